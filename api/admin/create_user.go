@@ -3,6 +3,7 @@ package admin
 import (
 	"net/http"
 
+	api "github.com/danmuck/dps_http/api/v1"
 	logs "github.com/danmuck/dps_lib/logs"
 
 	"github.com/gin-gonic/gin"
@@ -26,12 +27,15 @@ func CreateUser() gin.HandlerFunc {
 			username = dummyString(4, "dps")
 		}
 
-		if _, found := service.storage.Lookup(service.userDB, bson.M{"username": username}); found {
+		ctx, cancel := service.withDeadline(api.CallerContext(c))
+		defer cancel()
+
+		if _, err := service.storage.Lookup(ctx, service.userDB, bson.M{"username": username}); err == nil {
 			logs.Log("[DEV]> User %s already exists, generating a new one", username)
 			username = dummyString(4, "dps")
 		}
 
-		if err := createDummyUser(username); err != nil {
+		if err := createDummyUser(c.Request.Context(), username); err != nil {
 			// Store the user in the database
 			// if err := service.storage.Store(service.userDB, user.ID.Hex(), user); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -1,12 +1,14 @@
 package admin
 
 import (
+	"context"
 	"net/http"
 	"strconv"
 
+	api "github.com/danmuck/dps_http/api/v1"
+	"github.com/danmuck/dps_http/lib/storage"
 	logs "github.com/danmuck/dps_lib/logs"
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
 func CreateUsersX() gin.HandlerFunc {
@@ -23,7 +25,7 @@ func CreateUsersX() gin.HandlerFunc {
 			})
 			return
 		}
-		err = CreateXUsers(N)
+		err = CreateXUsers(api.CallerContext(c), N)
 		if err != nil {
 			logs.Err("[DEV]> CreateUser: failed to create %d dummy users: %v", N, err)
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -36,21 +38,54 @@ func CreateUsersX() gin.HandlerFunc {
 	}
 }
 
-func CreateXUsers(x int) error {
+// dummies are written (and deleted) dummyBatch at a time
+const dummyBatch = 100
+
+// CreateXUsers creates x dummy users in batches, stopping early if ctx is cancelled
+// note: a random username that is already taken fails on the unique index
+// and is skipped rather than looked up beforehand
+func CreateXUsers(ctx context.Context, x int) error {
 	logs.Info("[DEV]> Creating ++(%d) dummy users", x)
-	for range x {
-		username := dummyString(8, "dps")
-		if _, found := service.storage.Lookup(service.userDB, bson.M{"username": username}); found {
-			logs.Log("[DEV]> User %s already exists, generating a new one", username)
-			username = dummyString(8, "dps")
+	created := 0
+	for done := 0; done < x; done += dummyBatch {
+		if err := ctx.Err(); err != nil {
+			logs.Warn("[DEV]> CreateXUsers: stopped early: %v", err)
+			return err
+		}
+		items := make([]storage.Item, 0, dummyBatch)
+		for range min(dummyBatch, x-done) {
+			user, err := newDummyUser(dummyString(8, "dps"))
+			if err != nil {
+				logs.Warn("[DEV]> CreateUser: error: %s, user not created", err)
+				continue
+			}
+			items = append(items, storage.Item{Key: user.ID.Hex(), Value: user})
 		}
 
-		if err := createDummyUser(username); err != nil {
-			logs.Warn("[DEV]> CreateUser: error: %s, user not created", err)
-			continue
+		n, err := storeDummies(ctx, items)
+		if err != nil {
+			logs.Err("[DEV]> CreateXUsers: batch failed: %v", err)
+			return err
 		}
+		created += n
 	}
-	logs.Info("[DEV]> Created ++(%d) dummy users", x)
+	logs.Info("[DEV]> Created ++(%d) dummy users", created)
 
 	return nil
 }
+
+// storeDummies writes one batch under the service deadline
+// and returns how many users were stored
+func storeDummies(parent context.Context, items []storage.Item) (int, error) {
+	ctx, cancel := service.withDeadline(parent)
+	defer cancel()
+	results, err := service.storage.ConnectOrCreateBucket(ctx, service.userDB).BatchStore(ctx, items)
+	if err != nil {
+		return 0, err
+	}
+	failed := storage.Failed(results)
+	for _, result := range failed {
+		logs.Warn("[DEV]> CreateUser: error: %s, user not created", result.Err)
+	}
+	return len(items) - len(failed), nil
+}
@@ -1,6 +1,7 @@
 package admin
 
 import (
+	"context"
 	"math/rand"
 	"time"
 
@@ -33,6 +34,9 @@ func clamp(x int) int {
 
 func (dg *DataGenerator) start() {
 	logs.Dev("DataGenerator started ...")
+	// background work is not tied to a request, each storage call is still
+	// bounded by the service deadline
+	ctx := context.Background()
 	go func() {
 		for {
 			select {
@@ -49,24 +53,24 @@ func (dg *DataGenerator) start() {
 				n := clamp(nd + na)
 				switch flip {
 				case 0:
-					go CreateXUsers(n)
+					go CreateXUsers(ctx, n)
 				case 1:
-					go DeleteXDummies(n)
+					go DeleteXDummies(ctx, n)
 				case 2:
-					go CreateXUsers(c + 75)
-					go DeleteXDummies(d + 75)
+					go CreateXUsers(ctx, c+75)
+					go DeleteXDummies(ctx, d+75)
 				case 3:
-					go CreateXUsers(c + 75)
-					go CreateXUsers(c + 75)
+					go CreateXUsers(ctx, c+75)
+					go CreateXUsers(ctx, c+75)
 				case 4:
-					go DeleteXDummies(d + 75)
-					go DeleteXDummies(d + 75)
+					go DeleteXDummies(ctx, d+75)
+					go DeleteXDummies(ctx, d+75)
 				case 5:
-					go CreateXUsers(c + 500)
-					go DeleteXDummies(d + 500)
+					go CreateXUsers(ctx, c+500)
+					go DeleteXDummies(ctx, d+500)
 				default:
-					go CreateXUsers(c + 5)
-					go DeleteXDummies(d + 5)
+					go CreateXUsers(ctx, c+5)
+					go DeleteXDummies(ctx, d+5)
 				}
 			}
 		}
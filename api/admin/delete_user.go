@@ -3,15 +3,20 @@ package admin
 import (
 	"net/http"
 
+	api "github.com/danmuck/dps_http/api/v1"
 	logs "github.com/danmuck/dps_lib/logs"
 	"github.com/gin-gonic/gin"
 )
 
+// DeleteUser moves a user to the trash, see ListTrash and RestoreUser
 func DeleteUser() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if err := service.storage.Delete(service.userDB, c.Param("id")); err != nil {
+		ctx, cancel := service.withDeadline(api.CallerContext(c))
+		defer cancel()
+
+		if err := service.storage.Delete(ctx, service.userDB, c.Param("id")); err != nil {
 			logs.Err("DeleteUser: failed to delete user %s: %v", c.Param("id"), err)
-			c.JSON(http.StatusInternalServerError, gin.H{
+			c.JSON(api.StorageStatus(err), gin.H{
 				"status": "error",
 				"error":  "failed to delete user",
 			})
@@ -1,13 +1,15 @@
 package admin
 
 import (
+	"context"
 	"net/http"
-	"slices"
 	"strconv"
 
+	api "github.com/danmuck/dps_http/api/v1"
+	"github.com/danmuck/dps_http/lib/storage"
 	logs "github.com/danmuck/dps_lib/logs"
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 func DeleteUsersX() gin.HandlerFunc {
@@ -22,7 +24,7 @@ func DeleteUsersX() gin.HandlerFunc {
 			})
 			return
 		}
-		err = DeleteXDummies(N)
+		err = DeleteXDummies(api.CallerContext(c), N)
 		if err != nil {
 			logs.Err("Failed to delete %d dummy users: %v", N, err)
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -36,62 +38,63 @@ func DeleteUsersX() gin.HandlerFunc {
 	}
 }
 
-func DeleteXDummies(x int) error {
+// DeleteXDummies deletes up to x users with the "dummy" role in batches,
+// stopping early if ctx is cancelled
+func DeleteXDummies(ctx context.Context, x int) error {
 	logs.Info("[DEV]> Deleting --(%d) dummy users", x)
-	bucket := service.storage.ConnectOrCreateBucket(service.userDB)
-	items, err := bucket.ListItems()
-	if err != nil {
-		logs.Err("Could not list user items: %v", err)
-		return err
-	}
+	// only the keys are needed
+	opts := storage.ListOptions{Filter: bson.M{"roles": "dummy"}, Fields: []string{"username"}}
 
 	deleted := 0
-	for _, doc := range items {
-		if deleted >= x {
-			break
-		}
-
-		// Get key (string)
-		keyStr, ok := doc["key"].(string)
-		if !ok {
-			logs.Warn("Skipping document with invalid key: %+v", doc["key"])
-			continue
-		}
-
-		// Get value map
-		val, ok := doc["value"].(map[string]any)
-		if !ok {
-			logs.Warn("Skipping document with invalid value: %+v", doc["value"])
-			continue
+	for deleted < x {
+		if err := ctx.Err(); err != nil {
+			logs.Warn("[DEV]> DeleteXDummies: stopped early: %v", err)
+			return err
 		}
-
-		// Check roles
-		rolesAny, ok := val["roles"].(primitive.A)
-		if !ok {
-			logs.Warn("Skipping user %s: roles field not primitive.A", keyStr)
-			continue
+		opts.Limit = int64(min(dummyBatch, x-deleted))
+		n, next, err := deleteDummies(ctx, opts)
+		if err != nil {
+			logs.Err("Could not delete users: %v", err)
+			return err
 		}
-
-		var roles []string
-		for _, r := range rolesAny {
-			if s, ok := r.(string); ok {
-				roles = append(roles, s)
-			}
+		deleted += n
+		if next == "" {
+			break
 		}
+		opts.Cursor = next
+	}
+	logs.Info("[DEV]> Deleted --(%d) dummy users", deleted)
+	return nil
+}
 
-		if !slices.Contains(roles, "dummy") {
-			continue
-		}
+// deleteDummies deletes one page of dummies under the service deadline
+// and returns how many were deleted along with the cursor of the next page
+func deleteDummies(parent context.Context, opts storage.ListOptions) (int, string, error) {
+	ctx, cancel := service.withDeadline(parent)
+	defer cancel()
+	page, err := service.storage.ListPage(ctx, service.userDB, opts)
+	if err != nil {
+		return 0, "", err
+	}
 
-		// Delete user
-		err := bucket.Delete(keyStr)
-		if err != nil {
-			logs.Err("Failed to delete user %s: %v", keyStr, err)
-			continue
+	// users are keyed by their hex id
+	keys := make([]string, 0, len(page.Items))
+	for _, item := range page.Items {
+		if key, ok := item["key"].(string); ok {
+			keys = append(keys, key)
 		}
+	}
+	if len(keys) == 0 {
+		return 0, "", nil
+	}
 
-		deleted++
+	results, err := service.storage.ConnectOrCreateBucket(ctx, service.userDB).BatchDelete(ctx, keys)
+	if err != nil {
+		return 0, "", err
 	}
-	logs.Info("[DEV]> Deleted --(%d) dummy users", deleted)
-	return nil
+	failed := storage.Failed(results)
+	for _, result := range failed {
+		logs.Err("Failed to delete user %s: %v", result.Key, result.Err)
+	}
+	return len(keys) - len(failed), page.Next, nil
 }
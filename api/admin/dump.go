@@ -0,0 +1,99 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+
+	api "github.com/danmuck/dps_http/api/v1"
+	"github.com/danmuck/dps_http/lib/storage/dump"
+	logs "github.com/danmuck/dps_lib/logs"
+	"github.com/gin-gonic/gin"
+)
+
+// maxImport bounds the size of an uploaded dump
+const maxImport = 64 << 20
+
+// ndjson writes the headers of a JSON Lines download on the first write,
+// so that an error before any document still gets a JSON response
+type ndjson struct {
+	c       *gin.Context
+	started bool
+}
+
+func (w *ndjson) Write(p []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		w.c.Header("Content-Type", "application/x-ndjson")
+		w.c.Header("Content-Disposition", `attachment; filename="`+w.c.Param("bucket")+`.jsonl"`)
+		w.c.Status(http.StatusOK)
+	}
+	return w.c.Writer.Write(p)
+}
+
+// ExportBucket streams a bucket as JSON Lines, see lib/storage/dump
+// note: only the buckets the admin service registered are reachable,
+// use cmd/dpsdump for the others; not bound by the service deadline
+//
+//	GET /admin/buckets/:bucket/export
+func ExportBucket() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.Param("bucket")
+		ctx := api.CallerContext(c)
+
+		w := &ndjson{c: c}
+		n, err := dump.Export(ctx, service.storage.ConnectOrCreateBucket(ctx, bucket), w)
+		if err != nil {
+			logs.Err("ExportBucket: %s after %d documents: %v", bucket, n, err)
+			if !w.started {
+				c.JSON(api.StorageStatus(err), gin.H{
+					"status": "error",
+					"error":  "failed to export " + bucket,
+				})
+			}
+			return
+		}
+		if !w.started {
+			// empty bucket, still an (empty) download
+			w.Write(nil)
+		}
+		logs.Info("exported %d documents from %s", n, bucket)
+	}
+}
+
+// ImportBucket loads a JSON Lines dump into a bucket, dry-run by default
+//
+//	POST /admin/buckets/:bucket/import?mode=dry-run
+//	POST /admin/buckets/:bucket/import?mode=upsert
+func ImportBucket() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.Param("bucket")
+		mode, err := dump.ParseMode(c.Query("mode"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ctx := api.CallerContext(c)
+		body := http.MaxBytesReader(c.Writer, c.Request.Body, maxImport)
+
+		report, err := dump.Import(ctx, service.storage.ConnectOrCreateBucket(ctx, bucket), body, mode)
+		if err != nil {
+			logs.Err("ImportBucket: %s: %v", bucket, err)
+			status := api.StorageStatus(err)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			c.JSON(status, gin.H{
+				"status": "error",
+				"error":  "failed to import " + bucket + ": " + err.Error(),
+				"report": report,
+			})
+			return
+		}
+		logs.Info("imported into %s: %+v", bucket, report)
+		c.JSON(http.StatusOK, gin.H{
+			"status": "ok",
+			"report": report,
+		})
+	}
+}
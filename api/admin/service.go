@@ -1,6 +1,7 @@
 package admin
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"time"
@@ -8,7 +9,8 @@ import (
 	"github.com/danmuck/dps_http/api/auth"
 	api "github.com/danmuck/dps_http/api/v1"
 	"github.com/danmuck/dps_http/configs"
-	"github.com/danmuck/dps_http/lib/storage/mongo"
+	"github.com/danmuck/dps_http/lib/storage"
+	"github.com/danmuck/dps_http/lib/storage/drivers"
 	"github.com/danmuck/dps_http/middleware"
 	logs "github.com/danmuck/dps_lib/logs"
 	"go.mongodb.org/mongo-driver/bson"
@@ -29,7 +31,9 @@ type AdminService struct {
 
 	// service specific structures
 	userDB  string
-	storage *mongo.MongoClient
+	storage storage.Client
+	timeout time.Duration // deadline for storage calls
+	trash   time.Duration // retention of deleted users, see PurgeTrash
 
 	datagen chan any
 }
@@ -49,6 +53,15 @@ func (svc *AdminService) Up(root *gin.RouterGroup) {
 	admin.POST("/gcx", CreateUsersX())
 	admin.POST("/dcx", DeleteUsersX()) // Delete user by ID
 
+	trash := admin.Group("/trash")
+	trash.GET("/", ListTrash())
+	trash.POST("/:id/restore", RestoreUser())
+	trash.DELETE("/", PurgeTrash())
+
+	buckets := admin.Group("/buckets")
+	buckets.GET("/:bucket/export", ExportBucket())
+	buckets.POST("/:bucket/import", ImportBucket())
+
 	logs.Info("[AdminService] up at %s and %s", root.BasePath(), ug.BasePath())
 }
 
@@ -69,6 +82,17 @@ func (svc *AdminService) DependsOn() []string {
 	return nil
 }
 
+// users returns the user bucket decoded into api.User
+func (svc *AdminService) users(ctx context.Context) *storage.TypedBucket[api.User] {
+	return storage.Typed[api.User](svc.storage.ConnectOrCreateBucket(ctx, svc.userDB))
+}
+
+// withDeadline bounds storage calls made on behalf of parent
+// by the service deadline (see configs.ServiceTimeout)
+func (svc *AdminService) withDeadline(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, svc.timeout)
+}
+
 // returns a pointer to the server instance
 // expects its state to be initialized and ready for Up()
 func NewAdminService(endpoint string) *AdminService {
@@ -76,9 +100,9 @@ func NewAdminService(endpoint string) *AdminService {
 	if err != nil {
 		logs.Fatal(err.Error())
 	}
-	m, err := mongo.NewMongoStore(cfg.DB.MongoURI, cfg.DB.Name)
+	m, err := drivers.Open(cfg.DB)
 	if err != nil {
-		logs.Log("failed to create mongo store: %v", err)
+		logs.Log("failed to open storage: %v", err)
 		return nil
 	}
 	version := "v1"
@@ -86,9 +110,22 @@ func NewAdminService(endpoint string) *AdminService {
 		endpoint: endpoint,
 		version:  version,
 		userDB:   "users" + version,
-		storage:  m,
+		storage:  m.Service(endpoint),
+		timeout:  cfg.ServiceTimeout(endpoint),
+		trash:    cfg.DB.Trash,
 		datagen:  newDataGenerator(),
 	}
+	// the user bucket is shared with the other services
+	if err := m.Register(endpoint, service.userDB, true); err != nil {
+		logs.Err("failed to register bucket %s: %v", service.userDB, err)
+		return nil
+	}
+	storage.RegisterPolicy(service.userDB, api.UserPolicy)
+	storage.RegisterEncryption(service.userDB, api.UserEncrypted...)
+
+	ctx, cancel := service.withDeadline(context.Background())
+	defer cancel()
+	service.storage.ConnectOrCreateBucket(ctx, service.userDB, api.UserIndexes...)
 	return service
 }
 
@@ -102,25 +139,43 @@ func dummyString(length int, postfix string) string {
 	return fmt.Sprintf("%s%s", string(b), postfix)
 }
 
-func createDummyUser(username string) error {
-	email := dummyString(8, "@dirtranch.io")
-	password := dummyString(4, "crypt")
+func createDummyUser(parent context.Context, username string) error {
+	ctx, cancel := service.withDeadline(parent)
+	defer cancel()
+
 	if username == "" || username == "undefined" {
 		// logs.Log("[DEV]> No username provided, generating a random one")
 		username = dummyString(4, "dps")
 	}
 
-	if _, found := service.storage.Lookup(service.userDB, bson.M{"username": username}); found {
+	if _, err := service.storage.Lookup(ctx, service.userDB, bson.M{"username": username}); err == nil {
 		logs.Warn("[DEV]> User %s already exists, generating a new one", username)
 		username = dummyString(4, "dps")
 	}
 
 	// logs.Log("[DEV]> Creating user: %s", username)
 
+	user, err := newDummyUser(username)
+	if err != nil {
+		return err
+	}
+
+	// Store the user in the database
+	if err := service.storage.Store(ctx, service.userDB, user.ID.Hex(), user); err != nil {
+		return err
+	}
+	return nil
+}
+
+// newDummyUser builds a dummy user with a random email and password
+func newDummyUser(username string) (api.User, error) {
+	email := dummyString(8, "@dirtranch.io")
+	password := dummyString(4, "crypt")
+
 	hash, err := auth.HashPassword(password)
 	if err != nil {
 		logs.Err("[DEV]> Hashing error: %v", err)
-		return err
+		return api.User{}, err
 	}
 	// t := sha512.Sum512([]byte(username))
 	// logs.Dev("token: %s", t)
@@ -140,10 +195,5 @@ func createDummyUser(username string) error {
 	}
 
 	logs.Debug("[DEV]> User object: %s", user.String())
-
-	// Store the user in the database
-	if err := service.storage.Store(service.userDB, user.ID.Hex(), user); err != nil {
-		return err
-	}
-	return nil
+	return user, nil
 }
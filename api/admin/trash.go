@@ -0,0 +1,111 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	api "github.com/danmuck/dps_http/api/v1"
+	"github.com/danmuck/dps_http/lib/storage"
+	logs "github.com/danmuck/dps_lib/logs"
+	"github.com/gin-gonic/gin"
+)
+
+// ListTrash returns one page of deleted users
+//
+//	GET /admin/trash/?limit=25
+//	GET /admin/trash/?limit=25&cursor=<next>
+func ListTrash() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		opts := storage.ListOptions{Cursor: c.Query("cursor")}
+		if raw := c.Query("limit"); raw != "" {
+			limit, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || limit <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+				return
+			}
+			opts.Limit = limit
+		}
+
+		ctx, cancel := service.withDeadline(api.CallerContext(c))
+		defer cancel()
+
+		page, err := service.storage.ConnectOrCreateBucket(ctx, service.userDB).ListTrash(ctx, opts)
+		if err != nil {
+			logs.Err("ListTrash: %v", err)
+			c.JSON(api.StorageStatus(err), gin.H{
+				"status": "error",
+				"error":  "failed to retrieve deleted users",
+			})
+			return
+		}
+
+		users := make([]gin.H, 0, len(page.Items))
+		for _, item := range page.Items {
+			user, err := storage.Decode[api.User](item["value"])
+			if err != nil {
+				logs.Err("ListTrash: skipping %v: %v", item["key"], err)
+				continue
+			}
+			users = append(users, gin.H{
+				"user":    user,
+				"deleted": item[storage.Deleted],
+			})
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"users":       users,
+			"next_cursor": page.Next,
+		})
+	}
+}
+
+// RestoreUser takes a deleted user out of the trash
+//
+//	POST /admin/trash/:id/restore
+func RestoreUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := service.withDeadline(api.CallerContext(c))
+		defer cancel()
+
+		err := service.storage.ConnectOrCreateBucket(ctx, service.userDB).Restore(ctx, c.Param("id"))
+		if err != nil {
+			logs.Err("RestoreUser: failed to restore user %s: %v", c.Param("id"), err)
+			c.JSON(api.StorageStatus(err), gin.H{
+				"status": "error",
+				"error":  "failed to restore user",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "ok",
+			"message": "user restored successfully",
+		})
+	}
+}
+
+// PurgeTrash removes the users deleted longer ago than the retention
+// period (DB_TRASH_RETENTION) for good
+//
+//	DELETE /admin/trash/
+func PurgeTrash() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := service.withDeadline(api.CallerContext(c))
+		defer cancel()
+
+		cutoff := time.Now().Add(-service.trash)
+		n, err := service.storage.ConnectOrCreateBucket(ctx, service.userDB).Purge(ctx, cutoff)
+		if err != nil {
+			logs.Err("PurgeTrash: %v", err)
+			c.JSON(api.StorageStatus(err), gin.H{
+				"status": "error",
+				"error":  "failed to purge deleted users",
+			})
+			return
+		}
+		logs.Info("purged %d users deleted before %v", n, cutoff)
+		c.JSON(http.StatusOK, gin.H{
+			"status": "ok",
+			"purged": n,
+		})
+	}
+}
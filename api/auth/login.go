@@ -1,10 +1,12 @@
 package auth
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
 	api "github.com/danmuck/dps_http/api/v1"
+	"github.com/danmuck/dps_http/lib/storage"
 	logs "github.com/danmuck/dps_lib/logs"
 
 	"github.com/gin-gonic/gin"
@@ -27,22 +29,23 @@ func LoginHandler() gin.HandlerFunc {
 			return
 		}
 
+		ctx, cancel := service.withDeadline(api.CallerContext(c))
+		defer cancel()
+
 		// lookup user by username
 		logs.Log("received login request for user: %s", in.Username)
-		raw, found := service.storage.Lookup(service.userDB, bson.M{"username": in.Username})
-		if !found {
+		user, err := service.users(ctx).Find(ctx, bson.M{"username": in.Username})
+		if errors.Is(err, storage.ErrNotFound) {
 			logs.Log("user not found: %s", in.Username)
 			c.JSON(401, gin.H{"error": "invalid credentials"})
 			return
 		}
-		logs.Log("user found: %s", in.Username)
-		var user api.User
-		data, _ := bson.Marshal(raw)
-		if err := bson.Unmarshal(data, &user); err != nil {
-			logs.Log("unmarshal error: %v", err)
-			c.JSON(500, gin.H{"error": "server error"})
+		if err != nil {
+			logs.Err("lookup failed for user %s: %v", in.Username, err)
+			c.JSON(api.StorageStatus(err), gin.H{"error": "failed to look up user"})
 			return
 		}
+		logs.Log("user found: %s", in.Username)
 
 		// validate password against stored hash
 		if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(in.Password)) != nil {
@@ -56,6 +59,7 @@ func LoginHandler() gin.HandlerFunc {
 			"username": user.Username,
 			"sub":      user.ID.Hex(),
 			"roles":    user.Roles,
+			"tenant":   c.GetString("tenant"),
 			"exp":      time.Now().Add(24 * time.Hour).Unix(),
 		})
 		signed, err := token.SignedString([]byte(service.secret))
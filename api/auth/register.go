@@ -1,10 +1,12 @@
 package auth
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
 	api "github.com/danmuck/dps_http/api/v1"
+	"github.com/danmuck/dps_http/lib/storage"
 	logs "github.com/danmuck/dps_lib/logs"
 
 	"github.com/gin-gonic/gin"
@@ -32,15 +34,25 @@ func RegisterHandler() gin.HandlerFunc {
 			return
 		}
 
+		ctx, cancel := service.withDeadline(api.CallerContext(c))
+		defer cancel()
+
 		// uniqueness checks
 		// could extend these
-		if _, exists := service.storage.Lookup(service.userDB, bson.M{"username": in.Username}); exists {
-			c.JSON(http.StatusConflict, gin.H{"error": "username already in use"})
-			return
-		}
-		if _, exists := service.storage.Lookup(service.userDB, bson.M{"email": in.Email}); exists {
-			c.JSON(http.StatusConflict, gin.H{"error": "email already in use"})
-			return
+		// note: email is not public, the check runs as the system role
+		sys := storage.WithRoles(ctx, storage.RoleSystem)
+		for _, check := range [][2]string{{"username", in.Username}, {"email", in.Email}} {
+			field, value := check[0], check[1]
+			_, err := service.storage.Lookup(sys, service.userDB, bson.M{field: value})
+			if err == nil {
+				c.JSON(http.StatusConflict, gin.H{"error": field + " already in use"})
+				return
+			}
+			if !errors.Is(err, storage.ErrNotFound) {
+				logs.Err("uniqueness check on %s failed: %v", field, err)
+				c.JSON(api.StorageStatus(err), gin.H{"error": "failed to check " + field})
+				return
+			}
 		}
 
 		hash, err := HashPassword(in.Password)
@@ -71,6 +83,7 @@ func RegisterHandler() gin.HandlerFunc {
 			"username": user.Username,
 			"sub":      user.ID.Hex(),
 			"roles":    user.Roles,
+			"tenant":   c.GetString("tenant"),
 			"exp":      time.Now().Add(24 * time.Hour).Unix(),
 		})
 		logs.Debug("signing token for user: %s", user.Username)
@@ -81,8 +94,14 @@ func RegisterHandler() gin.HandlerFunc {
 		}
 		logs.Debug("token signed successfully for user: %s \n  %v", user.Username, tokenString)
 
-		if err := service.storage.Store(service.userDB, user.ID.Hex(), user); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create user"})
+		if err := service.storage.Store(ctx, service.userDB, user.ID.Hex(), user); err != nil {
+			logs.Err("failed to store user %s: %v", user.Username, err)
+			if errors.Is(err, storage.ErrConflict) {
+				// lost a race with a concurrent registration
+				c.JSON(http.StatusConflict, gin.H{"error": "username or email already in use"})
+				return
+			}
+			c.JSON(api.StorageStatus(err), gin.H{"error": "failed to create user"})
 			return
 		}
 
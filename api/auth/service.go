@@ -1,10 +1,14 @@
 package auth
 
 import (
+	"context"
 	"fmt"
+	"time"
 
+	api "github.com/danmuck/dps_http/api/v1"
 	"github.com/danmuck/dps_http/configs"
-	"github.com/danmuck/dps_http/lib/storage/mongo"
+	"github.com/danmuck/dps_http/lib/storage"
+	"github.com/danmuck/dps_http/lib/storage/drivers"
 	"github.com/danmuck/dps_http/middleware"
 	logs "github.com/danmuck/dps_lib/logs"
 	"github.com/gin-gonic/gin"
@@ -19,7 +23,8 @@ type AuthService struct {
 	endpoint, version string
 	secret            string
 	userDB            string
-	storage           *mongo.MongoClient
+	storage           storage.Client
+	timeout           time.Duration // deadline for storage calls
 }
 
 func (svc *AuthService) Up(rg *gin.RouterGroup) {
@@ -44,14 +49,25 @@ func (svc *AuthService) DependsOn() []string {
 	return nil
 }
 
+// users returns the user bucket decoded into api.User
+func (svc *AuthService) users(ctx context.Context) *storage.TypedBucket[api.User] {
+	return storage.Typed[api.User](svc.storage.ConnectOrCreateBucket(ctx, svc.userDB))
+}
+
+// withDeadline bounds storage calls made on behalf of parent
+// by the service deadline (see configs.ServiceTimeout)
+func (svc *AuthService) withDeadline(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, svc.timeout)
+}
+
 func NewAuthService(endpoint string) *AuthService {
 	cfg, err := configs.LoadConfig()
 	if err != nil {
 		logs.Fatal(err.Error())
 	}
-	m, err := mongo.NewMongoStore(cfg.DB.MongoURI, cfg.DB.Name)
+	m, err := drivers.Open(cfg.DB)
 	if err != nil {
-		logs.Err("failed to create mongo store: %v", err)
+		logs.Err("failed to open storage: %v", err)
 		return nil
 	}
 	version := "v1"
@@ -60,8 +76,20 @@ func NewAuthService(endpoint string) *AuthService {
 		version:  version,
 		userDB:   "users" + version, // need to fix this
 		secret:   cfg.Auth.JWTSecret,
-		storage:  m,
+		storage:  m.Service(endpoint),
+		timeout:  cfg.ServiceTimeout(endpoint),
 	}
+	// the user bucket is shared with the other services
+	if err := m.Register(endpoint, service.userDB, true); err != nil {
+		logs.Err("failed to register bucket %s: %v", service.userDB, err)
+		return nil
+	}
+	storage.RegisterPolicy(service.userDB, api.UserPolicy)
+	storage.RegisterEncryption(service.userDB, api.UserEncrypted...)
+
+	ctx, cancel := service.withDeadline(context.Background())
+	defer cancel()
+	service.storage.ConnectOrCreateBucket(ctx, service.userDB, api.UserIndexes...)
 	return service
 }
 
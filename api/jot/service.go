@@ -5,7 +5,8 @@ import (
 
 	api "github.com/danmuck/dps_http/api/v1"
 	"github.com/danmuck/dps_http/configs"
-	"github.com/danmuck/dps_http/lib/storage/mongo"
+	"github.com/danmuck/dps_http/lib/storage"
+	"github.com/danmuck/dps_http/lib/storage/drivers"
 	"github.com/danmuck/dps_http/middleware"
 	"github.com/danmuck/dps_lib/logs"
 
@@ -28,7 +29,7 @@ type JotService struct {
 
 	// service specific structures
 	userDB  string
-	storage *mongo.MongoClient
+	storage storage.Client
 }
 
 /*
@@ -68,9 +69,9 @@ func NewUserService(endpoint string) *JotService {
 	if err != nil {
 		logs.Fatal(err.Error())
 	}
-	m, err := mongo.NewMongoStore(cfg.DB.MongoURI, cfg.DB.Name)
+	m, err := drivers.Open(cfg.DB)
 	if err != nil {
-		logs.Log("failed to create mongo store: %v", err)
+		logs.Log("failed to open storage: %v", err)
 		return nil
 	}
 	version := "v1"
@@ -78,7 +79,11 @@ func NewUserService(endpoint string) *JotService {
 		endpoint: endpoint,
 		version:  version,
 		userDB:   endpoint + version,
-		storage:  m,
+		storage:  m.Service(endpoint),
+	}
+	if err := m.Register(endpoint, service.userDB, false); err != nil {
+		logs.Err("failed to register bucket %s: %v", service.userDB, err)
+		return nil
 	}
 	return service
 }
@@ -1,18 +1,18 @@
 package metrics
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/danmuck/dps_http/configs"
 	"github.com/danmuck/dps_http/lib/storage"
-	"github.com/danmuck/dps_http/lib/storage/mongo"
+	"github.com/danmuck/dps_http/lib/storage/drivers"
 	"github.com/danmuck/dps_http/middleware"
 	logs "github.com/danmuck/dps_lib/logs"
 
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 var service *UserMetricsService
@@ -24,12 +24,17 @@ type UserMetricsService struct {
 
 	total_users     int64
 	users_over_time map[string]int64
+	growth_keys     []string // users_over_time keys, oldest first, see AddGrowthData
 	total_roles     map[string]int64
+	user_roles      map[string][]string // roles by user key as of its last event, see applyEvent
 
 	running   bool
+	watching  bool // counts are kept up to date by watchUsers, see backgroundService
 	userDB    string
 	metricsDB string
-	storage   storage.Client // mongo client
+	storage   storage.Client // storage backend, see configs.Storage
+	stats     *storage.Stats // operation stats of the shared storage client
+	timeout   time.Duration  // deadline for storage calls
 
 	mu sync.Mutex
 }
@@ -42,6 +47,7 @@ func (svc *UserMetricsService) Up(rg *gin.RouterGroup) {
 	admin := rg.Group("/metrics")
 	admin.Use(middleware.JWTMiddleware(), middleware.AuthorizeByRoles("admin"))
 	admin.GET("/users", UserGrowth(svc))
+	admin.GET("/storage", StorageStats(svc))
 	svc.start()
 }
 
@@ -53,6 +59,13 @@ func (svc *UserMetricsService) Down() error {
 	return nil
 }
 
+// isRunning reports whether the service has started and not stopped since
+func (svc *UserMetricsService) isRunning() bool {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	return svc.running
+}
+
 func (svc *UserMetricsService) Version() string {
 	return svc.version
 }
@@ -61,6 +74,12 @@ func (svc *UserMetricsService) DependsOn() []string {
 	return nil
 }
 
+// withDeadline bounds storage calls made on behalf of parent
+// by the service deadline (see configs.ServiceTimeout)
+func (svc *UserMetricsService) withDeadline(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, svc.timeout)
+}
+
 func (svc *UserMetricsService) String() string {
 	return fmt.Sprintf(`
 	UserMetricsService:
@@ -81,19 +100,21 @@ func NewUserMetricsService(endpoint string) *UserMetricsService {
 	if err != nil {
 		logs.Fatal(err.Error())
 	}
-	m, err := mongo.NewMongoStore(cfg.DB.MongoURI, cfg.DB.Name)
+	m, err := drivers.Open(cfg.DB)
 	if err != nil {
-		logs.Log("failed to create mongo store: %v", err)
+		logs.Log("failed to open storage: %v", err)
 		return nil
 	}
-	logs.Dev("initialized mongo store %s from %s", m.Name(), cfg.String())
+	logs.Dev("initialized %s store %s from %s", m.Type(), m.Name(), cfg.String())
 	version := "v1"
 
 	service = &UserMetricsService{
 		endpoint: endpoint,
 		version:  version,
 
-		storage:   m,
+		storage:   m.Service(endpoint),
+		stats:     m.Stats(),
+		timeout:   cfg.ServiceTimeout(endpoint),
 		userDB:    "users" + version,
 		metricsDB: endpoint + version,
 		running:   false,
@@ -101,25 +122,39 @@ func NewUserMetricsService(endpoint string) *UserMetricsService {
 		total_users:     0,
 		users_over_time: make(map[string]int64),
 		total_roles:     make(map[string]int64),
+		user_roles:      make(map[string][]string),
+	}
+	// metrics reads the shared user bucket and keeps its own private
+	if err := m.Register(endpoint, service.userDB, true); err != nil {
+		logs.Err("failed to register bucket %s: %v", service.userDB, err)
+		return nil
+	}
+	if err := m.Register(endpoint, service.metricsDB, false); err != nil {
+		logs.Err("failed to register bucket %s: %v", service.metricsDB, err)
+		return nil
 	}
 	return service
 }
 
 func (svc *UserMetricsService) start() {
 	logs.Init("starting ...")
-	total_users, err := svc.storage.ConnectOrCreateBucket(service.userDB).Count()
+	ctx, cancel := svc.withDeadline(context.Background())
+	defer cancel()
+
+	total_users, err := svc.storage.ConnectOrCreateBucket(ctx, service.userDB).Count(ctx)
 	if err != nil {
 		logs.Err("failed to retrieve user count: %v", err)
 		return
 	}
 	logs.Log("loaded %d users", total_users)
 	svc.total_users = total_users
-	users_over_time, err := svc.storage.ConnectOrCreateBucket(service.metricsDB).ListItems()
+	users_over_time, err := svc.storage.ConnectOrCreateBucket(ctx, service.metricsDB).ListItems(ctx)
 	if err != nil {
 		logs.Err("failed to retrieve user metrics: %v", err)
 		return
 	}
 	total_over_time := make(map[string]int64)
+	growth_keys := make([]string, 0, len(users_over_time))
 	for idx, raw := range users_over_time {
 		if idx%250 == 1 {
 			logs.Debug("sanity check processing point %d/%d", idx, len(users_over_time))
@@ -135,11 +170,12 @@ func (svc *UserMetricsService) start() {
 			continue
 		}
 		total_over_time[timestamp] = count
+		growth_keys = append(growth_keys, timestamp)
 		if idx%500 == 1 {
 			logs.Debug("sanity check processing %d/%d { %s : %d }", idx, len(users_over_time), timestamp, count)
 		}
 	}
-	err = svc.UpdateRoleCounts()
+	err = svc.UpdateRoleCounts(ctx)
 	if err != nil {
 		logs.Err("failed to retrieve user roles: %v", err)
 		return
@@ -147,26 +183,44 @@ func (svc *UserMetricsService) start() {
 	svc.mu.Lock()
 	svc.running = true
 	svc.users_over_time = total_over_time
+	svc.growth_keys = growth_keys
 	svc.total_users = total_users
 	svc.mu.Unlock()
 
 	logs.Info("initialized with %d users, roles: %v, users_over_time points: %v",
 		total_users, svc.total_roles, len(total_over_time))
 
+	go svc.watchUsers()
 	go backgroundService()
 }
 
-func (svc *UserMetricsService) AddGrowthData() {
+// AddGrowthData records the current user count and returns the new point,
+// points older than configs.METRICS_retention are dropped oldest first
+// the same way the metrics bucket expires them
+func (svc *UserMetricsService) AddGrowthData() (string, int64) {
 	service.mu.Lock()
-	service.users_over_time[time.Now().Format(time.Stamp)] = svc.total_users
-	service.mu.Unlock()
+	defer service.mu.Unlock()
+	timestamp := time.Now().Format(time.Stamp)
+	if _, exists := service.users_over_time[timestamp]; !exists {
+		service.growth_keys = append(service.growth_keys, timestamp)
+	}
+	service.users_over_time[timestamp] = svc.total_users
+
+	max := int(configs.METRICS_retention / configs.METRICS_delay)
+	for len(service.growth_keys) > max {
+		delete(service.users_over_time, service.growth_keys[0])
+		service.growth_keys = service.growth_keys[1:]
+	}
+	return timestamp, svc.total_users
 }
 
-func (svc *UserMetricsService) UpdateTotalUsers() error {
+func (svc *UserMetricsService) UpdateTotalUsers(parent context.Context) error {
 	logs.Init("UserCount")
+	ctx, cancel := svc.withDeadline(parent)
+	defer cancel()
 	svc.mu.Lock()
 	defer svc.mu.Unlock()
-	total_users, err := service.storage.ConnectOrCreateBucket(service.userDB).Count()
+	total_users, err := service.storage.ConnectOrCreateBucket(ctx, service.userDB).Count(ctx)
 	if err != nil {
 		logs.Err("failed to connect to storage: %v", err)
 		return err
@@ -175,68 +229,149 @@ func (svc *UserMetricsService) UpdateTotalUsers() error {
 	return nil
 }
 
-func (svc *UserMetricsService) UpdateRoleCounts() error {
+// UpdateRoleCounts recounts users and users per role in the database,
+// the counts become the new basis of applyEvent
+func (svc *UserMetricsService) UpdateRoleCounts(parent context.Context) error {
 	logs.Init("UserCountByRole")
-	roleCounts := make(map[string]int64)
+	ctx, cancel := svc.withDeadline(parent)
+	defer cancel()
 
-	store := svc.storage.ConnectOrCreateBucket(service.userDB)
-	users, err := store.ListKeys()
+	store := svc.storage.ConnectOrCreateBucket(ctx, service.userDB)
+	roleCounts, err := storage.GroupCount(ctx, store, "roles")
 	if err != nil {
-		logs.Err("failed to list users: %v", err)
-		return fmt.Errorf("failed to list users: %w", err)
+		logs.Err("failed to count users by role: %v", err)
+		return fmt.Errorf("failed to count users by role: %w", err)
 	}
-	// count each role across all users
-	for idx, raw := range users {
-		if idx%250 == 1 {
-			logs.Debug("sanity check processing point %d/%d", idx, len(svc.users_over_time))
-		}
-		user, ok := raw.(map[string]any)
-		if !ok {
-			logs.Warn("skipping malformed user record: %v", raw)
-			continue
-		}
-		rolesRaw, ok := user["roles"]
-		if !ok {
-			logs.Warn("skipping user with no roles field: %v", user)
-			continue
-		}
-		roles, ok := rolesRaw.(primitive.A)
-		if !ok {
-			logs.Warn("skipping user with non-list roles: %v %T", rolesRaw, roles)
-			continue
-		}
-		for _, r := range roles {
-			roleStr, ok := r.(string)
-			if ok {
-				roleCounts[roleStr]++
-			}
-		}
+	total_users, err := store.Count(ctx)
+	if err != nil {
+		logs.Err("failed to count users: %v", err)
+		return fmt.Errorf("failed to count users: %w", err)
 	}
 	svc.mu.Lock()
 	defer svc.mu.Unlock()
 	svc.total_roles = roleCounts
+	svc.total_users = total_users
+	svc.user_roles = make(map[string][]string)
 
 	return nil
 }
-func (svc *UserMetricsService) WriteMetrics() {
-	service.mu.Lock()
-	defer service.mu.Unlock()
-	collection := service.storage.ConnectOrCreateBucket(service.metricsDB)
-	for timestamp, users := range service.users_over_time {
-		go func(ts string, us int64) {
-			if err := collection.Store(ts, us); err != nil {
-				logs.Err("failed to store user metrics: %v", err)
-				return
+
+// applyEvent folds a single users bucket write into the counts, it reports
+// false when it cannot: the roles a user had before an update or a delete
+// are only known for the users written since the last recount
+func (svc *UserMetricsService) applyEvent(ev storage.Event) bool {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	old, known := svc.user_roles[ev.Key]
+	if !known && ev.Op != storage.OpInsert {
+		return false
+	}
+	if known {
+		for _, role := range old {
+			svc.total_roles[role]--
+			if svc.total_roles[role] <= 0 {
+				delete(svc.total_roles, role)
+			}
+		}
+		delete(svc.user_roles, ev.Key)
+		svc.total_users--
+	}
+	if ev.Op != storage.OpDelete {
+		roles := rolesOf(ev.Value)
+		svc.user_roles[ev.Key] = roles
+		for _, role := range roles {
+			svc.total_roles[role]++
+		}
+		svc.total_users++
+	}
+	return true
+}
+
+// rolesOf returns the roles of a user value as read from storage
+func rolesOf(raw any) []string {
+	user, err := storage.Decode[struct {
+		Roles []string `bson:"roles"`
+	}](raw)
+	if err != nil {
+		logs.Warn("skipping malformed user record: %v", err)
+		return nil
+	}
+	return user.Roles
+}
+
+// watchUsers keeps the counts up to date from the users bucket change feed,
+// it rescans after every (re)subscribe since events before it are not replayed
+// if the backend cannot watch, backgroundService keeps rescanning instead
+// note: a write racing a rescan may be counted by both until the next one
+func (svc *UserMetricsService) watchUsers() {
+	for svc.isRunning() {
+		ctx, cancel := context.WithCancel(context.Background())
+		events, err := svc.storage.ConnectOrCreateBucket(ctx, svc.userDB).Watch(ctx)
+		if err != nil {
+			cancel()
+			logs.Warn("cannot watch %s, falling back to rescans: %v", svc.userDB, err)
+			return
+		}
+		if err := svc.UpdateRoleCounts(ctx); err != nil {
+			logs.Err("failed to retrieve user roles: %v", err)
+		}
+		svc.mu.Lock()
+		svc.watching = true
+		svc.mu.Unlock()
+		logs.Log("watching %s", svc.userDB)
+
+		// a burst of events is folded as a whole, if any of them cannot be
+		// the bucket is recounted once at its end
+		for ev := range events {
+			stale := !svc.applyEvent(ev)
+			for drained := false; !drained; {
+				select {
+				case ev, ok := <-events:
+					if drained = !ok; ok {
+						stale = !svc.applyEvent(ev) || stale
+					}
+				default:
+					drained = true
+				}
+			}
+			if !stale {
+				continue
 			}
-		}(timestamp, users)
+			logs.Debug("%s changed users of unknown roles, recounting", svc.userDB)
+			if err := svc.UpdateRoleCounts(ctx); err != nil {
+				logs.Err("failed to retrieve user roles: %v", err)
+			}
+		}
+		cancel()
+
+		// the feed dropped us (fell behind or the stream failed)
+		svc.mu.Lock()
+		svc.watching = false
+		svc.mu.Unlock()
+		logs.Warn("lost the %s change feed, resubscribing", svc.userDB)
+		time.Sleep(time.Second)
 	}
 }
 
+// WriteMetrics persists a growth data point in the background, it expires
+// after configs.METRICS_retention so the metrics bucket does not grow forever
+// note: writes outlive the caller so they are not bound to its context
+func (svc *UserMetricsService) WriteMetrics(timestamp string, users int64) {
+	go func() {
+		ctx, cancel := svc.withDeadline(context.Background())
+		defer cancel()
+		collection := svc.storage.ConnectOrCreateBucket(ctx, svc.metricsDB)
+		if err := collection.StoreWithTTL(ctx, timestamp, users, configs.METRICS_retention); err != nil {
+			logs.Err("failed to store user metrics: %v", err)
+		}
+	}()
+}
+
 //	Private handler for service lifecycle management
 //
 // //
 func backgroundService() {
-	if !service.running {
+	if !service.isRunning() {
 		logs.Warn("is not running, exiting handler")
 		return
 	}
@@ -244,22 +379,22 @@ func backgroundService() {
 	logs.Info("starting %s cycle", configs.METRICS_delay.String())
 	defer service.Down()
 
-	for service.running {
+	for service.isRunning() {
 		logs.Log("processing metrics...")
-		err := service.UpdateTotalUsers()
-		if err != nil {
-			logs.Err("failed to retrieve user count: %v", err)
-			return
-		}
-
-		err = service.UpdateRoleCounts()
-		if err != nil {
-			logs.Err("failed to retrieve user roles: %v", err)
-			return
+		service.mu.Lock()
+		watching := service.watching
+		service.mu.Unlock()
+
+		// rescan only when the change feed is not keeping the counts current
+		if !watching {
+			err := service.UpdateRoleCounts(context.Background())
+			if err != nil {
+				logs.Err("failed to retrieve user roles: %v", err)
+				return
+			}
 		}
 
-		service.AddGrowthData()
-		service.WriteMetrics()
+		service.WriteMetrics(service.AddGrowthData())
 
 		time.Sleep(configs.METRICS_delay) // wait for the next cycle
 	}
@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	logs "github.com/danmuck/dps_lib/logs"
+	"github.com/gin-gonic/gin"
+)
+
+// StorageStats returns the per bucket, per operation counts, error counts
+// and latency histograms of the storage client, optionally for one bucket
+//
+//	GET /metrics/storage
+//	GET /metrics/storage?bucket=usersv1
+//
+// callers only see the buckets of their own tenant, by their plain name
+func StorageStats(svc *UserMetricsService) gin.HandlerFunc {
+	logs.Init("initializing service handler [%s.%s]", svc.endpoint, svc.version)
+	return func(c *gin.Context) {
+		if svc.stats == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "storage is not instrumented",
+			})
+			return
+		}
+		bucket, tenant := c.Query("bucket"), c.GetString("tenant")
+		ops := make([]storage.OpStats, 0)
+		for _, op := range svc.stats.Snapshot() {
+			owner, name := storage.SplitTenant(op.Bucket)
+			if owner != tenant || bucket != "" && name != bucket {
+				continue
+			}
+			op.Bucket = name
+			ops = append(ops, op)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"operations": ops,
+			"message":    "storage metrics retrieved successfully",
+		})
+	}
+}
@@ -2,7 +2,11 @@ package metrics
 
 import (
 	"net/http"
+	"time"
 
+	api "github.com/danmuck/dps_http/api/v1"
+	"github.com/danmuck/dps_http/configs"
+	"github.com/danmuck/dps_http/lib/storage"
 	logs "github.com/danmuck/dps_lib/logs"
 	"github.com/gin-gonic/gin"
 )
@@ -12,7 +16,11 @@ func UserGrowth(svc *UserMetricsService) gin.HandlerFunc {
 	// it needs to be initialized at the server
 	logs.Init("initializing service handler [%s.%s]", svc.endpoint, svc.version)
 	return func(c *gin.Context) {
-		err := svc.UpdateTotalUsers()
+		if tenant := c.GetString("tenant"); tenant != "" {
+			tenantGrowth(svc, c)
+			return
+		}
+		err := svc.UpdateTotalUsers(c.Request.Context())
 		if err != nil {
 			logs.Err("failed to get user count: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -20,7 +28,7 @@ func UserGrowth(svc *UserMetricsService) gin.HandlerFunc {
 			})
 			return
 		}
-		err = svc.UpdateRoleCounts()
+		err = svc.UpdateRoleCounts(c.Request.Context())
 		if err != nil {
 			logs.Err("failed to get user count by role: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -28,8 +36,7 @@ func UserGrowth(svc *UserMetricsService) gin.HandlerFunc {
 			})
 			return
 		}
-		service.AddGrowthData()
-		service.WriteMetrics()
+		service.WriteMetrics(service.AddGrowthData())
 		svc.mu.Lock()
 		defer svc.mu.Unlock()
 
@@ -56,3 +63,55 @@ func UserGrowth(svc *UserMetricsService) gin.HandlerFunc {
 		})
 	}
 }
+
+// tenantGrowth serves the user metrics of a tenant other than the default
+// one, the service only tracks the default tenant in the background so
+// the counts are taken on request and the growth points are kept in the
+// metrics bucket of the tenant
+func tenantGrowth(svc *UserMetricsService, c *gin.Context) {
+	ctx, cancel := svc.withDeadline(api.CallerContext(c))
+	defer cancel()
+
+	users := svc.storage.ConnectOrCreateBucket(ctx, svc.userDB)
+	total_users, err := users.Count(ctx)
+	if err != nil {
+		logs.Err("failed to get user count: %v", err)
+		c.JSON(api.StorageStatus(err), gin.H{"error": "failed to get user count"})
+		return
+	}
+	total_roles, err := storage.GroupCount(ctx, users, "roles")
+	if err != nil {
+		logs.Err("failed to get user count by role: %v", err)
+		c.JSON(api.StorageStatus(err), gin.H{"error": "failed to get user count by role"})
+		return
+	}
+
+	points := svc.storage.ConnectOrCreateBucket(ctx, svc.metricsDB)
+	timestamp := time.Now().Format(time.Stamp)
+	if err := points.StoreWithTTL(ctx, timestamp, total_users, configs.METRICS_retention); err != nil {
+		logs.Err("failed to store user metrics: %v", err)
+	}
+	items, err := points.ListItems(ctx)
+	if err != nil {
+		logs.Err("failed to retrieve user metrics: %v", err)
+		c.JSON(api.StorageStatus(err), gin.H{"error": "failed to retrieve user metrics"})
+		return
+	}
+	users_over_time := make(map[string]int64, len(items))
+	for _, raw := range items {
+		timestamp, ok := raw["key"].(string)
+		count, isCount := raw["value"].(int64)
+		if !ok || !isCount {
+			logs.Warn("found malformed user metrics point: %v", raw)
+			continue
+		}
+		users_over_time[timestamp] = count
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total_users":     total_users,
+		"total_roles":     total_roles,
+		"users_over_time": MapTimestampToInt64Points(users_over_time),
+		"message":         "user metrics retrieved successfully",
+	})
+}
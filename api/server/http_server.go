@@ -7,6 +7,7 @@ import (
 	"time"
 
 	// "github.com/danmuck/dps_http/mongo_client"
+	"github.com/danmuck/dps_http/middleware"
 	"github.com/danmuck/dps_lib/logs"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -89,13 +90,15 @@ func NewHTTPServer() *HTTPServer {
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:3031", os.Getenv("CLIENT") + ":" + os.Getenv("CLIENT_PORT")},
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", middleware.TenantHeader},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
 	// router.SetTrustedProxies([]string{os.Getenv("CLIENT")})
 	router.Use(gin.Logger(), gin.Recovery())
+	// every request runs as a tenant, see storage.WithTenant
+	router.Use(middleware.TenantMiddleware())
 	router.Use(func(c *gin.Context) {
 		logs.Dev("Incoming request: %s %s (origin: %s)",
 			c.Request.Method, c.Request.URL.Path, c.Request.Header.Get("Origin"))
@@ -0,0 +1,222 @@
+package users
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // registers the gif decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	api "github.com/danmuck/dps_http/api/v1"
+	"github.com/danmuck/dps_http/configs"
+	"github.com/danmuck/dps_http/lib/storage"
+	logs "github.com/danmuck/dps_lib/logs"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// @NOTE avatars are uploaded images kept in the blob store, the user only
+// holds the url they are served from
+//
+//	POST /users/:id/avatar   multipart form, the image in the "avatar" field
+//	GET  /avatars/:name      public, the url of User.AvatarURL
+//
+// the content type is sniffed from the bytes (the one sent is ignored),
+// images are scaled down to fit configs.AVATAR_size and re-encoded,
+// which also drops their metadata (e.g. EXIF locations)
+// //
+
+// formats accepted for avatars, by sniffed content type
+var avatarTypes = []string{"image/png", "image/jpeg", "image/gif"}
+
+// largest width or height decoded, bounds the memory a decode takes
+const avatarMaxSide = 4096
+
+// UploadAvatar stores the uploaded image as the avatar of the user :id
+func UploadAvatar() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		logs.Init("UploadAvatar for user %s", id)
+
+		// the multipart framing gets some slack, the image is checked below
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, configs.AVATAR_limit+64<<10)
+		fh, err := c.FormFile("avatar")
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": avatarTooLarge()})
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "an avatar file is required"})
+			return
+		}
+		if fh.Size > configs.AVATAR_limit {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": avatarTooLarge()})
+			return
+		}
+		f, err := fh.Open()
+		if err != nil {
+			logs.Err("UploadAvatar: failed to open upload: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read avatar"})
+			return
+		}
+		defer f.Close()
+		raw, err := io.ReadAll(io.LimitReader(f, configs.AVATAR_limit+1))
+		if err != nil {
+			logs.Err("UploadAvatar: failed to read upload: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read avatar"})
+			return
+		}
+		if int64(len(raw)) > configs.AVATAR_limit {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": avatarTooLarge()})
+			return
+		}
+
+		sniffed := http.DetectContentType(raw)
+		if !slices.Contains(avatarTypes, sniffed) {
+			logs.Log("UploadAvatar: rejected %s for user %s", sniffed, id)
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "avatars must be png, jpeg or gif images"})
+			return
+		}
+		out, contentType, err := encodeAvatar(raw, sniffed)
+		if err != nil {
+			logs.Log("UploadAvatar: undecodable %s for user %s: %v", sniffed, id, err)
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx, cancel := service.withDeadline(api.CallerContext(c))
+		defer cancel()
+
+		// the user must exist before anything is stored for it
+		_, err = service.storage.Lookup(ctx, service.userDB, bson.M{"key": id}, "username")
+		if err != nil {
+			logs.Log("UploadAvatar: no user %s: %v", id, err)
+			c.JSON(api.StorageStatus(err), gin.H{"error": "failed to find user"})
+			return
+		}
+
+		name := storage.Qualify(storage.TenantFrom(ctx), id)
+		info, err := service.blobs.Put(ctx, "avatars/"+name, bytes.NewReader(out), contentType)
+		if err != nil {
+			logs.Err("UploadAvatar: failed to store avatar of %s: %v", id, err)
+			c.JSON(api.StorageStatus(err), gin.H{"error": "failed to store avatar"})
+			return
+		}
+
+		// the version changes the url so that caches fetch the new image
+		url := fmt.Sprintf("%s/%s?v=%d", service.avatars, name, info.Modified.Unix())
+		err = service.users(ctx).Patch(ctx, id, map[string]any{
+			"avatar_url": url,
+			"updated_at": primitive.NewDateTimeFromTime(time.Now()),
+		})
+		if err != nil {
+			logs.Err("UploadAvatar: failed to update user %s: %v", id, err)
+			c.JSON(api.StorageStatus(err), gin.H{"error": "failed to update user"})
+			return
+		}
+		logs.Log("UploadAvatar: stored %d bytes of %s for user %s", info.Size, contentType, id)
+		c.JSON(http.StatusOK, gin.H{"avatar_url": url})
+	}
+}
+
+// ServeAvatar streams the avatar :name, the avatar urls are versioned so
+// it can be cached for long
+func ServeAvatar() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		ctx, cancel := service.withDeadline(c.Request.Context())
+		defer cancel()
+
+		rc, info, err := service.blobs.Get(ctx, "avatars/"+name)
+		if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalid) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "avatar not found"})
+			return
+		}
+		if err != nil {
+			logs.Err("ServeAvatar: failed to get avatar %s: %v", name, err)
+			c.JSON(api.StorageStatus(err), gin.H{"error": "failed to get avatar"})
+			return
+		}
+		defer rc.Close()
+		c.DataFromReader(http.StatusOK, info.Size, info.ContentType, rc, map[string]string{
+			"Cache-Control":          "public, max-age=86400",
+			"Last-Modified":          info.Modified.UTC().Format(http.TimeFormat),
+			"X-Content-Type-Options": "nosniff",
+		})
+	}
+}
+
+func avatarTooLarge() string {
+	return fmt.Sprintf("avatars are limited to %d kB", configs.AVATAR_limit>>10)
+}
+
+// encodeAvatar decodes an image of a sniffed avatar type, scales it down
+// and encodes it again, jpeg as jpeg and everything else as png
+// note: only the first frame of an animated gif is kept
+func encodeAvatar(raw []byte, sniffed string) ([]byte, string, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid image: %w", err)
+	}
+	if cfg.Width > avatarMaxSide || cfg.Height > avatarMaxSide {
+		return nil, "", fmt.Errorf("images are limited to %dx%d pixels", avatarMaxSide, avatarMaxSide)
+	}
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid image: %w", err)
+	}
+	img = scaleDown(img, configs.AVATAR_size)
+
+	var out bytes.Buffer
+	if sniffed == "image/jpeg" {
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: 90})
+		return out.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(&out, img)
+	return out.Bytes(), "image/png", err
+}
+
+// scaleDown fits img in a size x size square keeping its aspect ratio,
+// every pixel is the average of the area it covers, smaller images are
+// returned as is
+func scaleDown(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	dw, dh := size, size
+	if w > h {
+		dh = max(1, h*size/w)
+	} else {
+		dw = max(1, w*size/h)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := range dh {
+		y0, y1 := b.Min.Y+y*h/dh, b.Min.Y+(y+1)*h/dh
+		for x := range dw {
+			x0, x1 := b.Min.X+x*w/dw, b.Min.X+(x+1)*w/dw
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
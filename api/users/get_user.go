@@ -1,38 +1,52 @@
 package users
 
 import (
+	"errors"
 	"net/http"
 
 	api "github.com/danmuck/dps_http/api/v1"
+	"github.com/danmuck/dps_http/lib/storage"
 	logs "github.com/danmuck/dps_lib/logs"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
-func GetUser() gin.HandlerFunc {
+// GetUser returns the user :username, private serves the UserPrivate
+// projection (the user itself and admins) instead of the public one
+func GetUser(private bool) gin.HandlerFunc {
+	fields := api.UserPublic
+	if private {
+		fields = api.UserPrivate
+	}
 	return func(c *gin.Context) {
 		logs.Init("GetUser getting %s", c.Param("username"))
 		key := c.Param("username")
 
-		// retrieve the raw map from storage
-		raw, ok := service.storage.Lookup(service.userDB, bson.M{"username": key})
-		if !ok {
+		ctx, cancel := service.withDeadline(api.CallerContext(c))
+		defer cancel()
+
+		// retrieve the user with its revision, sent as the ETag that
+		// UpdateUser accepts in If-Match
+		user, rev, err := service.users(ctx).FindRevision(ctx, bson.M{"username": key}, fields...)
+		if errors.Is(err, storage.ErrNotFound) {
 			logs.Log("not found: %s", key)
 			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
 			return
 		}
-		logs.Log("raw user map: %v", raw["username"])
-
-		rawBSON, _ := bson.Marshal(raw)
-		var user api.User
-		if err := bson.Unmarshal(rawBSON, &user); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to parse user"})
+		if err != nil {
+			logs.Err("failed to get user %s: %v", key, err)
+			c.JSON(api.StorageStatus(err), gin.H{"error": "failed to get user"})
 			return
 		}
 
 		// return the User struct
 		logs.Log("got user %s", user.String())
-		c.JSON(http.StatusOK, user)
+		c.Header("ETag", api.ETag(rev))
+		if private {
+			c.JSON(http.StatusOK, user)
+			return
+		}
+		c.JSON(http.StatusOK, user.Public())
 	}
 }
@@ -2,25 +2,72 @@ package users
 
 import (
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 
+	api "github.com/danmuck/dps_http/api/v1"
+	"github.com/danmuck/dps_http/lib/storage"
 	logs "github.com/danmuck/dps_lib/logs"
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
+// fields ListUsers accepts for ?sort=
+var sortable = []string{"username", "created_at", "updated_at"}
+
+// ListUsers returns one page of users
+//
+//	GET /users/?limit=25&sort=-created_at&role=admin
+//	GET /users/?limit=25&sort=-created_at&role=admin&cursor=<next>
+//
+// the response carries "next_cursor", pass it back as ?cursor= with the same
+// sort and role to get the following page ("" once exhausted)
 func ListUsers() gin.HandlerFunc {
 	logs.Init("ListUsers from storage: %s", service.storage.Name())
 	return func(c *gin.Context) {
-		users, err := service.storage.List(service.userDB)
+		opts := storage.ListOptions{
+			Cursor: c.Query("cursor"),
+			Sort:   c.Query("sort"),
+			Fields: api.UserPrivate, // admin only, see Up
+		}
+		if raw := c.Query("limit"); raw != "" {
+			limit, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || limit <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+				return
+			}
+			opts.Limit = limit
+		}
+		if field := strings.TrimPrefix(opts.Sort, "-"); field != "" && !slices.Contains(sortable, field) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cannot sort by " + field})
+			return
+		}
+		if role := c.Query("role"); role != "" {
+			opts.Filter = bson.M{"roles": role}
+		}
+
+		ctx, cancel := service.withDeadline(api.CallerContext(c))
+		defer cancel()
+
+		page, err := service.storage.ListPage(ctx, service.userDB, opts)
 		if err != nil {
 			logs.Err("failed to retrieve users: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{
+			c.JSON(api.StorageStatus(err), gin.H{
 				"status": "error",
 				"error":  "failed to retrieve users",
 			})
 			return
 		}
 
+		users := make([]any, 0, len(page.Items))
+		for _, item := range page.Items {
+			users = append(users, item["value"])
+		}
 		logs.Log("listed %d users", len(users))
-		c.JSON(http.StatusOK, users)
+		c.JSON(http.StatusOK, gin.H{
+			"users":       users,
+			"next_cursor": page.Next,
+		})
 	}
 }
@@ -0,0 +1,72 @@
+package users
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	api "github.com/danmuck/dps_http/api/v1"
+	"github.com/danmuck/dps_http/lib/storage"
+	logs "github.com/danmuck/dps_lib/logs"
+	"github.com/gin-gonic/gin"
+)
+
+// fields SearchUsers accepts for ?in=
+var searchable = []string{"username", "bio"}
+
+// SearchUsers returns the users whose username or bio contain any word of
+// the query, best matches first
+//
+//	GET /users/search?q=gopher
+//	GET /users/search?q=gopher&in=bio&limit=10
+func SearchUsers() gin.HandlerFunc {
+	logs.Init("SearchUsers from storage: %s", service.storage.Name())
+	return func(c *gin.Context) {
+		query := strings.TrimSpace(c.Query("q"))
+		if query == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+			return
+		}
+		var limit int64
+		if raw := c.Query("limit"); raw != "" {
+			n, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || n <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+				return
+			}
+			limit = n
+		}
+		var fields []string
+		if field := c.Query("in"); field != "" {
+			if !slices.Contains(searchable, field) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "cannot search in " + field})
+				return
+			}
+			fields = []string{field}
+		}
+
+		ctx, cancel := service.withDeadline(api.CallerContext(c))
+		defer cancel()
+
+		b := service.storage.ConnectOrCreateBucket(ctx, service.userDB)
+		items, err := b.Search(ctx, query, fields, limit, api.UserPublic...)
+		if err != nil {
+			logs.Err("failed to search users for %q: %v", query, err)
+			c.JSON(api.StorageStatus(err), gin.H{"error": "failed to search users"})
+			return
+		}
+
+		users := make([]api.PublicUser, 0, len(items))
+		for _, item := range items {
+			user, err := storage.Decode[api.User](item["value"])
+			if err != nil {
+				logs.Err("failed to decode user %v: %v", item["key"], err)
+				continue
+			}
+			users = append(users, user.Public())
+		}
+		logs.Log("found %d users for %q", len(users), query)
+		c.JSON(http.StatusOK, gin.H{"users": users})
+	}
+}
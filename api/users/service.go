@@ -1,11 +1,15 @@
 package users
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
+	"time"
 
+	api "github.com/danmuck/dps_http/api/v1"
 	"github.com/danmuck/dps_http/configs"
-	"github.com/danmuck/dps_http/lib/storage/mongo"
+	"github.com/danmuck/dps_http/lib/storage"
+	"github.com/danmuck/dps_http/lib/storage/drivers"
 	"github.com/danmuck/dps_http/middleware"
 	logs "github.com/danmuck/dps_lib/logs"
 
@@ -21,21 +25,30 @@ type UserService struct {
 	version  string
 
 	userDB  string
-	storage *mongo.MongoClient
+	storage storage.Client
+	blobs   storage.BlobStore // avatars, see avatar.go
+	avatars string            // url the avatars are served from
+	timeout time.Duration     // deadline for storage calls
 }
 
 func (svc *UserService) Up(rg *gin.RouterGroup) {
+	// public, avatars are loaded by img tags without a token
+	svc.avatars = rg.BasePath() + "/avatars"
+	rg.GET("/avatars/:name", ServeAvatar())
+
 	ug := rg.Group("/users")
 	ug.Use(middleware.JWTMiddleware(), middleware.AuthorizeByRoles("user")) // Apply JWT and role middleware to all routes in this group
 	{
 		// @NOTE -- locked to admin for development purposes
 		ug.GET("/", middleware.AuthorizeByRoles("admin"), ListUsers())
-		ug.GET("/:username", GetUser())
+		ug.GET("/search", SearchUsers())
+		ug.GET("/:username", GetUser(false))
 		uog := ug.Group("/")
 		uog.Use(middleware.AuthorizeResourceAccess())
 		{
-			uog.GET("/r/:username", GetUser()) // Get user by ID
-			uog.PUT("/:id", UpdateUser())      // Update user by ID
+			uog.GET("/r/:username", GetUser(true)) // Get user by ID, with the email
+			uog.PUT("/:id", UpdateUser())          // Update user by ID
+			uog.POST("/:id/avatar", UploadAvatar())
 			// uog.DELETE("/:id", DeleteUser())   // Delete user by ID
 		}
 	}
@@ -54,14 +67,30 @@ func (svc *UserService) DependsOn() []string {
 	return nil
 }
 
+// users returns the user bucket decoded into api.User
+func (svc *UserService) users(ctx context.Context) *storage.TypedBucket[api.User] {
+	return storage.Typed[api.User](svc.storage.ConnectOrCreateBucket(ctx, svc.userDB))
+}
+
+// withDeadline bounds storage calls made on behalf of parent
+// by the service deadline (see configs.ServiceTimeout)
+func (svc *UserService) withDeadline(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, svc.timeout)
+}
+
 func NewUserService(endpoint string) *UserService {
 	cfg, err := configs.LoadConfig()
 	if err != nil {
 		logs.Fatal(err.Error())
 	}
-	m, err := mongo.NewMongoStore(cfg.DB.MongoURI, cfg.DB.Name)
+	m, err := drivers.Open(cfg.DB)
 	if err != nil {
-		logs.Log("failed to create mongo store: %v", err)
+		logs.Log("failed to open storage: %v", err)
+		return nil
+	}
+	blobs, err := drivers.OpenBlobs(cfg.DB)
+	if err != nil {
+		logs.Log("failed to open blob storage: %v", err)
 		return nil
 	}
 	version := "v1"
@@ -69,8 +98,21 @@ func NewUserService(endpoint string) *UserService {
 		endpoint: endpoint,
 		version:  version,
 		userDB:   endpoint + version,
-		storage:  m,
+		storage:  m.Service(endpoint),
+		blobs:    blobs,
+		timeout:  cfg.ServiceTimeout(endpoint),
 	}
+	// the user bucket is shared with the other services
+	if err := m.Register(endpoint, service.userDB, true); err != nil {
+		logs.Err("failed to register bucket %s: %v", service.userDB, err)
+		return nil
+	}
+	storage.RegisterPolicy(service.userDB, api.UserPolicy)
+	storage.RegisterEncryption(service.userDB, api.UserEncrypted...)
+
+	ctx, cancel := service.withDeadline(context.Background())
+	defer cancel()
+	service.storage.ConnectOrCreateBucket(ctx, service.userDB, api.UserIndexes...)
 	return service
 }
 
@@ -1,8 +1,11 @@
 package users
 
 import (
+	"errors"
 	"net/http"
 
+	api "github.com/danmuck/dps_http/api/v1"
+	"github.com/danmuck/dps_http/lib/storage"
 	logs "github.com/danmuck/dps_lib/logs"
 	"github.com/gin-gonic/gin"
 )
@@ -13,11 +16,11 @@ func UpdateUser() gin.HandlerFunc {
 		logs.Init("UpdateUser: updating user %s", id)
 
 		// bind only the updatable fields
+		// note: avatars are uploaded, see UploadAvatar
 		var patch struct {
-			Email     string   `json:"email,omitempty"`
-			Bio       string   `json:"bio,omitempty"`
-			AvatarURL string   `json:"avatarURL,omitempty"`
-			Roles     []string `json:"roles,omitempty"` // if you want to allow role changes
+			Email string   `json:"email,omitempty"`
+			Bio   string   `json:"bio,omitempty"`
+			Roles []string `json:"roles,omitempty"` // if you want to allow role changes
 		}
 		if err := c.ShouldBindJSON(&patch); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON"})
@@ -34,10 +37,6 @@ func UpdateUser() gin.HandlerFunc {
 			logs.Log("UpdateUser: patching bio to %s", patch.Bio)
 			updates["bio"] = patch.Bio
 		}
-		if patch.AvatarURL != "" {
-			logs.Log("UpdateUser: patching avatarURL to %s", patch.AvatarURL)
-			updates["avatarURL"] = patch.AvatarURL
-		}
 		if len(patch.Roles) > 0 {
 			logs.Log("UpdateUser: patching roles to %v", patch.Roles)
 			updates["roles"] = patch.Roles
@@ -48,17 +47,45 @@ func UpdateUser() gin.HandlerFunc {
 			return
 		}
 
+		// If-Match carries the ETag from GetUser (or a previous update),
+		// without it the patch is applied unconditionally
+		rev, conditional, err := api.IfMatch(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx, cancel := service.withDeadline(api.CallerContext(c))
+		defer cancel()
+
 		// apply the patch
-		if err := service.storage.Patch(service.userDB, id, updates); err != nil {
+		users := service.users(ctx)
+		if conditional {
+			_, err = users.PatchIfRevision(ctx, id, rev, updates)
+		} else {
+			err = users.Patch(ctx, id, updates)
+		}
+		if errors.Is(err, storage.ErrStale) {
+			logs.Log("UpdateUser: user %s changed since revision %d", id, rev)
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": "user was modified, reload and retry"})
+			return
+		}
+		if err != nil {
 			logs.Log("UpdateUser: failed to update user %s: %v", id, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update"})
+			c.JSON(api.StorageStatus(err), gin.H{"error": "failed to update"})
 			return
 		}
 
-		// return the updated document (you can re‐fetch with Retrieve)
+		// return the updated document
 		logs.Log("UpdateUser: retreiving updated user %s", id)
-		updated, _ := service.storage.Retrieve(service.userDB, id)
-		logs.Log("UpdateUser: updated user %s: %v", id, updated)
+		updated, rev, err := users.GetRevision(ctx, id)
+		if err != nil {
+			logs.Log("UpdateUser: failed to retrieve user %s: %v", id, err)
+			c.JSON(api.StorageStatus(err), gin.H{"error": "failed to retrieve updated user"})
+			return
+		}
+		logs.Log("UpdateUser: updated user %s", updated.Username)
+		c.Header("ETag", api.ETag(rev))
 		c.JSON(http.StatusOK, updated)
 	}
 }
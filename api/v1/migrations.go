@@ -0,0 +1,57 @@
+package v1
+
+import (
+	"context"
+	"time"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	"github.com/danmuck/dps_http/lib/storage/migrate"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UsersV1 is the users bucket of this api version
+// note: services still derive it as "users" + version
+const UsersV1 = "usersv1"
+
+// Migrations are the data migrations of this api version, applied in
+// order by cmd/migrate; append new ones, never renumber or edit old ones
+var Migrations = []migrate.Migration{
+	{
+		Version: 1,
+		Name:    "backfill_users_updated_at",
+		Up:      backfillUpdatedAt,
+	},
+	{
+		Version: 2,
+		Name:    "seal_users_encrypted_fields",
+		Up: func(ctx context.Context, c storage.Client) error {
+			_, err := ResealUsers(ctx, c)
+			return err
+		},
+	},
+}
+
+// backfillUpdatedAt sets updated_at on users that never had it,
+// to created_at when known and to now otherwise
+func backfillUpdatedAt(ctx context.Context, c storage.Client) error {
+	now := primitive.NewDateTimeFromTime(time.Now())
+	_, err := migrate.Backfill(ctx, c.ConnectOrCreateBucket(ctx, UsersV1, UserIndexes...),
+		func(user map[string]any) map[string]any {
+			if _, ok := user["updated_at"]; ok {
+				return nil
+			}
+			if created, ok := user["created_at"]; ok {
+				return map[string]any{"updated_at": created}
+			}
+			return map[string]any{"updated_at": now}
+		})
+	return err
+}
+
+// ResealUsers encrypts the UserEncrypted fields of users stored before
+// they were encrypted and reseals the others with the current key,
+// run it after adding a key (see DB_KEYS) and before dropping the old one
+func ResealUsers(ctx context.Context, c storage.Client) (int, error) {
+	storage.RegisterEncryption(UsersV1, UserEncrypted...)
+	return storage.Reseal(ctx, c.ConnectOrCreateBucket(ctx, UsersV1, UserIndexes...))
+}
@@ -2,7 +2,9 @@ package v1
 
 import (
 	"fmt"
+	"slices"
 
+	"github.com/danmuck/dps_http/lib/storage"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -62,6 +64,69 @@ type User struct {
 	UpdatedAt primitive.DateTime `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
 }
 
+// UserPolicy is the field policy of every users bucket
+// note: email is only searchable by admins and internal checks,
+// secrets (password_hash, token) are never queryable
+var UserPolicy = storage.Policy{Fields: map[string]storage.Rule{
+	"username":   {Ops: []string{"$in"}},
+	"bio":        {},
+	"roles":      {Ops: []string{"$in", "$nin"}},
+	"email":      {Roles: []string{"admin"}},
+	"created_at": {Ops: []string{"$gt", "$gte", "$lt", "$lte"}, Roles: []string{"admin"}},
+	"updated_at": {Ops: []string{"$gt", "$gte", "$lt", "$lte"}, Roles: []string{"admin"}},
+}}
+
+// UserIndexes are declared on every users bucket
+// note: the unique indexes are what actually guarantees unique usernames
+// and emails, the register lookups only produce a friendlier error
+var UserIndexes = []storage.Index{
+	{Fields: []string{"username"}, Unique: true},
+	{Fields: []string{"email"}, Unique: true},
+	{Fields: []string{"roles"}},
+	{Fields: []string{"username", "bio"}, Text: true}, // see users.SearchUsers
+}
+
+// UserPublic is the projection of users served to every authenticated
+// user, the secrets (password_hash, token) are never read for it
+// note: email is admin only in UserPolicy, it is not public either
+var UserPublic = []string{
+	"_id", "username", "roles",
+	"bio", "avatar_url", "created_at", "updated_at",
+}
+
+// UserPrivate is the projection of users served to the user itself and
+// to admins, UserPublic with the email
+var UserPrivate = append(slices.Clone(UserPublic), "email")
+
+// PublicUser is the part of a User anyone may see, see UserPublic
+type PublicUser struct {
+	ID        primitive.ObjectID `json:"_id"`
+	Username  string             `json:"username"`
+	Roles     []string           `json:"roles"`
+	Bio       string             `json:"bio,omitempty"`
+	AvatarURL string             `json:"avatar_url,omitempty"`
+	CreatedAt primitive.DateTime `json:"created_at,omitempty"`
+	UpdatedAt primitive.DateTime `json:"updated_at,omitempty"`
+}
+
+// Public returns the public part of u
+func (u *User) Public() PublicUser {
+	return PublicUser{
+		ID:        u.ID,
+		Username:  u.Username,
+		Roles:     u.Roles,
+		Bio:       u.Bio,
+		AvatarURL: u.AvatarURL,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+	}
+}
+
+// UserEncrypted are the value fields of every users bucket that are
+// encrypted at rest, equality lookups on them still work (see storage.Seal)
+// note: User has no ContactInfo yet, its phone is sealed once it stores one
+var UserEncrypted = []string{"email", "contact.phone"}
+
 func (u *User) String() string {
 	var token string = "[no token]"
 	if len(u.Token) > 20 {
@@ -1,6 +1,77 @@
 package v1
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	"github.com/gin-gonic/gin"
+)
+
 // currently just prepends the endpoint with a slash
 func Path(endpoint string) string {
 	return "/" + endpoint
 }
+
+// StorageStatus maps a storage error onto an http status code
+//
+//	storage.ErrNotFound    -> 404
+//	storage.ErrConflict    -> 409
+//	storage.ErrUnavailable -> 503
+//	storage.ErrInvalid     -> 400
+//	storage.ErrStale       -> 412
+//	storage.ErrForbidden   -> 403
+//	anything else          -> 500
+func StorageStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, storage.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, storage.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrStale):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, storage.ErrForbidden):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// CallerContext returns the request context carrying the caller roles
+// set by the auth middleware, bucket policies check them (see storage.Rule),
+// the caller username recorded in tombstones by deletes and the caller
+// tenant whose buckets every storage call reaches (see storage.WithTenant)
+func CallerContext(c *gin.Context) context.Context {
+	raw, _ := c.Get("roles")
+	roles, _ := raw.([]string)
+	ctx := storage.WithRoles(c.Request.Context(), roles...)
+	ctx = storage.WithTenant(ctx, c.GetString("tenant"))
+	return storage.WithActor(ctx, c.GetString("username"))
+}
+
+// ETag formats a document revision as a strong entity tag, e.g. "3"
+func ETag(rev int64) string {
+	return strconv.Quote(strconv.FormatInt(rev, 10))
+}
+
+// IfMatch parses the If-Match header written from an ETag
+// ok is false when the header is absent or "*"
+func IfMatch(c *gin.Context) (rev int64, ok bool, err error) {
+	raw := strings.TrimSpace(c.GetHeader("If-Match"))
+	if raw == "" || raw == "*" {
+		return 0, false, nil
+	}
+	raw = strings.Trim(strings.TrimPrefix(raw, "W/"), `"`)
+	rev, err = strconv.ParseInt(raw, 10, 64)
+	if err != nil || rev < 0 {
+		return 0, false, fmt.Errorf("malformed If-Match %q", c.GetHeader("If-Match"))
+	}
+	return rev, true, nil
+}
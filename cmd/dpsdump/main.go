@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+
+	api "github.com/danmuck/dps_http/api/v1"
+	"github.com/danmuck/dps_http/configs"
+	"github.com/danmuck/dps_http/lib/storage"
+	"github.com/danmuck/dps_http/lib/storage/drivers"
+	"github.com/danmuck/dps_http/lib/storage/dump"
+	logs "github.com/danmuck/dps_lib/logs"
+	"github.com/joho/godotenv"
+)
+
+const usage = `usage: dpsdump <command> [flags] <bucket> [file]
+
+  export <bucket> [file]                         write the bucket as JSON Lines (default stdout)
+  import [-mode dry-run|upsert] <bucket> [file]  load a dump (default stdin, dry-run)
+
+TENANT=<id> dumps the buckets of that tenant instead of the default one
+`
+
+func init() {
+	// tries to load .env, but won’t crash if it’s missing
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: no .env file found, relying on environment variables")
+	}
+}
+
+func main() {
+	if len(os.Args) < 3 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	cmd := os.Args[1]
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	mode := flags.String("mode", string(dump.DryRun), "import mode: dry-run or upsert")
+	flags.Parse(os.Args[2:])
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	bucket, file := flags.Arg(0), flags.Arg(1)
+
+	cfg, err := configs.LoadConfig()
+	if err != nil {
+		logs.Fatal(err.Error())
+	}
+	m, err := drivers.Open(cfg.DB)
+	if err != nil {
+		logs.Fatal("failed to open storage: %v", err)
+	}
+	// dumps carry encrypted user fields in plaintext, see lib/storage/dump
+	storage.RegisterEncryption(api.UsersV1, api.UserEncrypted...)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := storage.ValidTenant(os.Getenv("TENANT")); err != nil {
+		logs.Fatal(err.Error())
+	}
+	ctx = storage.WithTenant(storage.WithRoles(ctx, storage.RoleSystem), os.Getenv("TENANT"))
+	b := m.ConnectOrCreateBucket(ctx, bucket)
+
+	switch cmd {
+	case "export":
+		var w io.Writer = os.Stdout
+		if file != "" {
+			f, err := os.Create(file)
+			if err != nil {
+				logs.Fatal(err.Error())
+			}
+			defer f.Close()
+			w = f
+		}
+		n, err := dump.Export(ctx, b, w)
+		if err != nil {
+			logs.Fatal("export %s after %d documents: %v", bucket, n, err)
+		}
+		fmt.Fprintf(os.Stderr, "exported %d documents from %s\n", n, bucket)
+	case "import":
+		mode, err := dump.ParseMode(*mode)
+		if err != nil {
+			logs.Fatal(err.Error())
+		}
+		var r io.Reader = os.Stdin
+		if file != "" {
+			f, err := os.Open(file)
+			if err != nil {
+				logs.Fatal(err.Error())
+			}
+			defer f.Close()
+			r = f
+		}
+		report, err := dump.Import(ctx, b, r, mode)
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+		if err != nil {
+			logs.Fatal("import %s: %v", bucket, err)
+		}
+		if len(report.Failed) > 0 {
+			os.Exit(1)
+		}
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+
+	api "github.com/danmuck/dps_http/api/v1"
+	"github.com/danmuck/dps_http/configs"
+	"github.com/danmuck/dps_http/lib/storage"
+	"github.com/danmuck/dps_http/lib/storage/drivers"
+	"github.com/danmuck/dps_http/lib/storage/migrate"
+	logs "github.com/danmuck/dps_lib/logs"
+	"github.com/joho/godotenv"
+)
+
+const usage = `usage: migrate [-all-tenants] <command> [arg]
+
+  up [version]   apply the pending migrations, up to version if given
+  down [steps]   revert the last steps applied migrations (default 1)
+  status         list the migrations and whether they are applied
+  reseal         reseal the encrypted user fields with the current key
+
+TENANT=<id> runs against the buckets of that tenant instead of the default one
+-all-tenants runs against the default tenant and every tenant with users or
+migrations, one after the other
+`
+
+var allTenants = flag.Bool("all-tenants", false, "run against every tenant")
+
+func init() {
+	// tries to load .env, but won’t crash if it’s missing
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: no .env file found, relying on environment variables")
+	}
+}
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 1 || !slices.Contains([]string{"up", "down", "status", "reseal"}, args[0]) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	arg := 0
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		arg = n
+	}
+
+	cfg, err := configs.LoadConfig()
+	if err != nil {
+		logs.Fatal(err.Error())
+	}
+	m, err := drivers.Open(cfg.DB)
+	if err != nil {
+		logs.Fatal("failed to open storage: %v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	tenants, err := targets(ctx, m)
+	if err != nil {
+		logs.Fatal(err.Error())
+	}
+
+	for _, tenant := range tenants {
+		if *allTenants {
+			fmt.Printf("== tenant %s\n", label(tenant))
+		}
+		if err := run(storage.WithTenant(ctx, tenant), m, args[0], arg); err != nil {
+			logs.Fatal("tenant %s: %v", label(tenant), err)
+		}
+	}
+}
+
+// targets returns the tenants to run against, TENANT or with -all-tenants
+// every tenant that has a users or a migrations bucket
+// note: the default tenant is always part of -all-tenants
+func targets(ctx context.Context, m *storage.Manager) ([]string, error) {
+	tenant := os.Getenv("TENANT")
+	if err := storage.ValidTenant(tenant); err != nil {
+		return nil, err
+	}
+	if !*allTenants {
+		return []string{tenant}, nil
+	}
+	if tenant != "" {
+		return nil, fmt.Errorf("TENANT and -all-tenants are exclusive")
+	}
+	tenants := []string{""}
+	for _, bucket := range []string{api.UsersV1, migrate.Bucket} {
+		found, err := storage.TenantsOf(ctx, m, bucket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tenants: %w", err)
+		}
+		for _, t := range found {
+			if !slices.Contains(tenants, t) {
+				tenants = append(tenants, t)
+			}
+		}
+	}
+	slices.Sort(tenants)
+	return tenants, nil
+}
+
+// run runs one command against the tenant of ctx
+func run(ctx context.Context, m *storage.Manager, cmd string, arg int) error {
+	runner, err := migrate.NewRunner(ctx, m, api.Migrations...)
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "up":
+		done, err := runner.Up(ctx, arg)
+		report("applied", done)
+		return err
+	case "down":
+		if arg == 0 {
+			arg = 1
+		}
+		done, err := runner.Down(ctx, arg)
+		report("reverted", done)
+		return err
+	case "status":
+		status, err := runner.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, s := range status {
+			applied := "pending"
+			if s.Applied {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			if s.Unknown {
+				applied += " (unknown to this build)"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return w.Flush()
+	case "reseal":
+		n, err := api.ResealUsers(ctx, m)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("resealed %d users\n", n)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+// label names a tenant in the output
+func label(tenant string) string {
+	if tenant == "" {
+		return "(default)"
+	}
+	return tenant
+}
+
+// report prints the migrations a command went through
+func report(verb string, done []migrate.Migration) {
+	if len(done) == 0 {
+		fmt.Printf("%s nothing\n", verb)
+	}
+	for _, m := range done {
+		fmt.Printf("%s %d %s\n", verb, m.Version, m.Name)
+	}
+}
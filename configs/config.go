@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -15,17 +17,32 @@ type Config struct {
 	Auth   Auth    // authentication configuration
 }
 type Storage struct {
-	T        string // type for future expansion, default: "mongo"
-	MongoURI string // mongo connection uri
-	Name     string // database name
+	T         string        // storage backend: "mongo" (default), "memory" or "sqlite"
+	MongoURI  string        // mongo connection uri
+	Path      string        // sqlite database file
+	Name      string        // database name
+	Timeout   time.Duration // default deadline for a storage call, see ServiceTimeout
+	Trash     time.Duration // how long soft deleted documents are kept before a purge
+	Keys      string        // encryption keys "id:base64,...", current first, see storage.ParseKeyring
+	BlindKey  string        // base64 key of the blind indexes on encrypted fields
+	CacheSize int           // entries of the read cache, 0 disables it, see storage.Cache
+	CacheTTL  time.Duration // how long a cached read is served
+	BlobDir   string        // blob directory of the memory and sqlite backends, see drivers.OpenBlobs
 }
 type Auth struct {
 	JWTSecret string // jwt secret for authentication
 }
 
 var (
-	METRICS_delay = 60 * time.Second
-	DATAGEN_delay = 120 * time.Second
+	METRICS_delay     = 60 * time.Second
+	METRICS_retention = 7 * 24 * time.Hour // how long a growth data point is kept
+	DATAGEN_delay     = 120 * time.Second
+	STORAGE_delay     = 5 * time.Second     // default deadline for a storage call
+	TRASH_delay       = 30 * 24 * time.Hour // default retention of soft deleted documents
+	CACHE_delay       = 30 * time.Second    // default ttl of cached reads
+	CACHE_size        = 1024                // default entries of the read cache
+	AVATAR_limit      = int64(2 << 20)      // max bytes of an uploaded avatar
+	AVATAR_size       = 256                 // avatars are scaled down to fit this many pixels square
 )
 
 func LoadConfig() (*Config, error) {
@@ -34,14 +51,28 @@ func LoadConfig() (*Config, error) {
 		Port:   os.Getenv("PORT"),
 		DB: Storage{
 			// needs to be updated alongside the storage/ api
-			T:        "mongo",
-			Name:     "dps_http",
-			MongoURI: os.Getenv("MONGO_URI"),
+			T:         os.Getenv("DB_TYPE"),
+			Name:      "dps_http",
+			MongoURI:  os.Getenv("MONGO_URI"),
+			Path:      os.Getenv("DB_PATH"),
+			Timeout:   durationEnv("DB_TIMEOUT", STORAGE_delay),
+			Trash:     durationEnv("DB_TRASH_RETENTION", TRASH_delay),
+			Keys:      os.Getenv("DB_KEYS"),
+			BlindKey:  os.Getenv("DB_BLIND_KEY"),
+			CacheSize: intEnv("DB_CACHE_SIZE", CACHE_size),
+			CacheTTL:  durationEnv("DB_CACHE_TTL", CACHE_delay),
+			BlobDir:   os.Getenv("DB_BLOB_DIR"),
 		},
 		Auth: Auth{
 			JWTSecret: os.Getenv("JWT_SECRET"),
 		},
 	}
+	if cfg.DB.T == "" {
+		cfg.DB.T = "mongo"
+	}
+	if cfg.DB.BlobDir == "" {
+		cfg.DB.BlobDir = "blobs"
+	}
 	if err := cfg.Validate(); err != nil {
 		panic(err)
 	}
@@ -49,9 +80,51 @@ func LoadConfig() (*Config, error) {
 
 	return cfg, err
 }
+
+// ServiceTimeout returns the storage deadline for a service
+// <ENDPOINT>_DB_TIMEOUT (e.g. AUTH_DB_TIMEOUT=2s) overrides DB_TIMEOUT
+func (cfg *Config) ServiceTimeout(endpoint string) time.Duration {
+	return durationEnv(strings.ToUpper(endpoint)+"_DB_TIMEOUT", cfg.DB.Timeout)
+}
+
+// durationEnv parses a time.Duration from the environment
+// falling back to def when unset or malformed
+func durationEnv(key string, def time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
+}
+
+// intEnv parses a non negative int from the environment
+// falling back to def when unset or malformed
+func intEnv(key string, def int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return def
+	}
+	return n
+}
+
 func (cfg *Config) String() string {
 	return fmt.Sprintf("Domain: %s, Port: %s, DB: %s, Auth: %s", cfg.Domain, cfg.Port, cfg.DB, cfg.Auth)
 }
+
+// String leaves the encryption keys out
+func (s Storage) String() string {
+	return fmt.Sprintf("{%s %s %s %s %s %s keys: %t cache: %d/%s blobs: %s}",
+		s.T, s.MongoURI, s.Path, s.Name, s.Timeout, s.Trash, s.Keys != "", s.CacheSize, s.CacheTTL, s.BlobDir)
+}
+
 func (cfg *Config) Validate() error {
 	// @TODO -- needs to issue a help like command
 	if cfg.Domain == "" {
@@ -63,12 +136,18 @@ func (cfg *Config) Validate() error {
 	if cfg.DB.T == "" {
 		return errors.New("database type is required")
 	}
-	if cfg.DB.MongoURI == "" {
+	if cfg.DB.T == "mongo" && cfg.DB.MongoURI == "" {
 		return errors.New("mongo uri is required")
 	}
+	if cfg.DB.T == "sqlite" && cfg.DB.Path == "" {
+		return errors.New("sqlite path is required")
+	}
 	if cfg.DB.Name == "" {
 		return errors.New("database name is required")
 	}
+	if cfg.DB.Keys != "" && cfg.DB.BlindKey == "" {
+		return errors.New("blind index key is required with encryption keys")
+	}
 	if cfg.Auth.JWTSecret == "" {
 		return errors.New("jwt secret is required")
 	}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// @NOTE Aggregate groups the live documents of a bucket on a value field
+// and counts (and optionally sums) each group, e.g. users per role
+//
+//	groups, err := b.Aggregate(ctx, storage.Aggregation{GroupBy: "roles"})
+//	// [{Key: "dummy", Count: 812} {Key: "admin", Count: 2} ...]
+//
+// an array field counts the document once per element, documents without
+// the field (or with an empty array) fall into the nil group
+// mongo runs it as a pipeline, memory and sqlite scan in process (Run)
+// //
+
+// Aggregation describes a group by over a bucket
+type Aggregation struct {
+	GroupBy string   // value field to group on, "" for a single group
+	Sum     []string // numeric value fields summed per group
+	Filter  any      // optional filter, checked against the bucket Policy
+}
+
+// Group is one group of an Aggregate
+type Group struct {
+	Key   any                // value of the GroupBy field, nil if absent
+	Count int64              // documents (array elements) in the group
+	Sums  map[string]float64 // per Sum field, non numeric values are skipped
+}
+
+// AggregateQuery is the backend facing form of Aggregation
+type AggregateQuery struct {
+	Path   string   // prefixed group path, "" for a single group
+	Sum    []string // Aggregation.Sum
+	Filter bson.M   // cleaned and prefixed filter, never nil
+}
+
+// Query validates the aggregation against the policy of the bucket
+// the group and sum fields must be queryable by the caller
+func (a Aggregation) Query(ctx context.Context, p Policy) (AggregateQuery, error) {
+	q := AggregateQuery{Sum: a.Sum}
+	for i, field := range append([]string{a.GroupBy}, a.Sum...) {
+		if field == "key" || field == "" && i > 0 {
+			return q, fmt.Errorf("%w: cannot aggregate on %q", ErrInvalid, field)
+		}
+		if err := p.Sortable(ctx, field); err != nil {
+			return q, err
+		}
+	}
+	if a.GroupBy != "" {
+		q.Path = Prefix(a.GroupBy)
+	}
+	filter, err := p.Clean(ctx, a.Filter)
+	if err != nil {
+		return q, err
+	}
+	q.Filter = filter
+	return q, nil
+}
+
+// Run aggregates docs in process, used by backends that cannot push the
+// aggregation down (memory, sqlite)
+func (q AggregateQuery) Run(docs []map[string]any) []Group {
+	groups := make(map[string]*Group)
+	add := func(key any, doc map[string]any) {
+		id := groupID(key)
+		g, ok := groups[id]
+		if !ok {
+			g = &Group{Key: key, Sums: make(map[string]float64, len(q.Sum))}
+			for _, field := range q.Sum {
+				g.Sums[field] = 0
+			}
+			groups[id] = g
+		}
+		g.Count++
+		for _, field := range q.Sum {
+			val, _ := Resolve(doc, Prefix(field))
+			if n, ok := number(val); ok {
+				g.Sums[field] += n
+			}
+		}
+	}
+	for _, doc := range docs {
+		if !Match(doc, q.Filter) {
+			continue
+		}
+		var key any
+		if q.Path != "" {
+			key, _ = Resolve(doc, q.Path)
+		}
+		var list []any
+		isList := false
+		switch l := key.(type) {
+		case bson.A:
+			list, isList = l, true
+		case []any:
+			list, isList = l, true
+		}
+		if !isList {
+			add(key, doc)
+			continue
+		}
+		if len(list) == 0 {
+			add(nil, doc)
+		}
+		for _, elem := range list {
+			add(elem, doc)
+		}
+	}
+	out := make([]Group, 0, len(groups))
+	for _, g := range groups {
+		out = append(out, *g)
+	}
+	sortGroups(out)
+	return out
+}
+
+// Pipeline returns the mongo pipeline of the aggregation, match is the
+// full filter including whatever the backend adds (e.g. live documents)
+func (q AggregateQuery) Pipeline(match bson.M) []bson.D {
+	pipeline := []bson.D{{{Key: "$match", Value: match}}}
+	var id any
+	if q.Path != "" {
+		pipeline = append(pipeline, bson.D{{Key: "$unwind", Value: bson.M{
+			"path":                       "$" + q.Path,
+			"preserveNullAndEmptyArrays": true,
+		}}})
+		id = "$" + q.Path
+	}
+	group := bson.D{{Key: "_id", Value: id}, {Key: "count", Value: bson.M{"$sum": 1}}}
+	for i, field := range q.Sum {
+		group = append(group, bson.E{Key: fmt.Sprintf("s%d", i), Value: bson.M{"$sum": "$" + Prefix(field)}})
+	}
+	return append(pipeline, bson.D{{Key: "$group", Value: group}})
+}
+
+// Groups converts the documents returned by Pipeline
+func (q AggregateQuery) Groups(rows []map[string]any) []Group {
+	out := make([]Group, 0, len(rows))
+	for _, row := range rows {
+		count, _ := number(row["count"])
+		g := Group{Key: row["_id"], Count: int64(count), Sums: make(map[string]float64, len(q.Sum))}
+		for i, field := range q.Sum {
+			g.Sums[field], _ = number(row[fmt.Sprintf("s%d", i)])
+		}
+		out = append(out, g)
+	}
+	sortGroups(out)
+	return out
+}
+
+// GroupCount counts the live documents of b per value of field, documents
+// without the field are left out, keys are formatted with fmt.Sprint
+func GroupCount(ctx context.Context, b Bucket, field string) (map[string]int64, error) {
+	groups, err := b.Aggregate(ctx, Aggregation{GroupBy: field})
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(groups))
+	for _, g := range groups {
+		if g.Key != nil {
+			counts[fmt.Sprint(g.Key)] += g.Count
+		}
+	}
+	return counts, nil
+}
+
+// groupID is the identity of a group key in Run
+func groupID(key any) string {
+	raw, err := bson.MarshalExtJSON(bson.M{"v": Normalize(key)}, true, false)
+	if err != nil {
+		return fmt.Sprintf("%T:%v", key, key)
+	}
+	return string(raw)
+}
+
+// sortGroups orders groups by count, largest first, then by key
+func sortGroups(groups []Group) {
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		return Compare(groups[i].Key, groups[j].Key) < 0
+	})
+}
@@ -0,0 +1,32 @@
+package storage
+
+// Item is one entry of a BatchStore
+type Item struct {
+	Key   string
+	Value any
+}
+
+// Change is one entry of a BatchPatch, Updates are applied like Patch
+type Change struct {
+	Key     string
+	Updates map[string]any
+}
+
+// Result is the outcome of one batch entry, results are returned in the
+// order of the input, Err wraps the same sentinel errors as the single
+// item operation (e.g. ErrConflict on a unique index, ErrNotFound)
+type Result struct {
+	Key string
+	Err error
+}
+
+// Failed returns the results that carry an error
+func Failed(results []Result) []Result {
+	var failed []Result
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// @NOTE a BlobStore keeps opaque files (avatars, uploads, ...) next to the
+// documents, they are streamed in and out rather than held in memory
+//
+//	info, err := blobs.Put(ctx, "avatars/abc.png", r, "image/png")
+//	rc, info, err := blobs.Get(ctx, "avatars/abc.png")
+//	defer rc.Close()
+//
+//	mongo          -> lib/storage/mongo GridFSStore, in the same database
+//	memory, sqlite -> lib/storage/files FileStore, in a local directory
+//
+// keys are slash separated paths, see ValidBlobKey, a Put replaces the
+// blob at key as a whole, readers never see half of a write
+// note: blobs are not tenant aware, callers qualify their keys (Qualify)
+// //
+
+// BlobStore stores streamed blobs by key
+type BlobStore interface {
+	Name() string                                                                           // returns the store name
+	Put(ctx context.Context, key string, r io.Reader, contentType string) (BlobInfo, error) // streams r into key, replacing any blob there
+	Get(ctx context.Context, key string) (io.ReadCloser, BlobInfo, error)                   // streams the blob at key, the caller closes it
+	Delete(ctx context.Context, key string) error                                           // removes the blob at key
+	Stat(ctx context.Context, key string) (BlobInfo, error)                                 // describes the blob at key
+}
+
+// OctetStream is the content type of a blob put without one
+const OctetStream = "application/octet-stream"
+
+// BlobInfo describes a stored blob
+type BlobInfo struct {
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`         // bytes
+	ContentType string    `json:"content_type"` // as given to Put, OctetStream if none
+	Modified    time.Time `json:"modified"`     // time of the last Put
+}
+
+// blob keys are path segments of letters, digits, '.', '_' and '-'
+var blobSegment = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// ValidBlobKey returns ErrInvalid unless key is a relative slash separated
+// path of such segments, none of them empty or starting with a '.'
+func ValidBlobKey(key string) error {
+	if key == "" || len(key) > 512 {
+		return fmt.Errorf("%w: blob key %q", ErrInvalid, key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if !blobSegment.MatchString(segment) {
+			return fmt.Errorf("%w: blob key %q", ErrInvalid, key)
+		}
+	}
+	return nil
+}
+
+// ContextReader returns r failing with the error of ctx once it is done,
+// so a Put stops streaming when its caller gives up
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &ctxReader{ctx: ctx, r: r}
+}
+
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); errors.Is(err, context.DeadlineExceeded) {
+		return 0, fmt.Errorf("%w: %w", ErrUnavailable, err)
+	} else if err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
@@ -0,0 +1,344 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	logs "github.com/danmuck/dps_lib/logs"
+)
+
+// @NOTE Cache wraps a Client with a read-through LRU of Retrieve,
+// RetrieveRevision and Lookup(Item) results, every write through the
+// cache invalidates what it could have changed
+//
+//	Retrieve(k)  -> dropped by any write to k
+//	Lookup(f)    -> dropped by any write to the bucket
+//
+// a result read while a write to the same bucket is in flight is not
+// cached, so a reader can not put back a value the write replaced
+// note: the cache is per process, writes made by another process (or
+// a document expiring, see StoreWithTTL) show up once the ttl runs out
+// //
+
+// Cache returns c with reads cached in an LRU of size entries for ttl,
+// size <= 0 returns c as is
+func Cache(c Client, size int, ttl time.Duration) Client {
+	if size <= 0 {
+		return c
+	}
+	logs.Init("Cache [%s] size %d ttl %v", c.Name(), size, ttl)
+	return &cachedClient{Client: c, lru: newLRU(size, ttl)}
+}
+
+// cachedClient hands out cached buckets sharing one LRU
+type cachedClient struct {
+	Client
+	lru *lru
+}
+
+func (cc *cachedClient) ConnectOrCreateBucket(ctx context.Context, bucket string, indexes ...Index) Bucket {
+	return &cachedBucket{Bucket: cc.Client.ConnectOrCreateBucket(ctx, bucket, indexes...), lru: cc.lru}
+}
+
+func (cc *cachedClient) Store(ctx context.Context, bucket string, key string, value any) error {
+	return cc.ConnectOrCreateBucket(ctx, bucket).Store(ctx, key, value)
+}
+
+func (cc *cachedClient) Retrieve(ctx context.Context, bucket string, key string) (any, error) {
+	return cc.ConnectOrCreateBucket(ctx, bucket).Retrieve(ctx, key)
+}
+
+func (cc *cachedClient) Delete(ctx context.Context, bucket string, key string) error {
+	return cc.ConnectOrCreateBucket(ctx, bucket).Delete(ctx, key)
+}
+
+func (cc *cachedClient) Update(ctx context.Context, bucket string, key string, value any) error {
+	return cc.ConnectOrCreateBucket(ctx, bucket).Update(ctx, key, value)
+}
+
+func (cc *cachedClient) Patch(ctx context.Context, bucket, key string, updates map[string]any) error {
+	return cc.ConnectOrCreateBucket(ctx, bucket).Patch(ctx, key, updates)
+}
+
+func (cc *cachedClient) List(ctx context.Context, bucket string) ([]any, error) {
+	return cc.ConnectOrCreateBucket(ctx, bucket).ListKeys(ctx)
+}
+
+func (cc *cachedClient) ListPage(ctx context.Context, bucket string, opts ListOptions) (Page, error) {
+	return cc.ConnectOrCreateBucket(ctx, bucket).ListPage(ctx, opts)
+}
+
+func (cc *cachedClient) Lookup(ctx context.Context, bucket string, key any, fields ...string) (map[string]any, error) {
+	return cc.ConnectOrCreateBucket(ctx, bucket).Lookup(ctx, key, fields...)
+}
+
+func (cc *cachedClient) Count(ctx context.Context, bucket string) (int64, error) {
+	return cc.ConnectOrCreateBucket(ctx, bucket).Count(ctx)
+}
+
+// cachedBucket serves reads from the LRU and invalidates it on writes
+type cachedBucket struct {
+	Bucket
+	lru *lru
+}
+
+func (cb *cachedBucket) Retrieve(ctx context.Context, key string) (any, error) {
+	value, _, err := cb.RetrieveRevision(ctx, key)
+	return value, err
+}
+
+func (cb *cachedBucket) RetrieveRevision(ctx context.Context, key string) (any, int64, error) {
+	ck := cb.Name() + "/r/" + key
+	if value, rev, ok := cb.lru.get(ck); ok {
+		return value, rev, nil
+	}
+	gen := cb.lru.generation(cb.Name())
+	value, rev, err := cb.Bucket.RetrieveRevision(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	cb.lru.put(cb.Name(), gen, ck, value, rev)
+	return value, rev, nil
+}
+
+func (cb *cachedBucket) Lookup(ctx context.Context, filter any, fields ...string) (map[string]any, error) {
+	doc, err := cb.LookupItem(ctx, filter, fields...)
+	if err != nil {
+		return nil, err
+	}
+	value, _ := asMap(doc["value"])
+	return value, nil
+}
+
+// LookupItem results are cached per filter, projection and caller roles,
+// the bucket Policy may answer differently for other roles
+func (cb *cachedBucket) LookupItem(ctx context.Context, filter any, fields ...string) (map[string]any, error) {
+	roles := slices.Clone(RolesFrom(ctx))
+	slices.Sort(roles)
+	// json keeps the fields apart, ["a,b"] and ["a", "b"] joined would not
+	raw, err := json.Marshal([]any{roles, fields, Normalize(filter)})
+	if err != nil {
+		return cb.Bucket.LookupItem(ctx, filter, fields...)
+	}
+	gen := cb.lru.generation(cb.Name())
+	ck := cb.Name() + "/l/" + string(raw)
+	if doc, _, ok := cb.lru.get(ck); ok {
+		return doc.(map[string]any), nil
+	}
+	doc, err := cb.Bucket.LookupItem(ctx, filter, fields...)
+	if err != nil {
+		return nil, err
+	}
+	cb.lru.put(cb.Name(), gen, ck, doc, Revision(doc))
+	return doc, nil
+}
+
+// write runs fn as a write on keys, a nil keys invalidates the whole bucket
+func (cb *cachedBucket) write(keys []string, fn func() error) error {
+	cb.lru.begin(cb.Name())
+	defer cb.lru.end(cb.Name(), keys)
+	return fn()
+}
+
+func (cb *cachedBucket) Store(ctx context.Context, key string, value any) error {
+	return cb.write([]string{key}, func() error { return cb.Bucket.Store(ctx, key, value) })
+}
+
+func (cb *cachedBucket) StoreWithTTL(ctx context.Context, key string, value any, ttl time.Duration) error {
+	return cb.write([]string{key}, func() error { return cb.Bucket.StoreWithTTL(ctx, key, value, ttl) })
+}
+
+func (cb *cachedBucket) Delete(ctx context.Context, key string) error {
+	return cb.write([]string{key}, func() error { return cb.Bucket.Delete(ctx, key) })
+}
+
+func (cb *cachedBucket) Update(ctx context.Context, key string, value any) error {
+	return cb.write([]string{key}, func() error { return cb.Bucket.Update(ctx, key, value) })
+}
+
+func (cb *cachedBucket) Patch(ctx context.Context, key string, updates map[string]any) error {
+	return cb.write([]string{key}, func() error { return cb.Bucket.Patch(ctx, key, updates) })
+}
+
+func (cb *cachedBucket) CompareAndSwap(ctx context.Context, key string, rev int64, value any) (next int64, err error) {
+	err = cb.write([]string{key}, func() error {
+		next, err = cb.Bucket.CompareAndSwap(ctx, key, rev, value)
+		return err
+	})
+	return next, err
+}
+
+func (cb *cachedBucket) PatchIfRevision(ctx context.Context, key string, rev int64, updates map[string]any) (next int64, err error) {
+	err = cb.write([]string{key}, func() error {
+		next, err = cb.Bucket.PatchIfRevision(ctx, key, rev, updates)
+		return err
+	})
+	return next, err
+}
+
+func (cb *cachedBucket) BatchStore(ctx context.Context, items []Item) (results []Result, err error) {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	err = cb.write(keys, func() error {
+		results, err = cb.Bucket.BatchStore(ctx, items)
+		return err
+	})
+	return results, err
+}
+
+func (cb *cachedBucket) BatchDelete(ctx context.Context, keys []string) (results []Result, err error) {
+	err = cb.write(keys, func() error {
+		results, err = cb.Bucket.BatchDelete(ctx, keys)
+		return err
+	})
+	return results, err
+}
+
+func (cb *cachedBucket) BatchPatch(ctx context.Context, changes []Change) (results []Result, err error) {
+	keys := make([]string, len(changes))
+	for i, change := range changes {
+		keys[i] = change.Key
+	}
+	err = cb.write(keys, func() error {
+		results, err = cb.Bucket.BatchPatch(ctx, changes)
+		return err
+	})
+	return results, err
+}
+
+func (cb *cachedBucket) Restore(ctx context.Context, key string) error {
+	return cb.write([]string{key}, func() error { return cb.Bucket.Restore(ctx, key) })
+}
+
+// Purge only removes trashed documents, which are never cached, it still
+// invalidates the bucket since it can not tell which keys it removed
+func (cb *cachedBucket) Purge(ctx context.Context, before time.Time) (n int64, err error) {
+	err = cb.write(nil, func() error {
+		n, err = cb.Bucket.Purge(ctx, before)
+		return err
+	})
+	return n, err
+}
+
+// lru is a size bounded cache of read results with a ttl
+// every bucket has a generation bumped by writes, results read across a
+// write (or while one is in flight) carry an old generation and are dropped
+type lru struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List               // most recently used first
+	entries map[string]*list.Element // map[cache key]*entry
+	gens    map[string]uint64        // map[bucket]generation
+	writing map[string]int           // map[bucket]writes in flight
+}
+
+type entry struct {
+	key     string
+	bucket  string
+	gen     uint64
+	value   any
+	rev     int64
+	expires time.Time
+}
+
+func newLRU(size int, ttl time.Duration) *lru {
+	return &lru{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		gens:    make(map[string]uint64),
+		writing: make(map[string]int),
+	}
+}
+
+// generation returns the generation of bucket to pass to put
+func (l *lru) generation(bucket string) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.gens[bucket]
+}
+
+// get returns a copy of a cached value if it is still current
+func (l *lru) get(key string) (any, int64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	el, ok := l.entries[key]
+	if !ok {
+		return nil, 0, false
+	}
+	e := el.Value.(*entry)
+	if time.Now().After(e.expires) || e.gen != l.gens[e.bucket] && strings.HasPrefix(key, e.bucket+"/l/") {
+		l.order.Remove(el)
+		delete(l.entries, key)
+		return nil, 0, false
+	}
+	l.order.MoveToFront(el)
+	// callers own what they get, values are decoded maps they may mutate
+	return Normalize(e.value), e.rev, true
+}
+
+// put caches a value read at generation gen of bucket
+func (l *lru) put(bucket string, gen uint64, key string, value any, rev int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if gen != l.gens[bucket] || l.writing[bucket] > 0 {
+		return
+	}
+	if el, ok := l.entries[key]; ok {
+		l.order.Remove(el)
+	}
+	l.entries[key] = l.order.PushFront(&entry{
+		key:     key,
+		bucket:  bucket,
+		gen:     gen,
+		value:   Normalize(value),
+		rev:     rev,
+		expires: time.Now().Add(l.ttl),
+	})
+	for l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*entry).key)
+	}
+}
+
+// begin marks a write to bucket as in flight
+func (l *lru) begin(bucket string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.writing[bucket]++
+	l.gens[bucket]++
+}
+
+// end finishes a write to bucket and drops the cached reads of keys,
+// lookups are dropped by the generation bump
+func (l *lru) end(bucket string, keys []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.writing[bucket]--
+	l.gens[bucket]++
+	if keys == nil {
+		for key, el := range l.entries {
+			if strings.HasPrefix(key, bucket+"/") {
+				l.order.Remove(el)
+				delete(l.entries, key)
+			}
+		}
+		return
+	}
+	for _, k := range keys {
+		if el, ok := l.entries[bucket+"/r/"+k]; ok {
+			l.order.Remove(el)
+			delete(l.entries, bucket+"/r/"+k)
+		}
+	}
+}
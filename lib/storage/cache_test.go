@@ -0,0 +1,340 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	"github.com/danmuck/dps_http/lib/storage/memory"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// cached returns a bucket behind Cache(size, ttl) and the stats of the
+// calls that reached the backend
+func cached(t *testing.T, size int, ttl time.Duration) (storage.Bucket, *storage.Stats) {
+	t.Helper()
+	storage.RegisterPolicy("cached", storage.Policy{Fields: map[string]storage.Rule{
+		"name":  {},
+		"email": {Roles: []string{"admin"}},
+	}})
+	stats := storage.NewStats()
+	c := storage.Cache(storage.Instrument(memory.NewMemoryStore(t.Name()), stats), size, ttl)
+	return c.ConnectOrCreateBucket(context.Background(), "cached"), stats
+}
+
+// backend returns how many times op reached the backend
+func backend(stats *storage.Stats, op string) int64 {
+	var n int64
+	for _, st := range stats.Snapshot() {
+		if st.Op == op {
+			n += st.Count
+		}
+	}
+	return n
+}
+
+// nameOf returns the name of the value at key
+func nameOf(t *testing.T, ctx context.Context, b storage.Bucket, key string) any {
+	t.Helper()
+	value, err := b.Retrieve(ctx, key)
+	if err != nil {
+		t.Fatalf("Retrieve %s: %v", key, err)
+	}
+	return value.(map[string]any)["name"]
+}
+
+func TestCacheHits(t *testing.T) {
+	ctx := context.Background()
+	b, stats := cached(t, 8, time.Minute)
+	if err := b.Store(ctx, "a", map[string]any{"name": "alpha"}); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	nameOf(t, ctx, b, "a")
+	value, _ := b.Retrieve(ctx, "a")
+	value.(map[string]any)["name"] = "mutated" // callers own what they get
+	if got := nameOf(t, ctx, b, "a"); got != "alpha" {
+		t.Fatalf("Retrieve after mutating a cached value: got %v", got)
+	}
+	if n := backend(stats, "retrieve_revision"); n != 1 {
+		t.Fatalf("Retrieve: reached the backend %d times, want 1", n)
+	}
+
+	for range 2 {
+		if _, err := b.Lookup(ctx, bson.M{"name": "alpha"}); err != nil {
+			t.Fatalf("Lookup: %v", err)
+		}
+		item, err := b.LookupItem(ctx, bson.M{"name": "alpha"})
+		if err != nil || item["key"] != "a" || storage.Revision(item) != 1 {
+			t.Fatalf("LookupItem: got %v, %v", item, err)
+		}
+	}
+	if n := backend(stats, "lookup_item"); n != 1 {
+		t.Fatalf("Lookup: reached the backend %d times, want 1", n)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	b, stats := cached(t, 8, 50*time.Millisecond)
+	if err := b.Store(ctx, "a", map[string]any{"name": "alpha"}); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	nameOf(t, ctx, b, "a")
+	nameOf(t, ctx, b, "a")
+	time.Sleep(80 * time.Millisecond)
+	nameOf(t, ctx, b, "a")
+	if n := backend(stats, "retrieve_revision"); n != 2 {
+		t.Fatalf("Retrieve: reached the backend %d times, want 2 (once more after the ttl)", n)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	b, stats := cached(t, 2, time.Minute)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := b.Store(ctx, key, map[string]any{"name": key}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+
+	nameOf(t, ctx, b, "a")
+	nameOf(t, ctx, b, "b")
+	nameOf(t, ctx, b, "a") // a is now the most recently used
+	nameOf(t, ctx, b, "c") // evicts b
+	if n := backend(stats, "retrieve_revision"); n != 3 {
+		t.Fatalf("Retrieve: reached the backend %d times, want 3", n)
+	}
+	nameOf(t, ctx, b, "a")
+	nameOf(t, ctx, b, "c")
+	if n := backend(stats, "retrieve_revision"); n != 3 {
+		t.Fatalf("Retrieve a and c: reached the backend %d times, want still 3", n)
+	}
+	nameOf(t, ctx, b, "b")
+	if n := backend(stats, "retrieve_revision"); n != 4 {
+		t.Fatalf("Retrieve evicted b: reached the backend %d times, want 4", n)
+	}
+}
+
+func TestCacheLookupKeys(t *testing.T) {
+	ctx := context.Background()
+	b, _ := cached(t, 8, time.Minute)
+	err := b.Store(ctx, "a", map[string]any{"name": "alpha", "email": "a@x.io", "n": 1})
+	if err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	// the projection is part of the key
+	full, err := b.Lookup(ctx, bson.M{"name": "alpha"})
+	if err != nil || len(full) != 3 {
+		t.Fatalf("Lookup: got %v, %v", full, err)
+	}
+	projected, err := b.Lookup(ctx, bson.M{"name": "alpha"}, "n")
+	if err != nil || len(projected) != 1 || projected["n"] != int32(1) {
+		t.Fatalf("Lookup projected: got %v, %v", projected, err)
+	}
+	if _, err := b.Lookup(ctx, bson.M{"name": "alpha"}, ""); !errors.Is(err, storage.ErrInvalid) {
+		t.Fatalf("Lookup projecting \"\": got %v, want ErrInvalid", err)
+	}
+
+	// so are the roles, the policy answers by role
+	admin := storage.WithRoles(ctx, "admin")
+	if _, err := b.Lookup(admin, bson.M{"email": "a@x.io"}); err != nil {
+		t.Fatalf("Lookup on email as admin: %v", err)
+	}
+	if _, err := b.Lookup(ctx, bson.M{"email": "a@x.io"}); !errors.Is(err, storage.ErrInvalid) {
+		t.Fatalf("Lookup on email without a role: got %v, want ErrInvalid", err)
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	writes := []struct {
+		name  string
+		write func(ctx context.Context, b storage.Bucket) error
+		want  any // name of a after the write, nil if it is gone
+	}{
+		{"Store", func(ctx context.Context, b storage.Bucket) error {
+			return b.Store(ctx, "a", map[string]any{"name": "new"})
+		}, "new"},
+		{"Patch", func(ctx context.Context, b storage.Bucket) error {
+			return b.Patch(ctx, "a", map[string]any{"name": "new"})
+		}, "new"},
+		{"Delete", func(ctx context.Context, b storage.Bucket) error {
+			return b.Delete(ctx, "a")
+		}, nil},
+		{"CompareAndSwap", func(ctx context.Context, b storage.Bucket) error {
+			_, err := b.CompareAndSwap(ctx, "a", 1, map[string]any{"name": "new"})
+			return err
+		}, "new"},
+		{"PatchIfRevision", func(ctx context.Context, b storage.Bucket) error {
+			_, err := b.PatchIfRevision(ctx, "a", 1, map[string]any{"name": "new"})
+			return err
+		}, "new"},
+		{"BatchStore", func(ctx context.Context, b storage.Bucket) error {
+			_, err := b.BatchStore(ctx, []storage.Item{{Key: "a", Value: map[string]any{"name": "new"}}})
+			return err
+		}, "new"},
+		{"BatchPatch", func(ctx context.Context, b storage.Bucket) error {
+			_, err := b.BatchPatch(ctx, []storage.Change{{Key: "a", Updates: map[string]any{"name": "new"}}})
+			return err
+		}, "new"},
+		{"BatchDelete", func(ctx context.Context, b storage.Bucket) error {
+			_, err := b.BatchDelete(ctx, []string{"a"})
+			return err
+		}, nil},
+		{"Restore", func(ctx context.Context, b storage.Bucket) error {
+			if err := b.Delete(ctx, "a"); err != nil {
+				return err
+			}
+			return b.Restore(ctx, "a")
+		}, "alpha"},
+		{"Purge", func(ctx context.Context, b storage.Bucket) error {
+			if err := b.Delete(ctx, "a"); err != nil {
+				return err
+			}
+			_, err := b.Purge(ctx, time.Now().Add(time.Minute))
+			return err
+		}, nil},
+	}
+	for _, tt := range writes {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			b, _ := cached(t, 8, time.Minute)
+			if err := b.Store(ctx, "a", map[string]any{"name": "alpha"}); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			nameOf(t, ctx, b, "a")
+			if _, err := b.Lookup(ctx, bson.M{"name": "alpha"}); err != nil {
+				t.Fatalf("Lookup: %v", err)
+			}
+
+			if err := tt.write(ctx, b); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			value, err := b.Retrieve(ctx, "a")
+			_, lookupErr := b.Lookup(ctx, bson.M{"name": "alpha"})
+			if tt.want == nil {
+				if !errors.Is(err, storage.ErrNotFound) || !errors.Is(lookupErr, storage.ErrNotFound) {
+					t.Fatalf("after %s: got %v (%v) and lookup %v, want ErrNotFound", tt.name, value, err, lookupErr)
+				}
+				return
+			}
+			if err != nil || value.(map[string]any)["name"] != tt.want {
+				t.Fatalf("after %s: got %v, %v, want name %v", tt.name, value, err, tt.want)
+			}
+			if found := tt.want == "alpha"; found != (lookupErr == nil) {
+				t.Fatalf("after %s: got lookup error %v", tt.name, lookupErr)
+			}
+		})
+	}
+}
+
+// gatedClient holds the reads of its buckets until they are released
+type gatedClient struct {
+	storage.Client
+	read    chan struct{} // a read got its value from the backend
+	release chan struct{} // lets it return
+}
+
+func (gc *gatedClient) ConnectOrCreateBucket(ctx context.Context, bucket string, indexes ...storage.Index) storage.Bucket {
+	return &gatedBucket{Bucket: gc.Client.ConnectOrCreateBucket(ctx, bucket, indexes...), gc: gc}
+}
+
+type gatedBucket struct {
+	storage.Bucket
+	gc *gatedClient
+}
+
+func (gb *gatedBucket) RetrieveRevision(ctx context.Context, key string) (any, int64, error) {
+	value, rev, err := gb.Bucket.RetrieveRevision(ctx, key)
+	gb.gc.read <- struct{}{}
+	<-gb.gc.release
+	return value, rev, err
+}
+
+func (gb *gatedBucket) LookupItem(ctx context.Context, filter any, fields ...string) (map[string]any, error) {
+	doc, err := gb.Bucket.LookupItem(ctx, filter, fields...)
+	gb.gc.read <- struct{}{}
+	<-gb.gc.release
+	return doc, err
+}
+
+// a read that got its value before a write must not cache it after it
+func TestCacheReadDuringWrite(t *testing.T) {
+	ctx := context.Background()
+	storage.RegisterPolicy("gated", storage.Policy{Fields: map[string]storage.Rule{"name": {}}})
+	gc := &gatedClient{
+		Client:  memory.NewMemoryStore(t.Name()),
+		read:    make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	if err := gc.Client.Store(ctx, "gated", "a", map[string]any{"name": "old"}); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	b := storage.Cache(gc, 8, time.Minute).ConnectOrCreateBucket(ctx, "gated")
+
+	reads := []struct {
+		name string
+		read func() (any, error)
+	}{
+		{"Retrieve", func() (any, error) {
+			value, err := b.Retrieve(ctx, "a")
+			if err != nil {
+				return nil, err
+			}
+			return value.(map[string]any)["name"], nil
+		}},
+		{"LookupItem", func() (any, error) {
+			doc, err := b.LookupItem(ctx, bson.M{"key": "a"})
+			if err != nil {
+				return nil, err
+			}
+			return doc["value"].(map[string]any)["name"], nil
+		}},
+	}
+	for i, r := range reads {
+		stale := "old"
+		if i > 0 {
+			stale = reads[i-1].name
+		}
+		fresh := r.name
+
+		done := make(chan any)
+		go func() {
+			got, err := r.read()
+			if err != nil {
+				t.Errorf("%s: %v", r.name, err)
+			}
+			done <- got
+		}()
+		<-gc.read // the reader holds the stale value
+
+		if err := b.Patch(ctx, "a", map[string]any{"name": fresh}); err != nil {
+			t.Fatalf("Patch: %v", err)
+		}
+		close(gc.release)
+		if got := <-done; got != stale {
+			t.Fatalf("%s across a write: got %v, want the %v it read", r.name, got, stale)
+		}
+
+		// the stale value was not cached, the next read goes to the backend
+		gc.release = make(chan struct{})
+		next := make(chan any)
+		go func() {
+			got, _ := r.read()
+			next <- got
+		}()
+		select {
+		case <-gc.read:
+			close(gc.release)
+		case got := <-next:
+			t.Fatalf("%s after the write: served %v from the cache", r.name, got)
+		}
+		if got := <-next; got != fresh {
+			t.Fatalf("%s after the write: got %v, want %v", r.name, got, fresh)
+		}
+		gc.release = make(chan struct{})
+	}
+}
@@ -0,0 +1,58 @@
+package storage_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	"github.com/danmuck/dps_http/lib/storage/memory"
+	"github.com/danmuck/dps_http/lib/storage/storagetest"
+)
+
+// the client decorators must forward every Bucket method unchanged
+
+func TestInstrumentConformance(t *testing.T) {
+	stats := storage.NewStats()
+	storagetest.Run(t, func(t *testing.T) storage.Client {
+		return storage.Instrument(memory.NewMemoryStore(t.Name()), stats)
+	})
+
+	// every Bucket method the suite went through was recorded
+	recorded := map[string]bool{}
+	for _, st := range stats.Snapshot() {
+		recorded[st.Op] = true
+	}
+	bucket := reflect.TypeOf((*storage.Bucket)(nil)).Elem()
+	for i := range bucket.NumMethod() {
+		name := bucket.Method(i).Name
+		if name != "Name" && !recorded[snake(name)] {
+			t.Errorf("Instrument: %s was not recorded as %q", name, snake(name))
+		}
+	}
+}
+
+// note: the cache ttl is below the expiry the suite waits for, expiring
+// documents only show through the cache once its ttl runs out
+func TestCacheConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Client {
+		return storage.Cache(memory.NewMemoryStore(t.Name()), 64, 100*time.Millisecond)
+	})
+}
+
+// snake returns the op name Instrument records a Bucket method under
+func snake(method string) string {
+	if method == "StoreWithTTL" {
+		return "store_ttl"
+	}
+	var b strings.Builder
+	for i, r := range method {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
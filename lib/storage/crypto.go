@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	logs "github.com/danmuck/dps_lib/logs"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// @NOTE buckets may declare value fields that are encrypted at rest, e.g.
+//
+//	storage.RegisterEncryption("usersv1", "email", "contact.phone")
+//
+// the Manager then wraps the bucket (see sealed.go) so that every write
+// stores the field as a blind index, an HMAC of the plaintext, and the
+// AES-GCM ciphertext under "_sealed"
+//
+//	{key, value: {email: "<blind index>", _sealed: {email: "<key id>:<ciphertext>"}}}
+//
+// the blind index keeps unique indexes and equality lookups ($eq, $in,
+// $ne, $nin) working, anything else on an encrypted field is rejected
+// reads decrypt with whichever configured key sealed the field, writes
+// use the current one, Reseal moves old documents to the current key
+//
+// ciphertexts are bound to their bucket, document key and field, and
+// blind indexes are keyed per bucket and field, so neither can be copied
+// to (or matched against) another document or field
+// note: renaming a bucket or a document orphans its ciphertexts, move
+// them with an export / import (see lib/storage/dump), which re-seals
+// //
+
+// Sealed is the value field holding the ciphertexts of encrypted fields
+const Sealed = "_sealed"
+
+var (
+	encryptionMu sync.RWMutex
+	encrypted    = map[string][]string{}
+)
+
+// RegisterEncryption declares the encrypted value fields of bucket,
+// replacing any previous declaration
+// note: services register their buckets when they are constructed
+func RegisterEncryption(bucket string, fields ...string) {
+	encryptionMu.Lock()
+	defer encryptionMu.Unlock()
+	logs.Init("registering encryption for %s: %v", bucket, fields)
+	encrypted[bucket] = slices.Clone(fields)
+}
+
+// EncryptionFor returns the encrypted fields registered for bucket,
+// a tenant qualified bucket has the fields of its plain name
+func EncryptionFor(bucket string) []string {
+	_, bucket = SplitTenant(bucket)
+	encryptionMu.RLock()
+	defer encryptionMu.RUnlock()
+	return encrypted[bucket]
+}
+
+// Keyring holds the keys encrypted fields are sealed with
+// the current key seals every write, the others are only kept to open
+// what they sealed until it is resealed
+type Keyring struct {
+	current string
+	aeads   map[string]cipher.AEAD
+	blind   []byte // blind index key, changing it orphans every blind index
+}
+
+// ParseKeyring reads a keyring from configuration
+//
+//	keys  = "2:<base64 key>,1:<base64 key>" // id:key pairs, current first
+//	blind = "<base64 key>"
+//
+// AES keys are 16, 24 or 32 bytes, empty keys return a nil Keyring
+func ParseKeyring(keys, blind string) (*Keyring, error) {
+	if keys == "" {
+		return nil, nil
+	}
+	kr := &Keyring{aeads: make(map[string]cipher.AEAD)}
+	for _, pair := range strings.Split(keys, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("%w: encryption keys must be id:key pairs", ErrInvalid)
+		}
+		if _, exists := kr.aeads[id]; exists {
+			return nil, fmt.Errorf("%w: duplicate encryption key id %q", ErrInvalid, id)
+		}
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%w: encryption key %q is not base64", ErrInvalid, id)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: encryption key %q: %v", ErrInvalid, id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		kr.aeads[id] = aead
+		if kr.current == "" {
+			kr.current = id
+		}
+	}
+	raw, err := base64.StdEncoding.DecodeString(blind)
+	if err != nil || len(raw) < 16 {
+		return nil, fmt.Errorf("%w: the blind index key must be at least 16 base64 encoded bytes", ErrInvalid)
+	}
+	kr.blind = raw
+	return kr, nil
+}
+
+// Current returns the id of the key new writes are sealed with
+func (kr *Keyring) Current() string {
+	return kr.current
+}
+
+// Seal encrypts val with the current key for the document field aad
+// names, the result carries the key id and only opens for the same aad
+func (kr *Keyring) Seal(val any, aad string) (string, error) {
+	plain, err := bson.Marshal(bson.M{"v": val})
+	if err != nil {
+		return "", err
+	}
+	aead := kr.aeads[kr.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plain, additional(kr.current, aad))
+	return kr.current + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value sealed by Seal for aad with any key of the ring
+func (kr *Keyring) Open(sealed string, aad string) (any, error) {
+	id, encoded, _ := strings.Cut(sealed, ":")
+	aead, ok := kr.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: no encryption key %q", ErrUnavailable, id)
+	}
+	raw, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) < aead.NonceSize() {
+		return nil, fmt.Errorf("malformed sealed value")
+	}
+	plain, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], additional(id, aad))
+	if err != nil {
+		return nil, err
+	}
+	var out bson.M
+	if err := bson.Unmarshal(plain, &out); err != nil {
+		return nil, err
+	}
+	return out["v"], nil
+}
+
+// fieldAAD returns the aad of field in the document key of bucket
+func fieldAAD(bucket, key, field string) string {
+	return bucket + "\x00" + key + "\x00" + field
+}
+
+// additional returns the additional data of a ciphertext, the key id
+// it was sealed with followed by aad
+func additional(id, aad string) []byte {
+	return []byte(id + "\x00" + aad)
+}
+
+// SealedWith returns the key id a value was sealed with
+func SealedWith(sealed string) string {
+	id, _, _ := strings.Cut(sealed, ":")
+	return id
+}
+
+// Blind returns the blind index of val in scope (see blindScope), equal
+// values have equal indexes within a scope and unrelated ones across
+func (kr *Keyring) Blind(scope string, val any) string {
+	sub := hmac.New(sha256.New, kr.blind)
+	sub.Write([]byte(scope))
+	mac := hmac.New(sha256.New, sub.Sum(nil))
+	raw, err := bson.Marshal(bson.M{"v": Normalize(val)})
+	if err != nil {
+		mac.Write([]byte(fmt.Sprint(val)))
+	} else {
+		mac.Write(raw)
+	}
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// blindScope returns the blind index scope of field in bucket
+func blindScope(bucket, field string) string {
+	return bucket + "\x00" + field
+}
@@ -0,0 +1,244 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	"github.com/danmuck/dps_http/lib/storage/memory"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// test keys, never use them anywhere else
+const (
+	key1  = "qF23zLEQk2rKa8tUZO9eJ2XOR2sywIIOC48URgcdwvA="
+	key2  = "Po51Oey0qFZI1pe5rAliRVRhsSfqZVMxAt+mMJ5qkpY="
+	blind = "3l5tCGXC6GGzm6CmtqPzVx0WbnRqUGm4YBNn3jkqGdM="
+)
+
+func keyring(t *testing.T, keys string) *storage.Keyring {
+	t.Helper()
+	kr, err := storage.ParseKeyring(keys, blind)
+	if err != nil {
+		t.Fatalf("ParseKeyring(%q): %v", keys, err)
+	}
+	return kr
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	kr := keyring(t, "1:"+key1)
+	for _, val := range []any{"dan@example.com", int32(42), map[string]any{"phone": "555"}} {
+		sealed, err := kr.Seal(val, "users/a/email")
+		if err != nil {
+			t.Fatalf("Seal(%v): %v", val, err)
+		}
+		if storage.SealedWith(sealed) != "1" || strings.Contains(sealed, fmt.Sprint(val)) {
+			t.Fatalf("Seal(%v): got %q, want a ciphertext of key 1", val, sealed)
+		}
+		got, err := kr.Open(sealed, "users/a/email")
+		if err != nil {
+			t.Fatalf("Open(%v): %v", val, err)
+		}
+		if fmt.Sprint(storage.Normalize(got)) != fmt.Sprint(storage.Normalize(val)) {
+			t.Fatalf("Open: got %v, want %v", got, val)
+		}
+	}
+
+	// the nonce is random, equal values do not seal alike
+	a, _ := kr.Seal("x", "aad")
+	b, _ := kr.Seal("x", "aad")
+	if a == b {
+		t.Fatal("Seal: equal values sealed to the same ciphertext")
+	}
+}
+
+func TestKeyringWrongKey(t *testing.T) {
+	kr := keyring(t, "1:"+key1)
+	sealed, err := kr.Seal("dan@example.com", "users/a/email")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	// same id, another key
+	if _, err := keyring(t, "1:"+key2).Open(sealed, "users/a/email"); err == nil {
+		t.Fatal("Open with another key: got no error")
+	}
+	// unknown id
+	if _, err := keyring(t, "2:"+key2).Open(sealed, "users/a/email"); !errors.Is(err, storage.ErrUnavailable) {
+		t.Fatalf("Open with an unknown key id: got %v, want ErrUnavailable", err)
+	}
+	// another document or field
+	for _, aad := range []string{"users/b/email", "users/a/phone", "other/a/email", ""} {
+		if _, err := kr.Open(sealed, aad); err == nil {
+			t.Fatalf("Open for %q: got no error", aad)
+		}
+	}
+	// tampered
+	tampered := sealed[:len(sealed)-2] + "AA"
+	if tampered == sealed {
+		tampered = sealed[:len(sealed)-2] + "BB"
+	}
+	if _, err := kr.Open(tampered, "users/a/email"); err == nil {
+		t.Fatal("Open tampered: got no error")
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	old := keyring(t, "1:"+key1)
+	sealed, err := old.Seal("dan@example.com", "aad")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	// the new key seals, the old one still opens what it sealed
+	rotated := keyring(t, "2:"+key2+",1:"+key1)
+	if rotated.Current() != "2" {
+		t.Fatalf("Current: got %q, want 2", rotated.Current())
+	}
+	if got, err := rotated.Open(sealed, "aad"); err != nil || got != "dan@example.com" {
+		t.Fatalf("Open after rotation: got %v, %v", got, err)
+	}
+	resealed, err := rotated.Seal("dan@example.com", "aad")
+	if err != nil || storage.SealedWith(resealed) != "2" {
+		t.Fatalf("Seal after rotation: got %q, %v, want key 2", resealed, err)
+	}
+
+	// once the old key is dropped only what was resealed opens
+	current := keyring(t, "2:"+key2)
+	if _, err := current.Open(sealed, "aad"); !errors.Is(err, storage.ErrUnavailable) {
+		t.Fatalf("Open with the old key dropped: got %v, want ErrUnavailable", err)
+	}
+	if got, err := current.Open(resealed, "aad"); err != nil || got != "dan@example.com" {
+		t.Fatalf("Open resealed: got %v, %v", got, err)
+	}
+}
+
+func TestKeyringBlind(t *testing.T) {
+	kr := keyring(t, "1:"+key1)
+	if kr.Blind("users/email", "a@x.io") != kr.Blind("users/email", "a@x.io") {
+		t.Fatal("Blind: equal values in a scope differ")
+	}
+	if kr.Blind("users/email", "a@x.io") == kr.Blind("users/email", "b@x.io") {
+		t.Fatal("Blind: different values in a scope are equal")
+	}
+	if kr.Blind("users/email", "a@x.io") == kr.Blind("users/contact", "a@x.io") {
+		t.Fatal("Blind: equal values are linkable across scopes")
+	}
+	// the blind key alone decides, not the encryption keys
+	if kr.Blind("s", "a@x.io") != keyring(t, "2:"+key2).Blind("s", "a@x.io") {
+		t.Fatal("Blind: changes with the encryption keys")
+	}
+}
+
+// sealed returns the bucket name encrypted on email and contact.phone,
+// the plain client to inspect it and the manager sealing it with keys
+func sealed(t *testing.T, keys string) (storage.Client, *storage.Manager, string) {
+	t.Helper()
+	name := strings.ToLower(strings.NewReplacer("/", "_", " ", "_").Replace(t.Name()))
+	storage.RegisterPolicy(name, storage.Policy{Fields: map[string]storage.Rule{
+		"username":      {},
+		"email":         {Ops: []string{"$in"}},
+		"contact.phone": {},
+	}})
+	storage.RegisterEncryption(name, "email", "contact.phone")
+	c := memory.NewMemoryStore(t.Name())
+	return c, storage.NewManager(c, keyring(t, keys)), name
+}
+
+func TestSealedBucket(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	plain, m, name := sealed(t, "1:"+key1)
+	b := m.ConnectOrCreateBucket(ctx, name, storage.Index{Fields: []string{"email"}, Unique: true})
+
+	alice := map[string]any{"username": "alice", "email": "a@x.io", "contact": map[string]any{"phone": "555"}}
+	if err := b.Store(ctx, "a", alice); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if err := b.Store(ctx, "b", map[string]any{"username": "bob", "email": "b@x.io"}); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	raw, err := plain.ConnectOrCreateBucket(ctx, name).Retrieve(ctx, "a")
+	if err != nil {
+		t.Fatalf("Retrieve raw: %v", err)
+	}
+	if s := fmt.Sprint(raw); strings.Contains(s, "a@x.io") || strings.Contains(s, "555") {
+		t.Fatalf("plaintext at rest: %v", raw)
+	}
+	got, err := b.Retrieve(ctx, "a")
+	if err != nil || fmt.Sprint(storage.Normalize(got)) != fmt.Sprint(storage.Normalize(alice)) {
+		t.Fatalf("Retrieve: got %v, %v, want %v", got, err, alice)
+	}
+
+	// the blind index answers equality lookups and unique indexes
+	found, err := b.Lookup(ctx, bson.M{"email": "a@x.io"})
+	if err != nil || found["username"] != "alice" || found["email"] != "a@x.io" {
+		t.Fatalf("Lookup on email: got %v, %v", found, err)
+	}
+	page, err := b.ListPage(ctx, storage.ListOptions{Filter: bson.M{"email": bson.M{"$in": []string{"b@x.io"}}}})
+	if err != nil || len(page.Items) != 1 || page.Items[0]["key"] != "b" {
+		t.Fatalf("ListPage $in on email: got %v, %v", page.Items, err)
+	}
+	_, err = b.ListPage(ctx, storage.ListOptions{Filter: bson.M{"email": bson.M{"$gt": "a"}}})
+	if !errors.Is(err, storage.ErrInvalid) {
+		t.Fatalf("ListPage $gt on email: got %v, want ErrInvalid", err)
+	}
+	err = b.Store(ctx, "c", map[string]any{"username": "carol", "email": "a@x.io"})
+	if !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Store duplicate email: got %v, want ErrConflict", err)
+	}
+
+	// a ciphertext copied into another document does not open there
+	rawB, err := plain.ConnectOrCreateBucket(ctx, name).Retrieve(ctx, "b")
+	if err != nil {
+		t.Fatalf("Retrieve raw: %v", err)
+	}
+	rawB.(map[string]any)[storage.Sealed] = raw.(map[string]any)[storage.Sealed]
+	if err := plain.ConnectOrCreateBucket(ctx, name).Store(ctx, "b", rawB); err != nil {
+		t.Fatalf("Store raw copy: %v", err)
+	}
+	if _, err := b.Retrieve(ctx, "b"); err == nil {
+		t.Fatal("Retrieve a copied ciphertext: got no error")
+	}
+}
+
+func TestSealedRotation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	plain, m, name := sealed(t, "1:"+key1)
+	b := m.ConnectOrCreateBucket(ctx, name)
+	for _, key := range []string{"a", "b"} {
+		err := b.Store(ctx, key, map[string]any{"username": key, "email": key + "@x.io"})
+		if err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+
+	// rotated, documents of the old key still open and are found
+	rotated := storage.NewManager(plain, keyring(t, "2:"+key2+",1:"+key1)).ConnectOrCreateBucket(ctx, name)
+	if got, err := rotated.Lookup(ctx, bson.M{"email": "a@x.io"}); err != nil || got["username"] != "a" {
+		t.Fatalf("Lookup after rotation: got %v, %v", got, err)
+	}
+	n, err := storage.Reseal(ctx, rotated)
+	if err != nil || n != 2 {
+		t.Fatalf("Reseal: got %d, %v, want 2", n, err)
+	}
+	if n, err := storage.Reseal(ctx, rotated); err != nil || n != 0 {
+		t.Fatalf("Reseal again: got %d, %v, want 0", n, err)
+	}
+
+	// resealed, the old key can go
+	current := storage.NewManager(plain, keyring(t, "2:"+key2)).ConnectOrCreateBucket(ctx, name)
+	if got, err := current.Retrieve(ctx, "b"); err != nil || got.(map[string]any)["email"] != "b@x.io" {
+		t.Fatalf("Retrieve with the old key dropped: got %v, %v", got, err)
+	}
+	_, err = storage.NewManager(plain, nil).ConnectOrCreateBucket(ctx, name).Retrieve(ctx, "b")
+	if !errors.Is(err, storage.ErrUnavailable) {
+		t.Fatalf("Retrieve without keys: got %v, want ErrUnavailable", err)
+	}
+}
@@ -0,0 +1,111 @@
+package drivers
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/danmuck/dps_http/configs"
+	"github.com/danmuck/dps_http/lib/storage"
+	"github.com/danmuck/dps_http/lib/storage/files"
+	"github.com/danmuck/dps_http/lib/storage/memory"
+	"github.com/danmuck/dps_http/lib/storage/mongo"
+	"github.com/danmuck/dps_http/lib/storage/sqlite"
+	logs "github.com/danmuck/dps_lib/logs"
+)
+
+// managers holds the storage.Manager of every database opened in this
+// process, services opening the same config share it (and its pool)
+var (
+	managers   = make(map[configs.Storage]*storage.Manager)
+	blobs      = make(map[configs.Storage]storage.BlobStore)
+	managersMu sync.Mutex
+)
+
+// Open returns the process wide storage.Manager for cfg, opening the
+// storage.Client selected by cfg.T on first use
+//
+//	"mongo"  -> lib/storage/mongo (default)
+//	"memory" -> lib/storage/memory
+//	"sqlite" -> lib/storage/sqlite
+//
+// services register their buckets and keep only m.Service(endpoint)
+// note: the client is tenant aware (see storage.Tenants), cached (see
+// configs.Storage) and instrumented, see m.Stats(), cache hits count as
+// operations too
+func Open(cfg configs.Storage) (*storage.Manager, error) {
+	managersMu.Lock()
+	defer managersMu.Unlock()
+
+	if m, exists := managers[cfg]; exists {
+		return m, nil
+	}
+	kr, err := storage.ParseKeyring(cfg.Keys, cfg.BlindKey)
+	if err != nil {
+		return nil, err
+	}
+	client, err := open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client = storage.Cache(storage.Tenants(client), cfg.CacheSize, cfg.CacheTTL)
+	m := storage.NewManager(storage.Instrument(client, storage.NewStats()), kr)
+	managers[cfg] = m
+	return m, nil
+}
+
+// open returns a new storage.Client for cfg
+func open(cfg configs.Storage) (storage.Client, error) {
+	logs.Init("Open [%s] %s", cfg.T, cfg.Name)
+	switch cfg.T {
+	case "mongo":
+		m, err := mongo.NewMongoStore(cfg.MongoURI, cfg.Name)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	case "memory":
+		return memory.NewMemoryStore(cfg.Name), nil
+	case "sqlite":
+		s, err := sqlite.NewSQLiteStore(cfg.Path, cfg.Name)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unsupported storage type %q", cfg.T)
+	}
+}
+
+// OpenBlobs returns the process wide storage.BlobStore for cfg
+//
+//	"mongo"  -> lib/storage/mongo, the GridFS bucket "blobs" of cfg.Name
+//	"memory" -> lib/storage/files, in cfg.BlobDir
+//	"sqlite" -> lib/storage/files, in cfg.BlobDir
+func OpenBlobs(cfg configs.Storage) (storage.BlobStore, error) {
+	managersMu.Lock()
+	defer managersMu.Unlock()
+
+	if bs, exists := blobs[cfg]; exists {
+		return bs, nil
+	}
+	logs.Init("OpenBlobs [%s] %s", cfg.T, cfg.Name)
+	var bs storage.BlobStore
+	switch cfg.T {
+	case "mongo":
+		gs, err := mongo.NewGridFSStore(cfg.MongoURI, cfg.Name, "blobs")
+		if err != nil {
+			return nil, err
+		}
+		bs = gs
+	case "memory", "sqlite":
+		fs, err := files.NewFileStore(cfg.BlobDir)
+		if err != nil {
+			return nil, err
+		}
+		bs = fs
+	default:
+		return nil, fmt.Errorf("unsupported storage type %q", cfg.T)
+	}
+	blobs[cfg] = bs
+	return bs, nil
+}
@@ -0,0 +1,202 @@
+package dump
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	logs "github.com/danmuck/dps_lib/logs"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// @NOTE a dump is JSON Lines, one {key, value} document per line in
+// canonical extended JSON so that BSON types survive the round trip
+//
+//	{"key":"6651...","value":{"username":"dirtpig","created_at":{"$date":{"$numberLong":"1717000000000"}}}}
+//
+// only live documents are exported, without their revision, expiry or
+// tombstone; encrypted fields are exported in plaintext (see storage.Seal)
+// so that a dump can be imported with other keys, keep dumps private
+// //
+
+// MaxLine is the longest line Import accepts
+const MaxLine = 16 << 20
+
+// batchSize is how many documents Import stores per BatchStore
+const batchSize = 100
+
+// Mode selects what Import does with the documents it reads
+type Mode string
+
+const (
+	DryRun Mode = "dry-run" // validate and report, write nothing
+	Upsert Mode = "upsert"  // store every document, replacing existing keys
+)
+
+// ParseMode returns the Mode named s, "" is DryRun
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case "", DryRun:
+		return DryRun, nil
+	case Upsert:
+		return Upsert, nil
+	}
+	return "", fmt.Errorf("%w: unknown import mode %q", storage.ErrInvalid, s)
+}
+
+// Report is the outcome of an Import, in DryRun New and Replaced count
+// what an Upsert would have done
+type Report struct {
+	Mode     Mode        `json:"mode"`
+	Lines    int         `json:"lines"`    // documents read
+	New      int         `json:"new"`      // keys that were not in the bucket
+	Replaced int         `json:"replaced"` // keys whose value was replaced
+	Failed   []LineError `json:"failed,omitempty"`
+}
+
+// LineError is a line of the dump that could not be imported
+type LineError struct {
+	Line  int    `json:"line"`
+	Key   string `json:"key,omitempty"`
+	Error string `json:"error"`
+}
+
+// line is one parsed line of a dump
+type line struct {
+	n     int
+	key   string
+	value any
+}
+
+// Export writes every live document of b to w, it returns the count
+func Export(ctx context.Context, b storage.Bucket, w io.Writer) (int, error) {
+	logs.Init("Export [%s]", b.Name())
+	bw := bufio.NewWriter(w)
+	opts := storage.ListOptions{Limit: storage.MaxPageSize}
+	n := 0
+	for {
+		page, err := b.ListPage(ctx, opts)
+		if err != nil {
+			return n, err
+		}
+		for _, item := range page.Items {
+			raw, err := bson.MarshalExtJSON(bson.D{
+				{Key: "key", Value: item["key"]},
+				{Key: "value", Value: item["value"]},
+			}, true, false)
+			if err != nil {
+				return n, fmt.Errorf("export %v: %w", item["key"], err)
+			}
+			bw.Write(raw)
+			if err := bw.WriteByte('\n'); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if page.Next == "" {
+			break
+		}
+		opts.Cursor = page.Next
+	}
+	return n, bw.Flush()
+}
+
+// Import reads a dump from r into b, lines that fail to parse or store are
+// reported in Report.Failed, the error is only set when reading r fails
+func Import(ctx context.Context, b storage.Bucket, r io.Reader, mode Mode) (Report, error) {
+	logs.Init("Import [%s] (%s)", b.Name(), mode)
+	report := Report{Mode: mode}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), MaxLine)
+
+	var batch []line
+	n := 0
+	for scanner.Scan() {
+		n++
+		raw := scanner.Bytes()
+		if len(raw) == 0 {
+			continue
+		}
+		report.Lines++
+		l, err := parse(n, raw)
+		if err != nil {
+			report.Failed = append(report.Failed, LineError{Line: n, Error: err.Error()})
+			continue
+		}
+		batch = append(batch, l)
+		if len(batch) == batchSize {
+			if err := flush(ctx, b, batch, mode, &report); err != nil {
+				return report, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return report, fmt.Errorf("line %d: %w", n+1, err)
+	}
+	return report, flush(ctx, b, batch, mode, &report)
+}
+
+// parse decodes one line of a dump
+func parse(n int, raw []byte) (line, error) {
+	var doc map[string]any
+	if err := bson.UnmarshalExtJSON(raw, false, &doc); err != nil {
+		return line{}, err
+	}
+	key, _ := doc["key"].(string)
+	if key == "" {
+		return line{}, errors.New("missing key")
+	}
+	value, ok := doc["value"]
+	if !ok {
+		return line{}, errors.New("missing value")
+	}
+	return line{n: n, key: key, value: value}, nil
+}
+
+// flush checks which keys of batch exist and, in Upsert mode, stores them
+func flush(ctx context.Context, b storage.Bucket, batch []line, mode Mode, report *Report) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	exists := make([]bool, len(batch))
+	for i, l := range batch {
+		_, err := b.Retrieve(ctx, l.key)
+		switch {
+		case err == nil:
+			exists[i] = true
+		case !errors.Is(err, storage.ErrNotFound):
+			return fmt.Errorf("line %d: %w", l.n, err)
+		}
+	}
+	failed := make(map[int]error)
+	if mode == Upsert {
+		items := make([]storage.Item, len(batch))
+		for i, l := range batch {
+			items[i] = storage.Item{Key: l.key, Value: l.value}
+		}
+		results, err := b.BatchStore(ctx, items)
+		if err != nil {
+			return fmt.Errorf("lines %d-%d: %w", batch[0].n, batch[len(batch)-1].n, err)
+		}
+		for i, r := range results {
+			if r.Err != nil {
+				failed[i] = r.Err
+			}
+		}
+	}
+	for i, l := range batch {
+		switch {
+		case failed[i] != nil:
+			report.Failed = append(report.Failed, LineError{Line: l.n, Key: l.key, Error: failed[i].Error()})
+		case exists[i]:
+			report.Replaced++
+		default:
+			report.New++
+		}
+	}
+	return nil
+}
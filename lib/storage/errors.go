@@ -0,0 +1,16 @@
+package storage
+
+import (
+	"errors"
+)
+
+// sentinel errors returned (wrapped) by every backend
+// check them with errors.Is, the wrapped error keeps the backend detail
+var (
+	ErrNotFound    = errors.New("storage: not found")   // no document matched
+	ErrConflict    = errors.New("storage: conflict")    // a write collided with existing data
+	ErrUnavailable = errors.New("storage: unavailable") // the backend could not be reached in time
+	ErrInvalid     = errors.New("storage: invalid")     // the request itself was rejected (filter, cursor, ...)
+	ErrStale       = errors.New("storage: stale")       // a conditional write saw a different revision
+	ErrForbidden   = errors.New("storage: forbidden")   // the service did not register the bucket (see manager.go)
+)
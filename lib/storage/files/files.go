@@ -0,0 +1,179 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	logs "github.com/danmuck/dps_lib/logs"
+)
+
+// @NOTE FileStore keeps every blob as a file under its root directory
+//
+//	<root>/avatars/abc.png        -> the bytes of "avatars/abc.png"
+//	<root>/avatars/.abc.png.type  -> its content type
+//
+// a Put streams into a temporary file next to the blob and renames it
+// over the blob once complete, blob keys never start with a '.' so the
+// temporary and type files can not collide with them
+// note: concurrent Puts of the same key keep one of the blobs whole, its
+// content type may come from the other one
+// //
+
+type FileStore struct {
+	root string
+}
+
+// NewFileStore returns a FileStore rooted at dir, creating it if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	logs.Init("NewFileStore %q", dir)
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStore{root: root}, nil
+}
+
+// Name returns the root directory
+func (fs *FileStore) Name() string {
+	return fs.root
+}
+
+// Put streams r into the blob at key
+func (fs *FileStore) Put(ctx context.Context, key string, r io.Reader, contentType string) (storage.BlobInfo, error) {
+	logs.Init("Put [%s] %q (%s)", fs.Name(), key, contentType)
+	if err := storage.ValidBlobKey(key); err != nil {
+		return storage.BlobInfo{}, err
+	}
+	path := fs.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return storage.BlobInfo{}, conflict(key, err)
+	}
+	if err := replace(path, storage.ContextReader(ctx, r)); err != nil {
+		logs.Err("Put() : %v", err)
+		return storage.BlobInfo{}, conflict(key, err)
+	}
+	if contentType == "" {
+		contentType = storage.OctetStream
+	}
+	if err := replace(typePath(path), strings.NewReader(contentType)); err != nil {
+		return storage.BlobInfo{}, wrapErr(key, err)
+	}
+	return fs.Stat(ctx, key)
+}
+
+// Get opens the blob at key, the caller closes it
+func (fs *FileStore) Get(ctx context.Context, key string) (io.ReadCloser, storage.BlobInfo, error) {
+	logs.Init("Get [%s] %q", fs.Name(), key)
+	info, err := fs.Stat(ctx, key)
+	if err != nil {
+		return nil, storage.BlobInfo{}, err
+	}
+	f, err := os.Open(fs.path(key))
+	if err != nil {
+		return nil, storage.BlobInfo{}, wrapErr(key, err)
+	}
+	return f, info, nil
+}
+
+// Delete removes the blob at key and its content type
+func (fs *FileStore) Delete(ctx context.Context, key string) error {
+	logs.Init("Delete [%s] %q", fs.Name(), key)
+	if _, err := fs.Stat(ctx, key); err != nil {
+		return err
+	}
+	path := fs.path(key)
+	if err := os.Remove(path); err != nil {
+		return wrapErr(key, err)
+	}
+	if err := os.Remove(typePath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logs.Warn("Delete() : %v", err)
+	}
+	return nil
+}
+
+// Stat describes the blob at key
+func (fs *FileStore) Stat(ctx context.Context, key string) (storage.BlobInfo, error) {
+	if err := storage.ValidBlobKey(key); err != nil {
+		return storage.BlobInfo{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return storage.BlobInfo{}, wrapErr(key, err)
+	}
+	path := fs.path(key)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return storage.BlobInfo{}, wrapErr(key, err)
+	}
+	if fi.IsDir() {
+		return storage.BlobInfo{}, fmt.Errorf("%w: no blob with key=%q", storage.ErrNotFound, key)
+	}
+	contentType := storage.OctetStream
+	if raw, err := os.ReadFile(typePath(path)); err == nil && len(raw) > 0 {
+		contentType = string(raw)
+	}
+	return storage.BlobInfo{
+		Key:         key,
+		Size:        fi.Size(),
+		ContentType: contentType,
+		Modified:    fi.ModTime(),
+	}, nil
+}
+
+// path returns the file of a valid key
+func (fs *FileStore) path(key string) string {
+	return filepath.Join(fs.root, filepath.FromSlash(key))
+}
+
+// typePath returns the file holding the content type of the blob at path
+func typePath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".type")
+}
+
+// replace writes r to a temporary file renamed over path once complete
+func replace(path string, r io.Reader) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// wrapErr maps filesystem errors onto the storage errors
+func wrapErr(key string, err error) error {
+	switch {
+	case err == nil, errors.Is(err, storage.ErrUnavailable):
+		return err
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, syscall.ENOTDIR):
+		return fmt.Errorf("%w: no blob with key=%q", storage.ErrNotFound, key)
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("%w: %w", storage.ErrUnavailable, err)
+	}
+	return err
+}
+
+// conflict reports a Put on a key whose path is taken by another blob,
+// "a/b" when "a" is a blob or "a" when "a/b" is one
+func conflict(key string, err error) error {
+	if errors.Is(err, syscall.ENOTDIR) || errors.Is(err, syscall.EISDIR) || errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%w: key=%q collides with another blob: %w", storage.ErrConflict, key, err)
+	}
+	return wrapErr(key, err)
+}
@@ -0,0 +1,19 @@
+package files_test
+
+import (
+	"testing"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	"github.com/danmuck/dps_http/lib/storage/files"
+	"github.com/danmuck/dps_http/lib/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.RunBlobs(t, func(t *testing.T) storage.BlobStore {
+		fs, err := files.NewFileStore(t.TempDir())
+		if err != nil {
+			t.Fatalf("NewFileStore: %v", err)
+		}
+		return fs
+	})
+}
@@ -0,0 +1,337 @@
+package storage
+
+import (
+	"reflect"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// @NOTE this is the in-process half of the query story, backends that
+// cannot push a filter down to a database (memory, sqlite) decode each
+// document and run it through Match
+// //
+
+// Resolve walks a dotted path (e.g. "value.username") through a decoded
+// document and returns the value found at the end of it
+func Resolve(doc map[string]any, path string) (any, bool) {
+	var cur any = doc
+	for _, part := range strings.Split(path, ".") {
+		m, ok := asMap(cur)
+		if !ok {
+			return nil, false
+		}
+		cur, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// Assign sets the value at a dotted path, creating intermediate documents
+// as needed, this mirrors a MongoDB $set on the same path
+func Assign(doc map[string]any, path string, val any) {
+	parts := strings.Split(path, ".")
+	cur := doc
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := asMap(cur[part])
+		if !ok {
+			next = map[string]any{}
+			cur[part] = next
+		}
+		cur = next
+	}
+	cur[parts[len(parts)-1]] = val
+}
+
+// Match reports whether a decoded {key, value} document satisfies the filter.
+// It supports equality on dotted paths, where an array field matches
+// if any of its elements is equal, "$and" / "$or", and the operators
+// $eq $ne $gt $gte $lt $lte $in $nin $exists, e.g.
+//
+//	bson.M{"value.created_at": bson.M{"$gt": ts}}
+//
+// note: the filter is expected to be cleaned and prefixed already
+func Match(doc map[string]any, filter bson.M) bool {
+	for field, want := range filter {
+		switch field {
+		case "$and":
+			for _, sub := range subFilters(want) {
+				if !Match(doc, sub) {
+					return false
+				}
+			}
+		case "$or":
+			matched := false
+			for _, sub := range subFilters(want) {
+				if Match(doc, sub) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		default:
+			have, exists := Resolve(doc, field)
+			want = Normalize(want)
+			if ops, ok := operators(want); ok {
+				if !matchOperators(have, exists, ops) {
+					return false
+				}
+				continue
+			}
+			if !matchValue(have, want) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Normalize round trips a value through BSON so that it has the same
+// shape it would have after being read back from storage
+// (int -> int32/int64, []string -> primitive.A, structs -> maps, etc.)
+func Normalize(val any) any {
+	raw, err := bson.Marshal(bson.M{"v": val})
+	if err != nil {
+		return val
+	}
+	var out map[string]any
+	if err := bson.Unmarshal(raw, &out); err != nil {
+		return val
+	}
+	return out["v"]
+}
+
+// operators returns want as an operator document ({"$gt": ...}) if it is one
+func operators(want any) (map[string]any, bool) {
+	m, ok := asMap(want)
+	if !ok || len(m) == 0 {
+		return nil, false
+	}
+	for op := range m {
+		if !strings.HasPrefix(op, "$") {
+			return nil, false
+		}
+	}
+	return m, true
+}
+
+func matchOperators(have any, exists bool, ops map[string]any) bool {
+	for op, arg := range ops {
+		var ok bool
+		switch op {
+		case "$eq":
+			ok = matchValue(have, arg)
+		case "$ne":
+			ok = !matchValue(have, arg)
+		case "$gt", "$gte", "$lt", "$lte":
+			ok = matchAny(have, func(v any) bool {
+				c, comparable := compareSameType(v, arg)
+				if !comparable {
+					return false
+				}
+				switch op {
+				case "$gt":
+					return c > 0
+				case "$gte":
+					return c >= 0
+				case "$lt":
+					return c < 0
+				}
+				return c <= 0
+			})
+		case "$in", "$nin":
+			list, _ := arg.(primitive.A)
+			for _, want := range list {
+				if matchValue(have, want) {
+					ok = true
+					break
+				}
+			}
+			if op == "$nin" {
+				ok = !ok
+			}
+		case "$exists":
+			want, _ := arg.(bool)
+			ok = exists == want
+		default:
+			// unknown operators never match rather than matching everything
+			ok = false
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAny applies fn to a value, or to each element if it is an array
+func matchAny(have any, fn func(any) bool) bool {
+	if arr, ok := have.(primitive.A); ok {
+		for _, elem := range arr {
+			if fn(elem) {
+				return true
+			}
+		}
+		return false
+	}
+	return fn(have)
+}
+
+// Compare orders two decoded values the way MongoDB sorts them,
+// values of different types are ordered by type first
+// (null < numbers < strings < documents < arrays < ObjectId < bool < dates)
+func Compare(a, b any) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return cmpInt(int64(ra), int64(rb))
+	}
+	c, _ := compareSameType(a, b)
+	return c
+}
+
+func compareSameType(a, b any) (int, bool) {
+	if typeRank(a) != typeRank(b) {
+		return 0, false
+	}
+	if x, ok := number(a); ok {
+		y, _ := number(b)
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	switch x := a.(type) {
+	case nil:
+		return 0, true
+	case string:
+		return strings.Compare(x, b.(string)), true
+	case primitive.ObjectID:
+		y := b.(primitive.ObjectID)
+		return strings.Compare(x.Hex(), y.Hex()), true
+	case bool:
+		y := b.(bool)
+		if x == y {
+			return 0, true
+		}
+		if !x {
+			return -1, true
+		}
+		return 1, true
+	case primitive.DateTime:
+		return cmpInt(int64(x), int64(b.(primitive.DateTime))), true
+	}
+	// documents, arrays, etc. only compare equal or not
+	if reflect.DeepEqual(a, b) {
+		return 0, true
+	}
+	return 0, false
+}
+
+func typeRank(v any) int {
+	if _, ok := number(v); ok {
+		return 2
+	}
+	switch v.(type) {
+	case nil:
+		return 1
+	case string:
+		return 3
+	case map[string]any, bson.M:
+		return 4
+	case primitive.A:
+		return 5
+	case primitive.Binary:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime:
+		return 9
+	}
+	return 10
+}
+
+func cmpInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func matchValue(have, want any) bool {
+	if equal(have, want) {
+		return true
+	}
+	if arr, ok := have.(primitive.A); ok {
+		for _, elem := range arr {
+			if equal(elem, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func equal(a, b any) bool {
+	if x, ok := number(a); ok {
+		if y, ok := number(b); ok {
+			return x == y
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func number(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func asMap(v any) (map[string]any, bool) {
+	switch m := v.(type) {
+	case map[string]any:
+		return m, true
+	case bson.M:
+		return m, true
+	}
+	return nil, false
+}
+
+func subFilters(v any) []bson.M {
+	var out []bson.M
+	switch list := v.(type) {
+	case []any:
+		for _, f := range list {
+			if m, ok := asMap(f); ok {
+				out = append(out, m)
+			}
+		}
+	case []bson.M:
+		out = list
+	case primitive.A:
+		for _, f := range list {
+			if m, ok := asMap(f); ok {
+				out = append(out, m)
+			}
+		}
+	}
+	return out
+}
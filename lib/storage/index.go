@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"strings"
+)
+
+// Index declares a secondary index on the value fields of a bucket,
+// passed to ConnectOrCreateBucket which creates it if it does not exist yet
+//
+//	client.ConnectOrCreateBucket(ctx, "usersv1",
+//		storage.Index{Fields: []string{"username"}, Unique: true},
+//		storage.Index{Fields: []string{"roles"}},
+//	)
+//
+// a write that would duplicate a unique index returns ErrConflict
+// note: documents missing one of the fields are not indexed (sparse),
+// so they never conflict with each other
+//
+// a Text index makes its (string) fields searchable with Search, a bucket
+// has at most one
+type Index struct {
+	Fields []string // value fields, without the "value." prefix
+	Unique bool     // reject duplicate values
+	Text   bool     // full text index, see search.go
+}
+
+// Name returns a stable name for the index, e.g. "username_1"
+// or "username_text_bio_text"
+func (idx Index) Name() string {
+	suffix := "_1"
+	if idx.Text {
+		suffix = "_text"
+	}
+	parts := make([]string, 0, len(idx.Fields))
+	for _, field := range idx.Fields {
+		parts = append(parts, field+suffix)
+	}
+	return strings.Join(parts, "_")
+}
+
+// Paths returns the prefixed document paths of the indexed fields
+func (idx Index) Paths() []string {
+	paths := make([]string, 0, len(idx.Fields))
+	for _, field := range idx.Fields {
+		paths = append(paths, Prefix(field))
+	}
+	return paths
+}
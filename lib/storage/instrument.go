@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// @NOTE Instrument wraps a Client so that every bucket operation is
+// counted and timed per bucket and operation, drivers.Open instruments
+// every client and the metrics service serves Manager.Stats()
+//
+//	GET /api/v1/metrics/storage
+//
+// latencies go into the fixed LatencyBounds histogram; ErrNotFound is an
+// answer, not a failure, and is not counted as an error
+// //
+
+// LatencyBounds are the upper bounds of the latency histogram buckets,
+// a last unbounded bucket catches the rest
+var LatencyBounds = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+}
+
+// Stats collects the operation counts and latencies of a client
+type Stats struct {
+	mu  sync.Mutex
+	ops map[opKey]*opStats
+}
+
+type opKey struct {
+	bucket, op string
+}
+
+type opStats struct {
+	count, errors int64
+	total, max    time.Duration
+	histogram     []int64 // len(LatencyBounds)+1
+}
+
+// NewStats returns an empty Stats
+func NewStats() *Stats {
+	return &Stats{ops: make(map[opKey]*opStats)}
+}
+
+// record adds one operation to the stats
+func (s *Stats) record(bucket, op string, d time.Duration, err error) {
+	i, _ := slices.BinarySearch(LatencyBounds, d)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.ops[opKey{bucket, op}]
+	if !ok {
+		st = &opStats{histogram: make([]int64, len(LatencyBounds)+1)}
+		s.ops[opKey{bucket, op}] = st
+	}
+	st.count++
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		st.errors++
+	}
+	st.total += d
+	st.max = max(st.max, d)
+	st.histogram[i]++
+}
+
+// OpStats is the snapshot of one operation on one bucket
+type OpStats struct {
+	Bucket    string  `json:"bucket"`
+	Op        string  `json:"op"`
+	Count     int64   `json:"count"`
+	Errors    int64   `json:"errors"`
+	MeanMs    float64 `json:"mean_ms"`
+	MaxMs     float64 `json:"max_ms"`
+	Histogram []Bin   `json:"histogram"`
+}
+
+// Bin is one latency histogram bucket, Le is its upper bound ("+Inf" last)
+type Bin struct {
+	Le    string `json:"le"`
+	Count int64  `json:"count"`
+}
+
+// Snapshot returns the stats sorted by bucket and operation
+func (s *Stats) Snapshot() []OpStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]OpStats, 0, len(s.ops))
+	for k, st := range s.ops {
+		bins := make([]Bin, len(st.histogram))
+		for i, n := range st.histogram {
+			le := "+Inf"
+			if i < len(LatencyBounds) {
+				le = LatencyBounds[i].String()
+			}
+			bins[i] = Bin{Le: le, Count: n}
+		}
+		out = append(out, OpStats{
+			Bucket:    k.bucket,
+			Op:        k.op,
+			Count:     st.count,
+			Errors:    st.errors,
+			MeanMs:    ms(st.total) / float64(st.count),
+			MaxMs:     ms(st.max),
+			Histogram: bins,
+		})
+	}
+	slices.SortFunc(out, func(a, b OpStats) int {
+		if c := strings.Compare(a.Bucket, b.Bucket); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Op, b.Op)
+	})
+	return out
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Instrument returns c with every bucket operation recorded in stats
+func Instrument(c Client, stats *Stats) Client {
+	return &instrumentedClient{Client: c, stats: stats}
+}
+
+// instrumentedClient hands out instrumented buckets
+type instrumentedClient struct {
+	Client
+	stats *Stats
+}
+
+// Stats returns the stats the client records into
+func (ic *instrumentedClient) Stats() *Stats {
+	return ic.stats
+}
+
+func (ic *instrumentedClient) ConnectOrCreateBucket(ctx context.Context, bucket string, indexes ...Index) Bucket {
+	return &instrumentedBucket{Bucket: ic.Client.ConnectOrCreateBucket(ctx, bucket, indexes...), stats: ic.stats}
+}
+
+func (ic *instrumentedClient) Store(ctx context.Context, bucket string, key string, value any) error {
+	return ic.ConnectOrCreateBucket(ctx, bucket).Store(ctx, key, value)
+}
+
+func (ic *instrumentedClient) Retrieve(ctx context.Context, bucket string, key string) (any, error) {
+	return ic.ConnectOrCreateBucket(ctx, bucket).Retrieve(ctx, key)
+}
+
+func (ic *instrumentedClient) Delete(ctx context.Context, bucket string, key string) error {
+	return ic.ConnectOrCreateBucket(ctx, bucket).Delete(ctx, key)
+}
+
+func (ic *instrumentedClient) Update(ctx context.Context, bucket string, key string, value any) error {
+	return ic.ConnectOrCreateBucket(ctx, bucket).Update(ctx, key, value)
+}
+
+func (ic *instrumentedClient) Patch(ctx context.Context, bucket, key string, updates map[string]any) error {
+	return ic.ConnectOrCreateBucket(ctx, bucket).Patch(ctx, key, updates)
+}
+
+func (ic *instrumentedClient) List(ctx context.Context, bucket string) ([]any, error) {
+	return ic.ConnectOrCreateBucket(ctx, bucket).ListKeys(ctx)
+}
+
+func (ic *instrumentedClient) ListPage(ctx context.Context, bucket string, opts ListOptions) (Page, error) {
+	return ic.ConnectOrCreateBucket(ctx, bucket).ListPage(ctx, opts)
+}
+
+func (ic *instrumentedClient) Lookup(ctx context.Context, bucket string, key any, fields ...string) (map[string]any, error) {
+	return ic.ConnectOrCreateBucket(ctx, bucket).Lookup(ctx, key, fields...)
+}
+
+func (ic *instrumentedClient) Count(ctx context.Context, bucket string) (int64, error) {
+	return ic.ConnectOrCreateBucket(ctx, bucket).Count(ctx)
+}
+
+// instrumentedBucket times every operation of the bucket it wraps
+type instrumentedBucket struct {
+	Bucket
+	stats *Stats
+}
+
+// observe records op as started at start, use as
+//
+//	defer ib.observe("store", time.Now(), &err)
+func (ib *instrumentedBucket) observe(op string, start time.Time, err *error) {
+	ib.stats.record(ib.Name(), op, time.Since(start), *err)
+}
+
+func (ib *instrumentedBucket) Store(ctx context.Context, key string, value any) (err error) {
+	defer ib.observe("store", time.Now(), &err)
+	return ib.Bucket.Store(ctx, key, value)
+}
+
+func (ib *instrumentedBucket) StoreWithTTL(ctx context.Context, key string, value any, ttl time.Duration) (err error) {
+	defer ib.observe("store_ttl", time.Now(), &err)
+	return ib.Bucket.StoreWithTTL(ctx, key, value, ttl)
+}
+
+func (ib *instrumentedBucket) Retrieve(ctx context.Context, key string) (_ any, err error) {
+	defer ib.observe("retrieve", time.Now(), &err)
+	return ib.Bucket.Retrieve(ctx, key)
+}
+
+func (ib *instrumentedBucket) Delete(ctx context.Context, key string) (err error) {
+	defer ib.observe("delete", time.Now(), &err)
+	return ib.Bucket.Delete(ctx, key)
+}
+
+func (ib *instrumentedBucket) Update(ctx context.Context, key string, value any) (err error) {
+	defer ib.observe("update", time.Now(), &err)
+	return ib.Bucket.Update(ctx, key, value)
+}
+
+func (ib *instrumentedBucket) Patch(ctx context.Context, key string, updates map[string]any) (err error) {
+	defer ib.observe("patch", time.Now(), &err)
+	return ib.Bucket.Patch(ctx, key, updates)
+}
+
+func (ib *instrumentedBucket) RetrieveRevision(ctx context.Context, key string) (_ any, _ int64, err error) {
+	defer ib.observe("retrieve_revision", time.Now(), &err)
+	return ib.Bucket.RetrieveRevision(ctx, key)
+}
+
+func (ib *instrumentedBucket) CompareAndSwap(ctx context.Context, key string, rev int64, value any) (_ int64, err error) {
+	defer ib.observe("compare_and_swap", time.Now(), &err)
+	return ib.Bucket.CompareAndSwap(ctx, key, rev, value)
+}
+
+func (ib *instrumentedBucket) PatchIfRevision(ctx context.Context, key string, rev int64, updates map[string]any) (_ int64, err error) {
+	defer ib.observe("patch_if_revision", time.Now(), &err)
+	return ib.Bucket.PatchIfRevision(ctx, key, rev, updates)
+}
+
+func (ib *instrumentedBucket) BatchStore(ctx context.Context, items []Item) (_ []Result, err error) {
+	defer ib.observe("batch_store", time.Now(), &err)
+	return ib.Bucket.BatchStore(ctx, items)
+}
+
+func (ib *instrumentedBucket) BatchDelete(ctx context.Context, keys []string) (_ []Result, err error) {
+	defer ib.observe("batch_delete", time.Now(), &err)
+	return ib.Bucket.BatchDelete(ctx, keys)
+}
+
+func (ib *instrumentedBucket) BatchPatch(ctx context.Context, changes []Change) (_ []Result, err error) {
+	defer ib.observe("batch_patch", time.Now(), &err)
+	return ib.Bucket.BatchPatch(ctx, changes)
+}
+
+func (ib *instrumentedBucket) Lookup(ctx context.Context, filter any, fields ...string) (_ map[string]any, err error) {
+	defer ib.observe("lookup", time.Now(), &err)
+	return ib.Bucket.Lookup(ctx, filter, fields...)
+}
+
+func (ib *instrumentedBucket) LookupItem(ctx context.Context, filter any, fields ...string) (_ map[string]any, err error) {
+	defer ib.observe("lookup_item", time.Now(), &err)
+	return ib.Bucket.LookupItem(ctx, filter, fields...)
+}
+
+func (ib *instrumentedBucket) ListKeys(ctx context.Context) (_ []any, err error) {
+	defer ib.observe("list_keys", time.Now(), &err)
+	return ib.Bucket.ListKeys(ctx)
+}
+
+func (ib *instrumentedBucket) ListItems(ctx context.Context) (_ []map[string]any, err error) {
+	defer ib.observe("list_items", time.Now(), &err)
+	return ib.Bucket.ListItems(ctx)
+}
+
+func (ib *instrumentedBucket) ListPage(ctx context.Context, opts ListOptions) (_ Page, err error) {
+	defer ib.observe("list_page", time.Now(), &err)
+	return ib.Bucket.ListPage(ctx, opts)
+}
+
+func (ib *instrumentedBucket) Count(ctx context.Context) (_ int64, err error) {
+	defer ib.observe("count", time.Now(), &err)
+	return ib.Bucket.Count(ctx)
+}
+
+func (ib *instrumentedBucket) Aggregate(ctx context.Context, agg Aggregation) (_ []Group, err error) {
+	defer ib.observe("aggregate", time.Now(), &err)
+	return ib.Bucket.Aggregate(ctx, agg)
+}
+
+func (ib *instrumentedBucket) Search(ctx context.Context, query string, in []string, limit int64, fields ...string) (_ []map[string]any, err error) {
+	defer ib.observe("search", time.Now(), &err)
+	return ib.Bucket.Search(ctx, query, in, limit, fields...)
+}
+
+func (ib *instrumentedBucket) ListTrash(ctx context.Context, opts ListOptions) (_ Page, err error) {
+	defer ib.observe("list_trash", time.Now(), &err)
+	return ib.Bucket.ListTrash(ctx, opts)
+}
+
+func (ib *instrumentedBucket) Restore(ctx context.Context, key string) (err error) {
+	defer ib.observe("restore", time.Now(), &err)
+	return ib.Bucket.Restore(ctx, key)
+}
+
+func (ib *instrumentedBucket) Purge(ctx context.Context, before time.Time) (_ int64, err error) {
+	defer ib.observe("purge", time.Now(), &err)
+	return ib.Bucket.Purge(ctx, before)
+}
+
+// Watch only records opening the stream
+func (ib *instrumentedBucket) Watch(ctx context.Context) (_ <-chan Event, err error) {
+	defer ib.observe("watch", time.Now(), &err)
+	return ib.Bucket.Watch(ctx)
+}
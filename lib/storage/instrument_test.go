@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStatsHistogram(t *testing.T) {
+	last := len(LatencyBounds)
+	tests := []struct {
+		d    time.Duration
+		want int // histogram bin
+	}{
+		{0, 0},
+		{LatencyBounds[0], 0}, // bounds are inclusive
+		{LatencyBounds[0] + 1, 1},
+		{LatencyBounds[1] - 1, 1},
+		{LatencyBounds[1], 1},
+		{LatencyBounds[last-1], last - 1},
+		{LatencyBounds[last-1] + 1, last}, // +Inf
+		{time.Hour, last},
+	}
+	for _, tt := range tests {
+		s := NewStats()
+		s.record("b", "op", tt.d, nil)
+		bins := s.Snapshot()[0].Histogram
+		if len(bins) != last+1 {
+			t.Fatalf("record(%v): got %d bins, want %d", tt.d, len(bins), last+1)
+		}
+		for i, bin := range bins {
+			want := int64(0)
+			if i == tt.want {
+				want = 1
+			}
+			if bin.Count != want {
+				t.Fatalf("record(%v): bin %d (le %s) has %d, want bin %d", tt.d, i, bin.Le, bin.Count, tt.want)
+			}
+		}
+	}
+
+	s := NewStats()
+	s.record("b", "op", time.Millisecond, nil)
+	bins := s.Snapshot()[0].Histogram
+	if bins[0].Le != "1ms" || bins[last].Le != "+Inf" {
+		t.Fatalf("Snapshot: got bins %v, want 1ms first and +Inf last", bins)
+	}
+}
+
+func TestStatsErrors(t *testing.T) {
+	s := NewStats()
+	s.record("b", "retrieve", time.Millisecond, nil)
+	s.record("b", "retrieve", time.Millisecond, fmt.Errorf("%w: key", ErrNotFound))
+	s.record("b", "retrieve", 3*time.Millisecond, ErrUnavailable)
+	s.record("b", "retrieve", time.Millisecond, errors.New("boom"))
+
+	got := s.Snapshot()[0]
+	if got.Count != 4 || got.Errors != 2 {
+		t.Fatalf("Snapshot: got count %d errors %d, want 4 and 2 (ErrNotFound is not an error)", got.Count, got.Errors)
+	}
+	if got.MeanMs != 1.5 || got.MaxMs != 3 {
+		t.Fatalf("Snapshot: got mean %vms max %vms, want 1.5 and 3", got.MeanMs, got.MaxMs)
+	}
+}
+
+func TestStatsSnapshotOrder(t *testing.T) {
+	s := NewStats()
+	for _, k := range []opKey{{"users", "store"}, {"metrics", "store"}, {"users", "lookup"}, {"metrics", "count"}} {
+		s.record(k.bucket, k.op, time.Millisecond, nil)
+	}
+	var got []string
+	for _, st := range s.Snapshot() {
+		got = append(got, st.Bucket+"/"+st.Op)
+	}
+	want := []string{"metrics/count", "metrics/store", "users/lookup", "users/store"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Snapshot: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// page sizes for ListPage
+const (
+	DefaultPageSize int64 = 50
+	MaxPageSize     int64 = 500
+)
+
+// ListOptions describes a single page of a bucket listing
+//
+//	opts := storage.ListOptions{
+//		Limit:  25,
+//		Sort:   "-created_at",           // value field, "-" for descending, default "key"
+//		Filter: bson.M{"roles": "admin"}, // checked against the bucket Policy
+//		Cursor: page.Next,               // "" for the first page
+//		Fields: []string{"username"},    // projection, nil for the whole value
+//	}
+type ListOptions struct {
+	Limit  int64    // max documents per page, 0 -> DefaultPageSize
+	Cursor string   // opaque cursor returned as Page.Next by the previous call
+	Sort   string   // value field to sort on, "-" prefix for descending
+	Filter any      // optional filter, checked against the bucket Policy
+	Fields []string // value fields to return, see projection.go
+}
+
+// Page is one page of {key, value} documents
+type Page struct {
+	Items []map[string]any // {key, value} documents in sort order
+	Next  string           // cursor for the next page, "" when there are no more
+}
+
+// Query is the backend facing form of ListOptions
+// the sort path is prefixed and the cursor decoded
+type Query struct {
+	Limit  int64    // clamped page size
+	Path   string   // sort path, "key" or "value.<field>"
+	Desc   bool     // descending order
+	Filter bson.M   // cleaned and prefixed filter, never nil
+	Fields []string // projected value fields, nil for the whole value
+
+	after    bool   // whether the cursor fields are set
+	afterVal any    // sort value of the last document of the previous page
+	afterKey string // key of the last document of the previous page
+}
+
+// cursor is the decoded form of Page.Next
+type cursor struct {
+	Path string `bson:"p"`
+	Val  any    `bson:"v"`
+	Key  string `bson:"k"`
+}
+
+// Query validates the options against the policy of the bucket being
+// listed and converts them for a backend
+// a rejected filter, sort or projection, or a malformed cursor returns ErrInvalid
+func (opts ListOptions) Query(ctx context.Context, p Policy) (Query, error) {
+	q := Query{
+		Limit:  opts.Limit,
+		Path:   "key",
+		Fields: opts.Fields,
+	}
+	if err := ValidProjection(q.Fields); err != nil {
+		return q, err
+	}
+	if q.Limit <= 0 {
+		q.Limit = DefaultPageSize
+	}
+	if q.Limit > MaxPageSize {
+		q.Limit = MaxPageSize
+	}
+
+	field := opts.Sort
+	if strings.HasPrefix(field, "-") {
+		q.Desc = true
+		field = field[1:]
+	}
+	if err := p.Sortable(ctx, field); err != nil {
+		return q, err
+	}
+	if field != "" && field != "key" {
+		q.Path = Prefix(field)
+	}
+
+	filter, err := p.Clean(ctx, opts.Filter)
+	if err != nil {
+		return q, err
+	}
+	q.Filter = filter
+
+	if opts.Cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(opts.Cursor)
+		if err != nil {
+			return q, fmt.Errorf("%w: malformed cursor", ErrInvalid)
+		}
+		var c cursor
+		if err := bson.Unmarshal(raw, &c); err != nil || c.Path != q.Path {
+			return q, fmt.Errorf("%w: cursor does not match sort %q", ErrInvalid, opts.Sort)
+		}
+		q.after, q.afterVal, q.afterKey = true, c.Val, c.Key
+	}
+	return q, nil
+}
+
+// Sort returns the sort document for the query, ties are broken by key
+func (q Query) Sort() bson.D {
+	dir := 1
+	if q.Desc {
+		dir = -1
+	}
+	if q.Path == "key" {
+		return bson.D{{Key: "key", Value: dir}}
+	}
+	return bson.D{{Key: q.Path, Value: dir}, {Key: "key", Value: dir}}
+}
+
+// Match returns the full filter for the page, the cleaned filter plus
+// the keyset condition that skips everything up to the cursor
+func (q Query) Match() bson.M {
+	if !q.after {
+		return q.Filter
+	}
+	op := "$gt"
+	if q.Desc {
+		op = "$lt"
+	}
+	var after bson.M
+	if q.Path == "key" {
+		after = bson.M{"key": bson.M{op: q.afterKey}}
+	} else {
+		or := []any{
+			bson.M{q.Path: bson.M{op: q.afterVal}},
+			bson.M{q.Path: q.afterVal, "key": bson.M{op: q.afterKey}},
+		}
+		// note: comparisons only match values of the same type, nothing is
+		// $gt null, so the documents missing the field (sorted first) are
+		// stepped over explicitly
+		switch {
+		case q.afterVal == nil && !q.Desc:
+			or = append(or, bson.M{q.Path: bson.M{"$exists": true, "$ne": nil}})
+		case q.afterVal != nil && q.Desc:
+			or = append(or, bson.M{q.Path: nil})
+		}
+		after = bson.M{"$or": or}
+	}
+	if len(q.Filter) == 0 {
+		return after
+	}
+	return bson.M{"$and": []any{q.Filter, after}}
+}
+
+// Page trims docs (fetched with a limit of q.Limit+1) to the page size
+// and computes the next cursor
+// the projection is applied once the cursor is taken, the sort field
+// does not have to be part of it
+func (q Query) Page(docs []map[string]any) Page {
+	if int64(len(docs)) <= q.Limit {
+		PickItems(docs, q.Fields)
+		return Page{Items: docs}
+	}
+	docs = docs[:q.Limit]
+	last := docs[len(docs)-1]
+	key, _ := last["key"].(string)
+	val, _ := Resolve(last, q.Path)
+	PickItems(docs, q.Fields)
+	raw, err := bson.Marshal(cursor{Path: q.Path, Val: val, Key: key})
+	if err != nil {
+		return Page{Items: docs}
+	}
+	return Page{Items: docs, Next: base64.RawURLEncoding.EncodeToString(raw)}
+}
+
+// Projection returns the find projection of the query, the sort path
+// included, nil when it projects nothing away
+func (q Query) Projection() bson.M {
+	return Projection(q.Fields, q.Path)
+}
+
+// Paginate applies the query to every document of a bucket in process,
+// used by backends that cannot push the query down (memory, sqlite)
+func (q Query) Paginate(docs []map[string]any) Page {
+	filter := q.Match()
+	matched := make([]map[string]any, 0, len(docs))
+	for _, doc := range docs {
+		if Match(doc, filter) {
+			matched = append(matched, doc)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		c := 0
+		if q.Path != "key" {
+			a, _ := Resolve(matched[i], q.Path)
+			b, _ := Resolve(matched[j], q.Path)
+			c = Compare(a, b)
+		}
+		if c == 0 {
+			a, _ := matched[i]["key"].(string)
+			b, _ := matched[j]["key"].(string)
+			c = strings.Compare(a, b)
+		}
+		if q.Desc {
+			return c > 0
+		}
+		return c < 0
+	})
+	if int64(len(matched)) > q.Limit+1 {
+		matched = matched[:q.Limit+1]
+	}
+	return q.Page(matched)
+}
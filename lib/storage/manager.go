@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	logs "github.com/danmuck/dps_lib/logs"
+)
+
+// @NOTE the Manager replaces the old top level mongo.MongoManager,
+// the server opens one per database (see drivers.Open) and every service
+// registers the buckets it uses before asking for its own view, e.g.
+//
+//	m.Register("metrics", "metricsv1", false) // private to metrics
+//	m.Register("metrics", "usersv1", true)    // shared with other services
+//	svc.storage = m.Service("metrics")
+//
+// a service only reaches the buckets it registered, anything else
+// returns ErrForbidden; a private bucket cannot be registered by a
+// second service
+//
+// buckets with encrypted fields (see crypto.go) are wrapped by the
+// Manager, services never see the blind indexes or ciphertexts
+// //
+
+// Manager is the process wide storage.Client, it shares one connection
+// pool between services and keeps the bucket registry
+// note: the Manager itself is unrestricted, hand services Service(name)
+type Manager struct {
+	Client
+
+	mu       sync.Mutex
+	registry map[string]*registration // map[bucket]*registration
+	keyring  *Keyring                 // nil when no encryption keys are configured
+}
+
+// registration records who may use a bucket
+type registration struct {
+	owner   string          // the first service to register the bucket
+	public  bool            // other services may register it too
+	members map[string]bool // services that registered the bucket
+}
+
+// NewManager wraps client with an empty bucket registry,
+// kr seals the encrypted fields and may be nil if there are none
+func NewManager(client Client, kr *Keyring) *Manager {
+	return &Manager{
+		Client:   client,
+		registry: make(map[string]*registration),
+		keyring:  kr,
+	}
+}
+
+// Stats returns the operation stats of the client, nil if it is not
+// instrumented (see Instrument)
+func (m *Manager) Stats() *Stats {
+	if ic, ok := m.Client.(interface{ Stats() *Stats }); ok {
+		return ic.Stats()
+	}
+	return nil
+}
+
+// ConnectOrCreateBucket returns the bucket, sealed if it has encrypted
+// fields; without a keyring those buckets return ErrUnavailable
+func (m *Manager) ConnectOrCreateBucket(ctx context.Context, bucket string, indexes ...Index) Bucket {
+	b := m.Client.ConnectOrCreateBucket(ctx, bucket, indexes...)
+	fields := EncryptionFor(bucket)
+	if len(fields) == 0 {
+		return b
+	}
+	if m.keyring == nil {
+		err := fmt.Errorf("%w: bucket %q is encrypted but no keys are configured", ErrUnavailable, bucket)
+		logs.Err("ConnectOrCreateBucket [%s] : %v", bucket, err)
+		return denied{name: bucket, err: err}
+	}
+	return Seal(b, m.keyring, fields...)
+}
+
+func (m *Manager) Store(ctx context.Context, bucket string, key string, value any) error {
+	return m.ConnectOrCreateBucket(ctx, bucket).Store(ctx, key, value)
+}
+
+func (m *Manager) Retrieve(ctx context.Context, bucket string, key string) (any, error) {
+	return m.ConnectOrCreateBucket(ctx, bucket).Retrieve(ctx, key)
+}
+
+func (m *Manager) Delete(ctx context.Context, bucket string, key string) error {
+	return m.ConnectOrCreateBucket(ctx, bucket).Delete(ctx, key)
+}
+
+func (m *Manager) Update(ctx context.Context, bucket string, key string, value any) error {
+	return m.ConnectOrCreateBucket(ctx, bucket).Update(ctx, key, value)
+}
+
+func (m *Manager) Patch(ctx context.Context, bucket, key string, updates map[string]any) error {
+	return m.ConnectOrCreateBucket(ctx, bucket).Patch(ctx, key, updates)
+}
+
+func (m *Manager) List(ctx context.Context, bucket string) ([]any, error) {
+	return m.ConnectOrCreateBucket(ctx, bucket).ListKeys(ctx)
+}
+
+func (m *Manager) ListPage(ctx context.Context, bucket string, opts ListOptions) (Page, error) {
+	return m.ConnectOrCreateBucket(ctx, bucket).ListPage(ctx, opts)
+}
+
+func (m *Manager) Lookup(ctx context.Context, bucket string, key any, fields ...string) (map[string]any, error) {
+	return m.ConnectOrCreateBucket(ctx, bucket).Lookup(ctx, key, fields...)
+}
+
+func (m *Manager) Count(ctx context.Context, bucket string) (int64, error) {
+	return m.ConnectOrCreateBucket(ctx, bucket).Count(ctx)
+}
+
+// Register grants service access to bucket
+// the first service to register a bucket owns it and decides whether it
+// is public; registering a private bucket owned by another service, or
+// disagreeing on the public flag, returns ErrForbidden
+func (m *Manager) Register(service, bucket string, public bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	logs.Init("Register [%s] for %s (public: %v)", bucket, service, public)
+
+	reg, exists := m.registry[bucket]
+	if !exists {
+		m.registry[bucket] = &registration{
+			owner:   service,
+			public:  public,
+			members: map[string]bool{service: true},
+		}
+		return nil
+	}
+	if reg.owner != service && !reg.public {
+		return fmt.Errorf("%w: bucket %q is private to %s", ErrForbidden, bucket, reg.owner)
+	}
+	if reg.public != public {
+		return fmt.Errorf("%w: bucket %q is registered with public=%v by %s",
+			ErrForbidden, bucket, reg.public, reg.owner)
+	}
+	reg.members[service] = true
+	return nil
+}
+
+// Service returns the view of the manager for service,
+// it only reaches the buckets service registered
+func (m *Manager) Service(service string) Client {
+	return &serviceClient{Manager: m, service: service}
+}
+
+// allowed reports an error when service did not register bucket
+func (m *Manager) allowed(service, bucket string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reg, exists := m.registry[bucket]
+	if !exists || !reg.members[service] {
+		return fmt.Errorf("%w: bucket %q is not registered by %s", ErrForbidden, bucket, service)
+	}
+	return nil
+}
+
+// serviceClient is the storage.Client handed to a single service
+type serviceClient struct {
+	*Manager
+	service string
+}
+
+// ConnectOrCreateBucket returns the bucket if the service registered it,
+// otherwise a bucket whose every operation returns ErrForbidden
+func (sc *serviceClient) ConnectOrCreateBucket(ctx context.Context, bucket string, indexes ...Index) Bucket {
+	if err := sc.allowed(sc.service, bucket); err != nil {
+		logs.Warn("ConnectOrCreateBucket [%s] : %v", bucket, err)
+		return denied{name: bucket, err: err}
+	}
+	return sc.Manager.ConnectOrCreateBucket(ctx, bucket, indexes...)
+}
+
+func (sc *serviceClient) Store(ctx context.Context, bucket string, key string, value any) error {
+	return sc.ConnectOrCreateBucket(ctx, bucket).Store(ctx, key, value)
+}
+
+func (sc *serviceClient) Retrieve(ctx context.Context, bucket string, key string) (any, error) {
+	return sc.ConnectOrCreateBucket(ctx, bucket).Retrieve(ctx, key)
+}
+
+func (sc *serviceClient) Delete(ctx context.Context, bucket string, key string) error {
+	return sc.ConnectOrCreateBucket(ctx, bucket).Delete(ctx, key)
+}
+
+func (sc *serviceClient) Update(ctx context.Context, bucket string, key string, value any) error {
+	return sc.ConnectOrCreateBucket(ctx, bucket).Update(ctx, key, value)
+}
+
+func (sc *serviceClient) Patch(ctx context.Context, bucket, key string, updates map[string]any) error {
+	return sc.ConnectOrCreateBucket(ctx, bucket).Patch(ctx, key, updates)
+}
+
+func (sc *serviceClient) List(ctx context.Context, bucket string) ([]any, error) {
+	return sc.ConnectOrCreateBucket(ctx, bucket).ListKeys(ctx)
+}
+
+func (sc *serviceClient) ListPage(ctx context.Context, bucket string, opts ListOptions) (Page, error) {
+	return sc.ConnectOrCreateBucket(ctx, bucket).ListPage(ctx, opts)
+}
+
+func (sc *serviceClient) Lookup(ctx context.Context, bucket string, key any, fields ...string) (map[string]any, error) {
+	return sc.ConnectOrCreateBucket(ctx, bucket).Lookup(ctx, key, fields...)
+}
+
+func (sc *serviceClient) Count(ctx context.Context, bucket string) (int64, error) {
+	return sc.ConnectOrCreateBucket(ctx, bucket).Count(ctx)
+}
+
+// Buckets is not for services, they only know the buckets they registered
+func (sc *serviceClient) Buckets(context.Context) ([]string, error) {
+	return nil, fmt.Errorf("%w: %s cannot list buckets", ErrForbidden, sc.service)
+}
+
+// denied is the bucket handed out for an unregistered bucket
+type denied struct {
+	name string
+	err  error
+}
+
+func (d denied) Name() string                             { return d.name }
+func (d denied) Store(context.Context, string, any) error { return d.err }
+func (d denied) StoreWithTTL(context.Context, string, any, time.Duration) error {
+	return d.err
+}
+func (d denied) Retrieve(context.Context, string) (any, error)       { return nil, d.err }
+func (d denied) Delete(context.Context, string) error                { return d.err }
+func (d denied) Update(context.Context, string, any) error           { return d.err }
+func (d denied) Patch(context.Context, string, map[string]any) error { return d.err }
+func (d denied) RetrieveRevision(context.Context, string) (any, int64, error) {
+	return nil, 0, d.err
+}
+func (d denied) CompareAndSwap(context.Context, string, int64, any) (int64, error) {
+	return 0, d.err
+}
+func (d denied) PatchIfRevision(context.Context, string, int64, map[string]any) (int64, error) {
+	return 0, d.err
+}
+func (d denied) BatchStore(context.Context, []Item) ([]Result, error)           { return nil, d.err }
+func (d denied) BatchDelete(context.Context, []string) ([]Result, error)        { return nil, d.err }
+func (d denied) BatchPatch(context.Context, []Change) ([]Result, error)         { return nil, d.err }
+func (d denied) Lookup(context.Context, any, ...string) (map[string]any, error) { return nil, d.err }
+func (d denied) ListKeys(context.Context) ([]any, error)                        { return nil, d.err }
+func (d denied) ListItems(context.Context) ([]map[string]any, error)            { return nil, d.err }
+func (d denied) ListPage(context.Context, ListOptions) (Page, error)            { return Page{}, d.err }
+func (d denied) Count(context.Context) (int64, error)                           { return 0, d.err }
+func (d denied) Aggregate(context.Context, Aggregation) ([]Group, error)        { return nil, d.err }
+func (d denied) ListTrash(context.Context, ListOptions) (Page, error)           { return Page{}, d.err }
+func (d denied) Restore(context.Context, string) error                          { return d.err }
+func (d denied) Purge(context.Context, time.Time) (int64, error)                { return 0, d.err }
+func (d denied) Watch(context.Context) (<-chan Event, error)                    { return nil, d.err }
+func (d denied) Search(context.Context, string, []string, int64, ...string) ([]map[string]any, error) {
+	return nil, d.err
+}
+func (d denied) LookupItem(context.Context, any, ...string) (map[string]any, error) {
+	return nil, d.err
+}
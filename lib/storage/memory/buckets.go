@@ -0,0 +1,802 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	logs "github.com/danmuck/dps_lib/logs"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// memoryBucket keeps {key, value} documents as encoded BSON so that values
+// read back have exactly the shape the MongoDB driver would hand out
+// (primitive.A for arrays, int32/int64 for numbers, etc.)
+type memoryBucket struct {
+	id   string
+	docs map[string][]byte // key -> bson document {key, value}
+	keys []string          // insertion order, mirrors natural order in MongoDB
+
+	indexes []*memoryIndex     // unique indexes, see ensureIndexes
+	text    *storage.TextIndex // text index, nil without one, see Search
+	feed    storage.Feed       // watchers, see Watch
+	swept   time.Time          // last sweep of expired documents, see sweep
+
+	mu sync.RWMutex
+}
+
+// newMemoryBucket creates an empty bucket with the given id
+func newMemoryBucket(id string) *memoryBucket {
+	logs.Init("NewMemoryBucket %q", id)
+	return &memoryBucket{
+		id:   id,
+		docs: make(map[string][]byte),
+	}
+}
+
+// Name returns the bucket id
+func (b *memoryBucket) Name() string {
+	return b.id
+}
+
+// String returns a string representation of the bucket
+func (b *memoryBucket) String() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return fmt.Sprintf("MemoryBucket(id=%q, count=%d)", b.id, len(b.keys))
+}
+
+// Store stores the given key-value pair in the bucket, replacing any
+// existing value for the key
+func (b *memoryBucket) Store(ctx context.Context, key string, value any) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.swap(key, upsert(key, value, 0))
+	return err
+}
+
+// StoreWithTTL stores the key-value pair like Store, it expires after ttl
+func (b *memoryBucket) StoreWithTTL(ctx context.Context, key string, value any, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%w: ttl must be positive, got %v", storage.ErrInvalid, ttl)
+	}
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.swap(key, upsert(key, value, ttl))
+	return err
+}
+
+// Retrieve retrieves the value associated with the given key from the bucket
+func (b *memoryBucket) Retrieve(ctx context.Context, key string) (any, error) {
+	value, _, err := b.RetrieveRevision(ctx, key)
+	return value, err
+}
+
+// RetrieveRevision retrieves the value for key along with its revision
+func (b *memoryBucket) RetrieveRevision(ctx context.Context, key string) (any, int64, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, 0, err
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	doc, err := b.live(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return doc["value"], storage.Revision(doc), nil
+}
+
+// Delete moves the document at key to the trash
+func (b *memoryBucket) Delete(ctx context.Context, key string) error {
+	logs.Debug("Delete [%s] key=%q", b.Name(), key)
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.swap(key, b.trash(ctx, key))
+	return err
+}
+
+// Update simply replaces the value for a key
+// and fails if the key does not exist
+func (b *memoryBucket) Update(ctx context.Context, key string, value any) error {
+	_, err := b.CompareAndSwap(ctx, key, anyRevision, value)
+	return err
+}
+
+// Patch the value for a key
+// fields are prefixed with "value." the same way mongoBucket does it
+func (b *memoryBucket) Patch(ctx context.Context, key string, updates map[string]any) error {
+	_, err := b.PatchIfRevision(ctx, key, anyRevision, updates)
+	return err
+}
+
+// CompareAndSwap replaces the value for key if it is still at rev
+// and returns the new revision, a moved on document returns storage.ErrStale
+func (b *memoryBucket) CompareAndSwap(ctx context.Context, key string, rev int64, value any) (int64, error) {
+	if err := ctxErr(ctx); err != nil {
+		return 0, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.swap(key, b.replace(key, rev, value))
+}
+
+// PatchIfRevision patches the value for key like Patch if it is still at rev
+// and returns the new revision, a moved on document returns storage.ErrStale
+func (b *memoryBucket) PatchIfRevision(ctx context.Context, key string, rev int64, updates map[string]any) (int64, error) {
+	logs.Init("PatchIfRevision [%q] { %q@%d : %v }", b.Name(), key, rev, updates)
+	if err := ctxErr(ctx); err != nil {
+		return 0, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.swap(key, b.patch(key, rev, updates))
+}
+
+// BatchStore stores every item under a single lock
+func (b *memoryBucket) BatchStore(ctx context.Context, items []storage.Item) ([]storage.Result, error) {
+	logs.Init("BatchStore [%q] %d items", b.Name(), len(items))
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	results := make([]storage.Result, len(items))
+	for i, item := range items {
+		_, err := b.swap(item.Key, upsert(item.Key, item.Value, 0))
+		results[i] = storage.Result{Key: item.Key, Err: err}
+	}
+	return results, nil
+}
+
+// BatchDelete deletes every key under a single lock
+func (b *memoryBucket) BatchDelete(ctx context.Context, keys []string) ([]storage.Result, error) {
+	logs.Init("BatchDelete [%q] %d keys", b.Name(), len(keys))
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	results := make([]storage.Result, len(keys))
+	for i, key := range keys {
+		_, err := b.swap(key, b.trash(ctx, key))
+		results[i] = storage.Result{Key: key, Err: err}
+	}
+	return results, nil
+}
+
+// BatchPatch applies every change under a single lock
+func (b *memoryBucket) BatchPatch(ctx context.Context, changes []storage.Change) ([]storage.Result, error) {
+	logs.Init("BatchPatch [%q] %d changes", b.Name(), len(changes))
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	results := make([]storage.Result, len(changes))
+	for i, change := range changes {
+		_, err := b.swap(change.Key, b.patch(change.Key, anyRevision, change.Updates))
+		results[i] = storage.Result{Key: change.Key, Err: err}
+	}
+	return results, nil
+}
+
+// Lookup retrieves the value of the first document matching the provided
+// filter. The filter is cleaned and prefixed exactly like mongoBucket.Lookup
+func (b *memoryBucket) Lookup(ctx context.Context, filter any, fields ...string) (map[string]any, error) {
+	doc, err := b.LookupItem(ctx, filter, fields...)
+	if err != nil {
+		return nil, err
+	}
+	return doc["value"].(map[string]any), nil
+}
+
+// LookupItem retrieves the {key, value, rev} document Lookup reads
+func (b *memoryBucket) LookupItem(ctx context.Context, filter any, fields ...string) (map[string]any, error) {
+	memFilter, err := storage.PolicyFor(b.id).Clean(ctx, filter)
+	if err != nil {
+		logs.Err("Lookup rejected filter %v: %v", filter, err)
+		return nil, err
+	}
+	if err := storage.ValidProjection(fields); err != nil {
+		return nil, err
+	}
+	logs.Init("Lookup filter : %v", memFilter)
+
+	if len(memFilter) == 0 {
+		logs.Err("empty filter provided, nothing to search on")
+		return nil, fmt.Errorf("%w: empty filter", storage.ErrInvalid)
+	}
+	if err := ctxErr(ctx); err != nil {
+		logs.Err("Lookup error: %v", err)
+		return nil, err
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	now := time.Now()
+	for _, key := range b.keys {
+		if b.hidden(key, now) {
+			continue
+		}
+		doc, err := b.decode(key)
+		if err != nil {
+			logs.Err("Lookup error: %v", err)
+			return nil, err
+		}
+		if !storage.Match(doc, memFilter) {
+			continue
+		}
+		value, ok := doc["value"].(map[string]any)
+		if !ok {
+			logs.Err("unexpected document shape %T", doc["value"])
+			return nil, fmt.Errorf("unexpected document shape %T", doc["value"])
+		}
+		doc["value"] = storage.Pick(value, fields)
+		return doc, nil
+	}
+	logs.Debug("soft warning: no document found for filter %v", memFilter)
+	return nil, fmt.Errorf("%w: filter %v", storage.ErrNotFound, memFilter)
+}
+
+// ListKeys retrieves all values from the bucket
+func (b *memoryBucket) ListKeys(ctx context.Context) ([]any, error) {
+	logs.Init("List [%s]", b.Name())
+	items, err := b.ListItems(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var results []any
+	for _, item := range items {
+		results = append(results, item["value"])
+	}
+	return results, nil
+}
+
+// ListItems retrieves all {key, value} documents from the bucket
+func (b *memoryBucket) ListItems(ctx context.Context) ([]map[string]any, error) {
+	logs.Init("ListItems [%s]", b.Name())
+	return b.items(ctx, false)
+}
+
+// items decodes every live document, or every trashed one
+func (b *memoryBucket) items(ctx context.Context, trashed bool) ([]map[string]any, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var results []map[string]any
+	now := time.Now()
+	for _, key := range b.keys {
+		if isExpired(b.docs[key], now) || isTrashed(b.docs[key]) != trashed {
+			continue
+		}
+		doc, err := b.decode(key)
+		if err != nil {
+			logs.Err("decode error: %v", err)
+			return nil, err
+		}
+		results = append(results, doc)
+	}
+	return results, nil
+}
+
+// ListPage retrieves one page of {key, value} documents
+// the query is evaluated in process over every document
+func (b *memoryBucket) ListPage(ctx context.Context, opts storage.ListOptions) (storage.Page, error) {
+	logs.Init("ListPage [%s] %+v", b.Name(), opts)
+	q, err := opts.Query(ctx, storage.PolicyFor(b.id))
+	if err != nil {
+		return storage.Page{}, err
+	}
+	items, err := b.ListItems(ctx)
+	if err != nil {
+		return storage.Page{}, err
+	}
+	return q.Paginate(items), nil
+}
+
+// Aggregate groups and counts the live documents in process
+func (b *memoryBucket) Aggregate(ctx context.Context, agg storage.Aggregation) ([]storage.Group, error) {
+	logs.Init("Aggregate [%s] %+v", b.Name(), agg)
+	q, err := agg.Query(ctx, storage.PolicyFor(b.id))
+	if err != nil {
+		return nil, err
+	}
+	items, err := b.ListItems(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return q.Run(items), nil
+}
+
+// Get the number of keys in the bucket
+func (b *memoryBucket) Count(ctx context.Context) (int64, error) {
+	if err := ctxErr(ctx); err != nil {
+		return 0, err
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var n int64
+	now := time.Now()
+	for _, key := range b.keys {
+		if !b.hidden(key, now) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Search finds live documents through the in process text index
+func (b *memoryBucket) Search(ctx context.Context, query string, in []string, limit int64, fields ...string) ([]map[string]any, error) {
+	logs.Init("Search [%s] %q in %v", b.Name(), query, in)
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var text []string
+	if b.text != nil {
+		text = b.text.Fields()
+	}
+	q, err := storage.NewSearch(ctx, storage.PolicyFor(b.id), text, query, in, limit, fields...)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]map[string]any, 0)
+	now := time.Now()
+	for _, key := range b.text.Search(q) {
+		if b.hidden(key, now) {
+			continue
+		}
+		doc, err := b.decode(key)
+		if err != nil {
+			logs.Err("decode error: %v", err)
+			return nil, err
+		}
+		doc["value"] = storage.Pick(doc["value"], q.Fields)
+		if results = append(results, doc); int64(len(results)) == q.Limit {
+			break
+		}
+	}
+	return results, nil
+}
+
+// ListTrash retrieves one page of trashed documents, like ListPage
+func (b *memoryBucket) ListTrash(ctx context.Context, opts storage.ListOptions) (storage.Page, error) {
+	logs.Init("ListTrash [%s] %+v", b.Name(), opts)
+	q, err := opts.Query(ctx, storage.PolicyFor(b.id))
+	if err != nil {
+		return storage.Page{}, err
+	}
+	items, err := b.items(ctx, true)
+	if err != nil {
+		return storage.Page{}, err
+	}
+	return q.Paginate(items), nil
+}
+
+// Restore takes the document at key out of the trash
+func (b *memoryBucket) Restore(ctx context.Context, key string) error {
+	logs.Init("Restore [%s] key=%q", b.Name(), key)
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.swap(key, b.restore(key))
+	return err
+}
+
+// Purge removes the documents trashed before cutoff for good
+func (b *memoryBucket) Purge(ctx context.Context, before time.Time) (int64, error) {
+	logs.Init("Purge [%s] before %v", b.Name(), before)
+	if err := ctxErr(ctx); err != nil {
+		return 0, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var n int64
+	for _, key := range slices.Clone(b.keys) {
+		if !isTrashed(b.docs[key]) {
+			continue
+		}
+		doc, err := b.decode(key)
+		if err != nil {
+			return n, err
+		}
+		if storage.DeletedBefore(doc, before) {
+			b.remove(key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Watch streams every write made through this process after the call
+func (b *memoryBucket) Watch(ctx context.Context) (<-chan storage.Event, error) {
+	logs.Init("Watch [%s]", b.Name())
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	return b.feed.Subscribe(ctx), nil
+}
+
+// anyRevision skips the revision check in expect, Update and Patch are
+// unconditional
+const anyRevision int64 = -1
+
+// expect checks that doc (nil when key is absent) exists and is at rev
+// a trashed document does not exist
+func (b *memoryBucket) expect(key string, doc map[string]any, rev int64) error {
+	if doc == nil || storage.IsDeleted(doc) {
+		logs.Err("no document matched for key %q in bucket %q", key, b.Name())
+		return notFound(key, b.Name())
+	}
+	if rev != anyRevision && storage.Revision(doc) != rev {
+		return stale(key, b.Name(), rev)
+	}
+	return nil
+}
+
+// upsert returns the swap function that stores value whether or not
+// key exists yet, expiring after ttl unless it is 0
+func upsert(key string, value any, ttl time.Duration) func(map[string]any) (map[string]any, error) {
+	return func(map[string]any) (map[string]any, error) {
+		doc := map[string]any{"key": key, "value": value}
+		if ttl > 0 {
+			doc[storage.Expires] = storage.Expiry(ttl)
+		}
+		return doc, nil
+	}
+}
+
+// replace returns the swap function that replaces the value of a
+// document at rev, keeping its expiry
+func (b *memoryBucket) replace(key string, rev int64, value any) func(map[string]any) (map[string]any, error) {
+	return func(doc map[string]any) (map[string]any, error) {
+		if err := b.expect(key, doc, rev); err != nil {
+			return nil, err
+		}
+		next := map[string]any{"key": key, "value": value}
+		if expires, ok := doc[storage.Expires]; ok {
+			next[storage.Expires] = expires
+		}
+		return next, nil
+	}
+}
+
+// patch returns the swap function that applies updates to a document at rev
+func (b *memoryBucket) patch(key string, rev int64, updates map[string]any) func(map[string]any) (map[string]any, error) {
+	return func(doc map[string]any) (map[string]any, error) {
+		if err := b.expect(key, doc, rev); err != nil {
+			return nil, err
+		}
+		for field, val := range updates {
+			storage.Assign(doc, storage.Prefix(field), val)
+		}
+		return doc, nil
+	}
+}
+
+// trash returns the swap function that tombstones a live document
+func (b *memoryBucket) trash(ctx context.Context, key string) func(map[string]any) (map[string]any, error) {
+	return func(doc map[string]any) (map[string]any, error) {
+		if err := b.expect(key, doc, anyRevision); err != nil {
+			return nil, err
+		}
+		doc[storage.Deleted] = storage.Tombstone(ctx)
+		return doc, nil
+	}
+}
+
+// restore returns the swap function that clears the tombstone of a
+// trashed document
+func (b *memoryBucket) restore(key string) func(map[string]any) (map[string]any, error) {
+	return func(doc map[string]any) (map[string]any, error) {
+		if doc == nil || !storage.IsDeleted(doc) {
+			return nil, fmt.Errorf("%w: no trashed document with key=%q in bucket=%q",
+				storage.ErrNotFound, key, b.Name())
+		}
+		delete(doc, storage.Deleted)
+		return doc, nil
+	}
+}
+
+// swap replaces the document at key with the one returned by fn, which
+// receives the current document (nil when absent), the write bumps the
+// revision and must pass the unique indexes
+// note: callers must hold the lock
+func (b *memoryBucket) swap(key string, fn func(doc map[string]any) (map[string]any, error)) (int64, error) {
+	now := time.Now()
+	b.sweep(now)
+	if isExpired(b.docs[key], now) {
+		b.expire(key)
+	}
+	doc, err := b.decode(key)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return 0, err
+	}
+	existed := doc != nil && !storage.IsDeleted(doc) // fn may modify doc
+	next, err := fn(doc)
+	if err != nil {
+		return 0, err
+	}
+	rev := storage.Revision(doc) + 1
+	next["rev"] = rev
+	raw, err := bson.Marshal(next)
+	if err != nil {
+		logs.Err("swap() : %v", err)
+		return 0, err
+	}
+	if err := b.checkUnique(key, raw, now); err != nil {
+		logs.Err("swap() : %v", err)
+		return 0, err
+	}
+	old, exists := b.docs[key]
+	if !exists {
+		b.keys = append(b.keys, key)
+	}
+	b.reindex(key, old, raw)
+	b.docs[key] = raw
+
+	if b.feed.Watched() {
+		ev := storage.Event{Op: storage.OpUpdate, Key: key, Rev: rev}
+		switch {
+		case storage.IsDeleted(next):
+			ev.Op = storage.OpDelete
+		case !existed:
+			ev.Op = storage.OpInsert
+		}
+		if ev.Op != storage.OpDelete {
+			stored, _ := b.decode(key)
+			ev.Value = stored["value"]
+		}
+		b.feed.Publish(ev)
+	}
+	return rev, nil
+}
+
+// remove deletes the document at key for good
+// note: callers must hold the lock
+func (b *memoryBucket) remove(key string) {
+	b.reindex(key, b.docs[key], nil)
+	delete(b.docs, key)
+	b.keys = slices.DeleteFunc(b.keys, func(k string) bool { return k == key })
+}
+
+// expire removes the expired document at key, watchers see an OpDelete
+// unless it was trashed already
+// note: callers must hold the lock
+func (b *memoryBucket) expire(key string) {
+	trashed := isTrashed(b.docs[key])
+	b.remove(key)
+	if !trashed {
+		b.feed.Publish(storage.Event{Op: storage.OpDelete, Key: key})
+	}
+}
+
+// sweep removes every expired document, at most once per
+// storage.SweepInterval
+// note: callers must hold the lock
+func (b *memoryBucket) sweep(now time.Time) {
+	if now.Sub(b.swept) < storage.SweepInterval {
+		return
+	}
+	b.swept = now
+	for _, key := range slices.Clone(b.keys) {
+		if isExpired(b.docs[key], now) {
+			b.expire(key)
+		}
+	}
+}
+
+// live decodes the document at key unless it is trashed or expired
+// note: callers must hold the lock
+func (b *memoryBucket) live(key string) (map[string]any, error) {
+	if b.hidden(key, time.Now()) {
+		return nil, notFound(key, b.Name())
+	}
+	return b.decode(key)
+}
+
+// hidden reports whether the document at key is trashed or expired
+// note: callers must hold the lock
+func (b *memoryBucket) hidden(key string, now time.Time) bool {
+	raw := b.docs[key]
+	return isTrashed(raw) || isExpired(raw, now)
+}
+
+// isTrashed reports whether an encoded document carries a tombstone
+func isTrashed(raw bson.Raw) bool {
+	val, err := raw.LookupErr(storage.Deleted)
+	return err == nil && val.Type != bson.TypeNull
+}
+
+// isExpired reports whether an encoded document expired before now
+func isExpired(raw bson.Raw, now time.Time) bool {
+	val, err := raw.LookupErr(storage.Expires)
+	if err != nil {
+		return false
+	}
+	at, ok := val.DateTimeOK()
+	return ok && at <= now.UnixMilli()
+}
+
+// decode unmarshals the document stored for key
+// note: callers must hold the lock
+func (b *memoryBucket) decode(key string) (map[string]any, error) {
+	raw, exists := b.docs[key]
+	if !exists {
+		return nil, notFound(key, b.Name())
+	}
+	var doc map[string]any
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// ctxErr reports a done context, deadlines map to storage.ErrUnavailable
+// the same way the MongoDB driver's timeouts do
+func ctxErr(ctx context.Context) error {
+	err := ctx.Err()
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", storage.ErrUnavailable, err)
+	}
+	return err
+}
+
+// notFound reports a key that matched no document
+func notFound(key, bucket string) error {
+	return fmt.Errorf("%w: no document with key=%q in bucket=%q", storage.ErrNotFound, key, bucket)
+}
+
+// stale reports a conditional write on a document that is no longer at rev
+func stale(key, bucket string, rev int64) error {
+	return fmt.Errorf("%w: key=%q in bucket=%q is no longer at revision %d", storage.ErrStale, key, bucket, rev)
+}
+
+// memoryIndex enforces a unique storage.Index
+// note: non-unique indexes are not kept, the memory backend scans anyway,
+// text indexes are kept as a storage.TextIndex
+type memoryIndex struct {
+	storage.Index
+	keys map[string]string // encoded field values -> document key
+}
+
+// entry returns the encoded field values of a document
+// false when one of the fields is missing or null (sparse)
+func (idx *memoryIndex) entry(raw bson.Raw) (string, bool) {
+	var sb strings.Builder
+	for _, path := range idx.Paths() {
+		val, err := raw.LookupErr(strings.Split(path, ".")...)
+		if err != nil || val.Type == bson.TypeNull {
+			return "", false
+		}
+		fmt.Fprintf(&sb, "%d:%d:", val.Type, len(val.Value))
+		sb.Write(val.Value)
+	}
+	return sb.String(), true
+}
+
+// ensureIndexes builds the unique indexes that do not exist yet, existing
+// documents that already collide return storage.ErrConflict
+func (b *memoryBucket) ensureIndexes(indexes []storage.Index) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, idx := range indexes {
+		if idx.Text {
+			if err := b.ensureText(idx); err != nil {
+				return err
+			}
+			continue
+		}
+		if !idx.Unique || slices.ContainsFunc(b.indexes, func(mi *memoryIndex) bool {
+			return mi.Name() == idx.Name()
+		}) {
+			continue
+		}
+		mi := &memoryIndex{Index: idx, keys: make(map[string]string)}
+		for _, key := range b.keys {
+			entry, ok := mi.entry(b.docs[key])
+			if !ok {
+				continue
+			}
+			if owner, taken := mi.keys[entry]; taken {
+				return fmt.Errorf("%w: keys %q and %q collide on index %s in bucket=%q",
+					storage.ErrConflict, owner, key, idx.Name(), b.id)
+			}
+			mi.keys[entry] = key
+		}
+		b.indexes = append(b.indexes, mi)
+	}
+	return nil
+}
+
+// ensureText builds the text index from the stored documents, a bucket
+// has at most one
+// note: callers must hold the lock
+func (b *memoryBucket) ensureText(idx storage.Index) error {
+	if b.text != nil {
+		if slices.Equal(b.text.Fields(), idx.Fields) {
+			return nil
+		}
+		return fmt.Errorf("%w: bucket=%q already has a text index on %v",
+			storage.ErrInvalid, b.id, b.text.Fields())
+	}
+	b.text = storage.NewTextIndex(idx.Fields)
+	for _, key := range b.keys {
+		doc, err := b.decode(key)
+		if err != nil {
+			return err
+		}
+		b.text.Put(key, doc)
+	}
+	return nil
+}
+
+// checkUnique reports a write of raw at key that would duplicate
+// a unique index entry held by another key, expired documents are
+// removed to make room
+// note: callers must hold the lock
+func (b *memoryBucket) checkUnique(key string, raw bson.Raw, now time.Time) error {
+	for _, mi := range b.indexes {
+		entry, ok := mi.entry(raw)
+		if !ok {
+			continue
+		}
+		if owner, taken := mi.keys[entry]; taken && owner != key && isExpired(b.docs[owner], now) {
+			b.expire(owner)
+		}
+		if owner, taken := mi.keys[entry]; taken && owner != key {
+			return fmt.Errorf("%w: key=%q duplicates index %s of key=%q in bucket=%q",
+				storage.ErrConflict, key, mi.Name(), owner, b.id)
+		}
+	}
+	return nil
+}
+
+// reindex moves key from the entries of old to those of raw,
+// either may be nil (insert / delete), a nil document has no entry
+// note: callers must hold the lock
+func (b *memoryBucket) reindex(key string, old, raw bson.Raw) {
+	for _, mi := range b.indexes {
+		if entry, ok := mi.entry(old); ok && mi.keys[entry] == key {
+			delete(mi.keys, entry)
+		}
+		if entry, ok := mi.entry(raw); ok {
+			mi.keys[entry] = key
+		}
+	}
+	if b.text != nil {
+		var doc map[string]any
+		if raw != nil {
+			if err := bson.Unmarshal(raw, &doc); err != nil {
+				logs.Err("reindex() : %v", err)
+			}
+		}
+		b.text.Put(key, doc)
+	}
+}
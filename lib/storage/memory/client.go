@@ -0,0 +1,160 @@
+package memory
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	logs "github.com/danmuck/dps_lib/logs"
+)
+
+// stores holds every MemoryClient created in this process by name
+// so that services opening the same database share the same data,
+// just like separate MongoDB clients pointed at the same database
+var (
+	stores   = make(map[string]*MemoryClient)
+	storesMu sync.Mutex
+)
+
+// MemoryClient is an in-process implementation of storage.Client
+// intended for tests and offline development
+type MemoryClient struct {
+	name     string
+	location string
+	t        string // "memory"
+	buckets  map[string]*memoryBucket
+
+	mu sync.Mutex
+}
+
+// NewMemoryStore returns the in-memory database with the given name,
+// creating it on first use
+func NewMemoryStore(dbName string) *MemoryClient {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+
+	if ms, exists := stores[dbName]; exists {
+		logs.Log("connecting to in-memory store %s", dbName)
+		return ms
+	}
+	logs.Log("creating in-memory store %s", dbName)
+	ms := &MemoryClient{
+		name:     dbName,
+		location: "memory://" + dbName,
+		t:        "memory",
+		buckets:  make(map[string]*memoryBucket),
+	}
+	stores[dbName] = ms
+	return ms
+}
+
+// Name returns the name of the in-memory database
+func (ms *MemoryClient) Name() string {
+	return ms.name
+}
+
+// Type returns the type of storage
+// -> "memory"
+func (ms *MemoryClient) Type() string {
+	return ms.t
+}
+
+// Location returns a pseudo uri for the store
+func (ms *MemoryClient) Location() string {
+	return ms.location
+}
+
+// Ping always succeeds unless the context is already done
+func (ms *MemoryClient) Ping(ctx context.Context) error {
+	return ctxErr(ctx)
+}
+
+// ConnectOrCreateBucket connects to an existing bucket or creates a new one if it doesn't exist.
+// indexes are created if they do not exist yet, a failure is logged and
+// the bucket is still returned
+func (ms *MemoryClient) ConnectOrCreateBucket(ctx context.Context, bucket string, indexes ...storage.Index) storage.Bucket {
+	logs.Init("ConnectOrCreateBucket [%s]", bucket)
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	collection, exists := ms.buckets[bucket]
+	if !exists || collection == nil {
+		logs.Info("Create [%s]", bucket)
+		collection = newMemoryBucket(bucket)
+		ms.buckets[bucket] = collection
+	}
+	if len(indexes) > 0 {
+		if err := collection.ensureIndexes(indexes); err != nil {
+			logs.Err("failed to create indexes for bucket %q: %v", bucket, err)
+		}
+	}
+	return collection
+}
+
+// basic CRUD operations
+func (ms *MemoryClient) Store(ctx context.Context, bucket string, key string, value any) error {
+	logs.Init("Store [%q] : { %q : %v }", bucket, key, value)
+	return ms.ConnectOrCreateBucket(ctx, bucket).Store(ctx, key, value)
+}
+
+// retrieves a value by key from a bucket
+func (ms *MemoryClient) Retrieve(ctx context.Context, bucket string, key string) (any, error) {
+	logs.Init("Retrieve [%q] : { %q }", bucket, key)
+	return ms.ConnectOrCreateBucket(ctx, bucket).Retrieve(ctx, key)
+}
+
+// deletes a key from a bucket
+func (ms *MemoryClient) Delete(ctx context.Context, bucket string, key string) error {
+	logs.Init("Delete [%q] key %q", bucket, key)
+	return ms.ConnectOrCreateBucket(ctx, bucket).Delete(ctx, key)
+}
+
+// Directly updates a value by key in a bucket
+func (ms *MemoryClient) Update(ctx context.Context, bucket string, key string, value any) error {
+	logs.Init("Update [%q] { %q : %v }", bucket, key, value)
+	return ms.ConnectOrCreateBucket(ctx, bucket).Update(ctx, key, value)
+}
+
+// Patch fields on the value of a key in a bucket
+func (ms *MemoryClient) Patch(ctx context.Context, bucket, key string, updates map[string]any) error {
+	logs.Init("Patch [%q] key %q updates: %v", bucket, key, updates)
+	return ms.ConnectOrCreateBucket(ctx, bucket).Patch(ctx, key, updates)
+}
+
+// Lookup a key in a bucket by field key
+// note: this is gated by the bucket policy (storage.PolicyFor)
+func (ms *MemoryClient) Lookup(ctx context.Context, bucket string, filter any, fields ...string) (map[string]any, error) {
+	logs.Init("Lookup [%q] filter: %v", bucket, filter)
+	return ms.ConnectOrCreateBucket(ctx, bucket).Lookup(ctx, filter, fields...)
+}
+
+// Retrieve a list of all keys in a bucket
+func (ms *MemoryClient) List(ctx context.Context, bucket string) ([]any, error) {
+	logs.Init("List [%s]", bucket)
+	return ms.ConnectOrCreateBucket(ctx, bucket).ListKeys(ctx)
+}
+
+// Retrieve a single page of items in a bucket
+func (ms *MemoryClient) ListPage(ctx context.Context, bucket string, opts storage.ListOptions) (storage.Page, error) {
+	logs.Init("ListPage [%s]", bucket)
+	return ms.ConnectOrCreateBucket(ctx, bucket).ListPage(ctx, opts)
+}
+
+// Count the number of keys in a bucket
+func (ms *MemoryClient) Count(ctx context.Context, bucket string) (int64, error) {
+	logs.Init("Count [%s]", bucket)
+	return ms.ConnectOrCreateBucket(ctx, bucket).Count(ctx)
+}
+
+// Buckets lists the buckets created in this store, sorted
+func (ms *MemoryClient) Buckets(ctx context.Context) ([]string, error) {
+	logs.Init("Buckets")
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return slices.Sorted(maps.Keys(ms.buckets)), nil
+}
@@ -0,0 +1,16 @@
+package memory_test
+
+import (
+	"testing"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	"github.com/danmuck/dps_http/lib/storage/memory"
+	"github.com/danmuck/dps_http/lib/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Client {
+		// stores are shared by name, every subtest gets its own
+		return memory.NewMemoryStore(t.Name())
+	})
+}
@@ -0,0 +1,97 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	logs "github.com/danmuck/dps_lib/logs"
+)
+
+// batchSize is how many documents the helpers write per batch call
+const batchSize = 100
+
+// CopyBucket stores every live document of from into to, creating to with
+// indexes; documents already in to are replaced, it returns the copied count
+// note: from is left untouched, drop it in a later migration
+func CopyBucket(ctx context.Context, c storage.Client, from, to string, indexes ...storage.Index) (int, error) {
+	src := c.ConnectOrCreateBucket(ctx, from)
+	dst := c.ConnectOrCreateBucket(ctx, to, indexes...)
+	items, err := src.ListItems(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for start := 0; start < len(items); start += batchSize {
+		end := min(start+batchSize, len(items))
+		batch := make([]storage.Item, 0, end-start)
+		for _, item := range items[start:end] {
+			key, _ := item["key"].(string)
+			batch = append(batch, storage.Item{Key: key, Value: item["value"]})
+		}
+		results, err := dst.BatchStore(ctx, batch)
+		if err != nil {
+			return n, err
+		}
+		if failed := storage.Failed(results); len(failed) > 0 {
+			return n, fmt.Errorf("copy %s -> %s: %d failed, first %q: %w",
+				from, to, len(failed), failed[0].Key, failed[0].Err)
+		}
+		n += len(batch)
+	}
+	logs.Info("copied %d documents %s -> %s", n, from, to)
+	return n, nil
+}
+
+// ClearBucket removes every document of bucket for good, the trash included,
+// it returns the removed count
+func ClearBucket(ctx context.Context, c storage.Client, bucket string) (int64, error) {
+	b := c.ConnectOrCreateBucket(ctx, bucket)
+	items, err := b.ListItems(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for start := 0; start < len(items); start += batchSize {
+		end := min(start+batchSize, len(items))
+		keys := make([]string, 0, end-start)
+		for _, item := range items[start:end] {
+			key, _ := item["key"].(string)
+			keys = append(keys, key)
+		}
+		if _, err := b.BatchDelete(ctx, keys); err != nil {
+			return 0, err
+		}
+	}
+	// every tombstone is older than a cutoff in the future
+	return b.Purge(ctx, time.Now().Add(time.Minute))
+}
+
+// Backfill patches every live document of b with the updates fn returns for
+// its value, an empty result leaves the document alone so that running it
+// again is a no-op; it returns the patched count
+// note: a document written concurrently fails with ErrStale, run it again
+func Backfill(ctx context.Context, b storage.Bucket, fn func(value map[string]any) map[string]any) (int, error) {
+	items, err := b.ListItems(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, item := range items {
+		key, _ := item["key"].(string)
+		value, ok := item["value"].(map[string]any)
+		if !ok {
+			continue
+		}
+		updates := fn(value)
+		if len(updates) == 0 {
+			continue
+		}
+		if _, err := b.PatchIfRevision(ctx, key, storage.Revision(item), updates); err != nil {
+			return n, fmt.Errorf("backfill %s %q: %w", b.Name(), key, err)
+		}
+		n++
+	}
+	logs.Info("backfilled %d documents in %s", n, b.Name())
+	return n, nil
+}
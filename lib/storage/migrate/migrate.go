@@ -0,0 +1,199 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	logs "github.com/danmuck/dps_lib/logs"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// @NOTE migrations are ordered by Version and recorded in the "migrations"
+// bucket once they ran, so running Up again only applies the new ones, e.g.
+//
+//	migrate.Migration{
+//		Version: 3,
+//		Name:    "move_users_to_v2",
+//		Up: func(ctx context.Context, c storage.Client) error {
+//			_, err := migrate.CopyBucket(ctx, c, "usersv1", "usersv2", api.UserIndexes...)
+//			return err
+//		},
+//		Down: func(ctx context.Context, c storage.Client) error {
+//			_, err := migrate.ClearBucket(ctx, c, "usersv2")
+//			return err
+//		},
+//	}
+//
+// Up and Down should be idempotent themselves, a migration that failed
+// halfway is not recorded and runs again from the start
+// a nil Down marks the migration as irreversible
+// note: there is no lock, run one migrate at a time
+// //
+
+// Bucket records the applied migrations, one document per version
+const Bucket = "migrations"
+
+// ErrIrreversible is returned by Down for a migration without a Down
+var ErrIrreversible = errors.New("migrate: migration is irreversible")
+
+// Migration is one versioned change of the stored data
+type Migration struct {
+	Version int    // order of the migration, unique and > 0
+	Name    string // short snake_case description
+	Up      func(ctx context.Context, c storage.Client) error
+	Down    func(ctx context.Context, c storage.Client) error // nil if irreversible
+}
+
+// record is the document stored in Bucket for an applied migration
+type record struct {
+	Version   int                `bson:"version"`
+	Name      string             `bson:"name"`
+	AppliedAt primitive.DateTime `bson:"applied_at"`
+}
+
+// Status is the state of one migration as reported by Runner.Status
+type Status struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	Unknown   bool // recorded but not part of the runner, e.g. from a newer build
+}
+
+// Runner applies migrations to a storage.Client
+type Runner struct {
+	client     storage.Client
+	records    *storage.TypedBucket[record]
+	migrations []Migration
+}
+
+// NewRunner returns a Runner for migrations sorted by Version
+// duplicate or non positive versions return ErrInvalid
+func NewRunner(ctx context.Context, client storage.Client, migrations ...Migration) (*Runner, error) {
+	sorted := slices.Clone(migrations)
+	slices.SortFunc(sorted, func(a, b Migration) int { return a.Version - b.Version })
+	for i, m := range sorted {
+		if m.Version <= 0 || m.Up == nil {
+			return nil, fmt.Errorf("%w: migration %d %q needs a positive version and an Up",
+				storage.ErrInvalid, m.Version, m.Name)
+		}
+		if i > 0 && sorted[i-1].Version == m.Version {
+			return nil, fmt.Errorf("%w: duplicate migration version %d", storage.ErrInvalid, m.Version)
+		}
+	}
+	return &Runner{
+		client:     client,
+		records:    storage.Typed[record](client.ConnectOrCreateBucket(ctx, Bucket)),
+		migrations: sorted,
+	}, nil
+}
+
+// applied returns the recorded migrations by version
+func (r *Runner) applied(ctx context.Context) (map[int]record, error) {
+	recs, err := r.records.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[int]record, len(recs))
+	for _, rec := range recs {
+		out[rec.Version] = rec
+	}
+	return out, nil
+}
+
+// Up applies the pending migrations up to and including target in order,
+// target 0 applies all of them; it returns the applied migrations
+func (r *Runner) Up(ctx context.Context, target int) ([]Migration, error) {
+	applied, err := r.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for _, m := range r.migrations {
+		if target > 0 && m.Version > target {
+			break
+		}
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		logs.Info("migrate up %d %s", m.Version, m.Name)
+		if err := m.Up(ctx, r.client); err != nil {
+			return done, fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+		rec := record{
+			Version:   m.Version,
+			Name:      m.Name,
+			AppliedAt: primitive.NewDateTimeFromTime(time.Now()),
+		}
+		if err := r.records.Store(ctx, key(m.Version), rec); err != nil {
+			return done, fmt.Errorf("recording migration %d %s: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// Down reverts the last steps applied migrations, newest first,
+// it stops at the first irreversible one; it returns the reverted migrations
+func (r *Runner) Down(ctx context.Context, steps int) ([]Migration, error) {
+	applied, err := r.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for i := len(r.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		m := r.migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if m.Down == nil {
+			return done, fmt.Errorf("%w: %d %s", ErrIrreversible, m.Version, m.Name)
+		}
+		logs.Info("migrate down %d %s", m.Version, m.Name)
+		if err := m.Down(ctx, r.client); err != nil {
+			return done, fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+		if err := r.records.Delete(ctx, key(m.Version)); err != nil {
+			return done, fmt.Errorf("unrecording migration %d %s: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// Status lists every migration of the runner and every recorded one
+func (r *Runner) Status(ctx context.Context) ([]Status, error) {
+	applied, err := r.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Status, 0, len(r.migrations))
+	for _, m := range r.migrations {
+		s := Status{Version: m.Version, Name: m.Name}
+		if rec, ok := applied[m.Version]; ok {
+			s.Applied, s.AppliedAt = true, rec.AppliedAt.Time()
+			delete(applied, m.Version)
+		}
+		out = append(out, s)
+	}
+	for _, rec := range applied {
+		out = append(out, Status{
+			Version:   rec.Version,
+			Name:      rec.Name,
+			Applied:   true,
+			AppliedAt: rec.AppliedAt.Time(),
+			Unknown:   true,
+		})
+	}
+	slices.SortFunc(out, func(a, b Status) int { return a.Version - b.Version })
+	return out, nil
+}
+
+// key is the record key of a version, zero padded so keys sort by version
+func key(version int) string {
+	return fmt.Sprintf("%06d", version)
+}
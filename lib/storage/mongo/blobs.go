@@ -0,0 +1,196 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	logs "github.com/danmuck/dps_lib/logs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GridFSStore keeps blobs in a GridFS bucket, blob keys are the file names
+// note: GridFS keeps every upload of a name as a revision, a Put removes
+// the older ones once the new upload is complete
+type GridFSStore struct {
+	name string
+	db   *mongo.Database
+}
+
+// gridFile is the part of a GridFS files document a BlobInfo needs
+type gridFile struct {
+	ID         any       `bson:"_id"`
+	Length     int64     `bson:"length"`
+	UploadDate time.Time `bson:"uploadDate"`
+	Metadata   struct {
+		ContentType string `bson:"content_type"`
+	} `bson:"metadata"`
+}
+
+// NewGridFSStore returns the GridFS bucket named bucket of the database
+// dbName at uri, sharing the connection of NewMongoStore
+func NewGridFSStore(uri, dbName, bucket string) (*GridFSStore, error) {
+	logs.Init("NewGridFSStore %s.%s", dbName, bucket)
+	ms, err := NewMongoStore(uri, dbName)
+	if err != nil {
+		return nil, err
+	}
+	return &GridFSStore{name: bucket, db: ms.db}, nil
+}
+
+// Name returns the GridFS bucket name
+func (gs *GridFSStore) Name() string {
+	return gs.name
+}
+
+// Put uploads r as the latest revision of key and drops the older ones
+func (gs *GridFSStore) Put(ctx context.Context, key string, r io.Reader, contentType string) (storage.BlobInfo, error) {
+	logs.Init("Put [%s] %q (%s)", gs.Name(), key, contentType)
+	if err := storage.ValidBlobKey(key); err != nil {
+		return storage.BlobInfo{}, err
+	}
+	if contentType == "" {
+		contentType = storage.OctetStream
+	}
+	b, err := gs.bucket(ctx)
+	if err != nil {
+		return storage.BlobInfo{}, err
+	}
+	id, err := b.UploadFromStream(key, storage.ContextReader(ctx, r),
+		options.GridFSUpload().SetMetadata(bson.M{"content_type": contentType}))
+	if err != nil {
+		logs.Err("Put() : %v", err)
+		return storage.BlobInfo{}, gridErr(key, err)
+	}
+	if err := gs.remove(ctx, b, bson.M{"filename": key, "_id": bson.M{"$ne": id}}); err != nil {
+		logs.Err("Put() : failed to drop older revisions of %q: %v", key, err)
+	}
+	return gs.Stat(ctx, key)
+}
+
+// Get streams the latest revision of key
+func (gs *GridFSStore) Get(ctx context.Context, key string) (io.ReadCloser, storage.BlobInfo, error) {
+	logs.Init("Get [%s] %q", gs.Name(), key)
+	if err := storage.ValidBlobKey(key); err != nil {
+		return nil, storage.BlobInfo{}, err
+	}
+	b, err := gs.bucket(ctx)
+	if err != nil {
+		return nil, storage.BlobInfo{}, err
+	}
+	file, err := gs.latest(ctx, b, key)
+	if err != nil {
+		return nil, storage.BlobInfo{}, err
+	}
+	ds, err := b.OpenDownloadStream(file.ID)
+	if err != nil {
+		return nil, storage.BlobInfo{}, gridErr(key, err)
+	}
+	return ds, file.info(key), nil
+}
+
+// Delete removes every revision of key
+func (gs *GridFSStore) Delete(ctx context.Context, key string) error {
+	logs.Init("Delete [%s] %q", gs.Name(), key)
+	if err := storage.ValidBlobKey(key); err != nil {
+		return err
+	}
+	b, err := gs.bucket(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := gs.latest(ctx, b, key); err != nil {
+		return err
+	}
+	return gs.remove(ctx, b, bson.M{"filename": key})
+}
+
+// Stat describes the latest revision of key
+func (gs *GridFSStore) Stat(ctx context.Context, key string) (storage.BlobInfo, error) {
+	if err := storage.ValidBlobKey(key); err != nil {
+		return storage.BlobInfo{}, err
+	}
+	b, err := gs.bucket(ctx)
+	if err != nil {
+		return storage.BlobInfo{}, err
+	}
+	file, err := gs.latest(ctx, b, key)
+	if err != nil {
+		return storage.BlobInfo{}, err
+	}
+	return file.info(key), nil
+}
+
+// bucket returns a GridFS bucket bounded by the deadline of ctx
+// note: the deadlines are per bucket, so every call gets its own
+func (gs *GridFSStore) bucket(ctx context.Context) (*gridfs.Bucket, error) {
+	b, err := gridfs.NewBucket(gs.db, options.GridFSBucket().SetName(gs.name))
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		b.SetWriteDeadline(deadline)
+		b.SetReadDeadline(deadline)
+	}
+	return b, nil
+}
+
+// latest returns the files document of the latest revision of key
+func (gs *GridFSStore) latest(ctx context.Context, b *gridfs.Bucket, key string) (gridFile, error) {
+	opts := options.GridFSFind().
+		SetSort(bson.D{{Key: "uploadDate", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(1)
+	cursor, err := b.FindContext(ctx, bson.M{"filename": key}, opts)
+	if err != nil {
+		return gridFile{}, gridErr(key, err)
+	}
+	var files []gridFile
+	if err := cursor.All(ctx, &files); err != nil {
+		return gridFile{}, gridErr(key, err)
+	}
+	if len(files) == 0 {
+		return gridFile{}, fmt.Errorf("%w: no blob with key=%q in bucket=%q", storage.ErrNotFound, key, gs.name)
+	}
+	return files[0], nil
+}
+
+// remove deletes the files matching filter and their chunks
+func (gs *GridFSStore) remove(ctx context.Context, b *gridfs.Bucket, filter bson.M) error {
+	cursor, err := b.FindContext(ctx, filter)
+	if err != nil {
+		return wrapErr(err)
+	}
+	var files []gridFile
+	if err := cursor.All(ctx, &files); err != nil {
+		return wrapErr(err)
+	}
+	for _, file := range files {
+		if err := b.DeleteContext(ctx, file.ID); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+			return wrapErr(err)
+		}
+	}
+	return nil
+}
+
+func (f gridFile) info(key string) storage.BlobInfo {
+	return storage.BlobInfo{
+		Key:         key,
+		Size:        f.Length,
+		ContentType: f.Metadata.ContentType,
+		Modified:    f.UploadDate,
+	}
+}
+
+// gridErr maps gridfs errors onto the storage errors
+func gridErr(key string, err error) error {
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return fmt.Errorf("%w: no blob with key=%q", storage.ErrNotFound, key)
+	}
+	return wrapErr(err)
+}
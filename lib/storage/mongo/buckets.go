@@ -2,12 +2,18 @@ package mongo
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/danmuck/dps_http/lib/storage"
 	logs "github.com/danmuck/dps_lib/logs"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -18,6 +24,9 @@ type mongoBucket struct {
 	count int64 // for internal use, future use
 	size  int64 // for internal use, future use
 	*mongo.Collection
+
+	mu   sync.RWMutex
+	text []string // fields of the text index, see Search
 }
 
 // newMongoBucket creates an instance using the MongoDB collection to the given id
@@ -45,54 +54,145 @@ func (b *mongoBucket) String() string {
 	return fmt.Sprintf("MongoBucket(id=%q, count=%d, size=%d)", b.id, b.count, b.size)
 }
 
+// ensureIndexes creates the declared indexes, CreateMany is a no-op
+// for indexes that already exist with the same spec
+func (b *mongoBucket) ensureIndexes(ctx context.Context, indexes []storage.Index) error {
+	models := make([]mongo.IndexModel, 0, len(indexes))
+	for _, idx := range indexes {
+		var kind any = 1
+		if idx.Text {
+			kind = "text"
+		}
+		keys := bson.D{}
+		for _, path := range idx.Paths() {
+			keys = append(keys, bson.E{Key: path, Value: kind})
+		}
+		opts := options.Index().SetName(idx.Name())
+		if idx.Unique {
+			opts.SetUnique(true).SetSparse(true)
+		}
+		models = append(models, mongo.IndexModel{Keys: keys, Options: opts})
+	}
+	names, err := b.Indexes().CreateMany(ctx, models)
+	if err != nil {
+		return wrapErr(err)
+	}
+	for _, idx := range indexes {
+		if idx.Text {
+			b.mu.Lock()
+			b.text = slices.Clone(idx.Fields)
+			b.mu.Unlock()
+		}
+	}
+	logs.Debug("indexes on [%s]: %v", b.Name(), names)
+	return nil
+}
+
+// ensureTTL creates the TTL index that lets the server remove documents
+// once their storage.Expires date has passed (see StoreWithTTL)
+func (b *mongoBucket) ensureTTL(ctx context.Context) error {
+	_, err := b.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: storage.Expires, Value: 1}},
+		Options: options.Index().SetName(storage.Expires + "_ttl").SetExpireAfterSeconds(0),
+	})
+	return wrapErr(err)
+}
+
 // Store stores the given key-value pair in the bucket
-func (b *mongoBucket) Store(key string, value any) error {
+// a value colliding with a unique index returns storage.ErrConflict
+func (b *mongoBucket) Store(ctx context.Context, key string, value any) error {
 	_, err := b.UpdateOne(
-		context.Background(),
-		map[string]any{
-			"key":   key,
-			"value": value,
-		},
-		bson.M{"$set": map[string]any{
-			"key":   key,
-			"value": value,
-		}}, options.Update().SetUpsert(true),
+		ctx,
+		bson.M{"key": key},
+		bson.M{
+			"$set": map[string]any{
+				"key":   key,
+				"value": value,
+			},
+			// storing over a trashed or expired key revives it
+			"$unset": bson.M{storage.Deleted: "", storage.Expires: ""},
+			"$inc":   bson.M{"rev": int64(1)},
+		}, options.Update().SetUpsert(true),
 	)
 	if err != nil {
 		logs.Err("Store() : %v", err)
-		return err
+		return wrapErr(err)
+	}
+	return nil
+}
+
+// StoreWithTTL stores the key-value pair like Store, the TTL index
+// removes it some time after ttl
+func (b *mongoBucket) StoreWithTTL(ctx context.Context, key string, value any, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%w: ttl must be positive, got %v", storage.ErrInvalid, ttl)
+	}
+	_, err := b.UpdateOne(
+		ctx,
+		bson.M{"key": key},
+		bson.M{
+			"$set": map[string]any{
+				"key":           key,
+				"value":         value,
+				storage.Expires: storage.Expiry(ttl),
+			},
+			"$unset": bson.M{storage.Deleted: ""},
+			"$inc":   bson.M{"rev": int64(1)},
+		}, options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		logs.Err("StoreWithTTL() : %v", err)
+		return wrapErr(err)
 	}
 	return nil
 }
 
 // Retrieve retrieves the value associated with the given key from the bucket
-// @TODO kinda bypassing this currently
-func (b *mongoBucket) Retrieve(key string) (any, error) {
-	logs.Dev("Retrieve not implemented for MongoBucket")
-	return nil, fmt.Errorf("not implemented")
+// the value is returned as decoded by the driver (e.g. map[string]any for documents)
+func (b *mongoBucket) Retrieve(ctx context.Context, key string) (any, error) {
+	logs.Init("Retrieve [%q] key=%q", b.Name(), key)
+
+	var rawDoc map[string]any
+	err := b.FindOne(ctx, live(bson.M{"key": key})).Decode(&rawDoc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		logs.Debug("soft warning: no document found for key %q", key)
+		return nil, notFound(key, b.Name())
+	}
+	if err != nil {
+		logs.Err("Retrieve error: %v", err)
+		return nil, wrapErr(err)
+	}
+	return rawDoc["value"], nil
 }
 
-// Delete deletes the key-value pair associated with the given key from the bucket
-func (b *mongoBucket) Delete(key string) error {
+// Delete moves the document at key to the trash
+func (b *mongoBucket) Delete(ctx context.Context, key string) error {
 	logs.Debug("Delete [%s] key=%q", b.Name(), key)
-	_, err := b.DeleteOne(context.Background(), bson.M{"key": key})
-	return err
+	result, err := b.UpdateOne(ctx, live(bson.M{"key": key}), trash(ctx))
+	if err != nil {
+		logs.Err("Delete() : %v", err)
+		return wrapErr(err)
+	}
+	if result.MatchedCount == 0 {
+		return notFound(key, b.Name())
+	}
+	return nil
 }
 
 // Update simply replaces the value for a key
 // note: this is due to dps_storage integration down the road
-func (b *mongoBucket) Update(key string, value any) error {
-	filter := bson.M{"key": key}
-	update := bson.M{"$set": bson.M{"value": value}}
+func (b *mongoBucket) Update(ctx context.Context, key string, value any) error {
+	filter := live(bson.M{"key": key})
+	update := bson.M{"$set": bson.M{"value": value}, "$inc": bson.M{"rev": int64(1)}}
 
-	result, err := b.UpdateOne(context.Background(), filter, update)
+	result, err := b.UpdateOne(ctx, filter, update)
 	if err != nil {
 		logs.Err("Update() : %v", err)
-		return err
+		return wrapErr(err)
 	}
 	if result.MatchedCount == 0 {
 		logs.Err("no document matched for key %q in bucket %q", key, b.Name())
-		return fmt.Errorf("no document with key=%q in bucket=%q", key, b.Name())
+		return notFound(key, b.Name())
 	}
 	// (Optionally, you can also check result.ModifiedCount==0 to warn if the value
 	// was identical and thus not modified.)
@@ -104,7 +204,7 @@ func (b *mongoBucket) Update(key string, value any) error {
 // this prepends the field name with "value." so that it complies with the
 // top level document structure {key: value} in which "username" is a field of value
 // as well as the MongoDB schema
-func (b *mongoBucket) Patch(key string, updates map[string]any) error {
+func (b *mongoBucket) Patch(ctx context.Context, key string, updates map[string]any) error {
 	logs.Init("Patch [%q] { %q : %v }", b.Name(), key, updates)
 
 	// Build a $set document that prefixes each field with "value."
@@ -115,67 +215,279 @@ func (b *mongoBucket) Patch(key string, updates map[string]any) error {
 	logs.Debug("patch bson : %v", patch)
 
 	result, err := b.UpdateOne(
-		context.Background(),
-		bson.M{"key": key},
-		bson.M{"$set": patch},
+		ctx,
+		live(bson.M{"key": key}),
+		bson.M{"$set": patch, "$inc": bson.M{"rev": int64(1)}},
 	)
 	if err != nil {
 		logs.Err("Patch() : %v", err)
-		return err
+		return wrapErr(err)
 	}
 	if result.MatchedCount == 0 {
 		logs.Err("no document matched for key %q in bucket %q", key, b.Name())
-		return fmt.Errorf("no document with key=%q in bucket=%q", key, b.Name())
+		return notFound(key, b.Name())
 	}
 	logs.Debug("[%q] patched %d documents for key %q",
 		b.Name(), result.ModifiedCount, key)
 	return nil
 }
 
+// RetrieveRevision retrieves the value for key along with its revision
+func (b *mongoBucket) RetrieveRevision(ctx context.Context, key string) (any, int64, error) {
+	var rawDoc map[string]any
+	err := b.FindOne(ctx, live(bson.M{"key": key})).Decode(&rawDoc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, 0, notFound(key, b.Name())
+	}
+	if err != nil {
+		logs.Err("RetrieveRevision error: %v", err)
+		return nil, 0, wrapErr(err)
+	}
+	return rawDoc["value"], storage.Revision(rawDoc), nil
+}
+
+// CompareAndSwap replaces the value for key if it is still at rev
+// and returns the new revision, a moved on document returns storage.ErrStale
+func (b *mongoBucket) CompareAndSwap(ctx context.Context, key string, rev int64, value any) (int64, error) {
+	return b.swap(ctx, key, rev, bson.M{
+		"$set": bson.M{"value": value},
+		"$inc": bson.M{"rev": int64(1)},
+	})
+}
+
+// PatchIfRevision patches the value for key like Patch if it is still at rev
+// and returns the new revision, a moved on document returns storage.ErrStale
+func (b *mongoBucket) PatchIfRevision(ctx context.Context, key string, rev int64, updates map[string]any) (int64, error) {
+	logs.Init("PatchIfRevision [%q] { %q@%d : %v }", b.Name(), key, rev, updates)
+	patch := bson.M{}
+	for field, val := range updates {
+		patch[storage.Prefix(field)] = val
+	}
+	return b.swap(ctx, key, rev, bson.M{
+		"$set": patch,
+		"$inc": bson.M{"rev": int64(1)},
+	})
+}
+
+// swap applies update to key only while the stored revision is rev
+// note: documents without a revision match rev 0
+func (b *mongoBucket) swap(ctx context.Context, key string, rev int64, update bson.M) (int64, error) {
+	filter := live(bson.M{"key": key, "rev": rev})
+	if rev == 0 {
+		filter["rev"] = bson.M{"$in": bson.A{int64(0), nil}}
+	}
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.M{"rev": 1})
+
+	var rawDoc map[string]any
+	err := b.FindOneAndUpdate(ctx, filter, update, opts).Decode(&rawDoc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// either the key is gone or another write got there first
+		if _, _, err := b.RetrieveRevision(ctx, key); err != nil {
+			return 0, err
+		}
+		return 0, stale(key, b.Name(), rev)
+	}
+	if err != nil {
+		logs.Err("swap() : %v", err)
+		return 0, wrapErr(err)
+	}
+	return storage.Revision(rawDoc), nil
+}
+
+// BatchStore upserts every item in one unordered bulk write
+func (b *mongoBucket) BatchStore(ctx context.Context, items []storage.Item) ([]storage.Result, error) {
+	logs.Init("BatchStore [%q] %d items", b.Name(), len(items))
+	results := make([]storage.Result, len(items))
+	models := make([]mongo.WriteModel, len(items))
+	for i, item := range items {
+		results[i].Key = item.Key
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"key": item.Key}).
+			SetUpdate(bson.M{
+				"$set":   bson.M{"key": item.Key, "value": item.Value},
+				"$unset": bson.M{storage.Deleted: "", storage.Expires: ""},
+				"$inc":   bson.M{"rev": int64(1)},
+			}).
+			SetUpsert(true)
+	}
+	return b.bulk(ctx, models, results)
+}
+
+// BatchDelete trashes every key in one unordered bulk write
+// note: keys that do not exist are found up front and reported as
+// storage.ErrNotFound, the bulk result only carries totals
+func (b *mongoBucket) BatchDelete(ctx context.Context, keys []string) ([]storage.Result, error) {
+	logs.Init("BatchDelete [%q] %d keys", b.Name(), len(keys))
+	existing, err := b.existing(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]storage.Result, len(keys))
+	models := make([]mongo.WriteModel, len(keys))
+	for i, key := range keys {
+		results[i].Key = key
+		if !existing[key] {
+			results[i].Err = notFound(key, b.Name())
+			continue
+		}
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(live(bson.M{"key": key})).
+			SetUpdate(trash(ctx))
+	}
+	return b.bulk(ctx, models, results)
+}
+
+// BatchPatch applies every change like Patch in one unordered bulk write
+// note: missing keys are reported the same way as BatchDelete
+func (b *mongoBucket) BatchPatch(ctx context.Context, changes []storage.Change) ([]storage.Result, error) {
+	logs.Init("BatchPatch [%q] %d changes", b.Name(), len(changes))
+	keys := make([]string, len(changes))
+	for i, change := range changes {
+		keys[i] = change.Key
+	}
+	existing, err := b.existing(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]storage.Result, len(changes))
+	models := make([]mongo.WriteModel, len(changes))
+	for i, change := range changes {
+		results[i].Key = change.Key
+		if !existing[change.Key] {
+			results[i].Err = notFound(change.Key, b.Name())
+			continue
+		}
+		patch := bson.M{}
+		for field, val := range change.Updates {
+			patch[storage.Prefix(field)] = val
+		}
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(live(bson.M{"key": change.Key})).
+			SetUpdate(bson.M{"$set": patch, "$inc": bson.M{"rev": int64(1)}})
+	}
+	return b.bulk(ctx, models, results)
+}
+
+// bulk sends the non nil models as one unordered bulk write and maps the
+// write errors back onto results, models and results share their index
+func (b *mongoBucket) bulk(ctx context.Context, models []mongo.WriteModel, results []storage.Result) ([]storage.Result, error) {
+	var send []mongo.WriteModel
+	var index []int // position in results of each model sent
+	for i, model := range models {
+		if model != nil {
+			send = append(send, model)
+			index = append(index, i)
+		}
+	}
+	if len(send) == 0 {
+		return results, nil
+	}
+
+	_, err := b.BulkWrite(ctx, send, options.BulkWrite().SetOrdered(false))
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) && bwe.WriteConcernError == nil {
+		for _, we := range bwe.WriteErrors {
+			results[index[we.Index]].Err = wrapErr(we)
+		}
+		err = nil
+	}
+	if err != nil {
+		logs.Err("bulk() : %v", err)
+		return nil, wrapErr(err)
+	}
+	return results, nil
+}
+
+// existing returns the subset of keys that have a live document
+func (b *mongoBucket) existing(ctx context.Context, keys []string) (map[string]bool, error) {
+	cursor, err := b.Find(ctx,
+		live(bson.M{"key": bson.M{"$in": keys}}),
+		options.Find().SetProjection(bson.M{"key": 1}),
+	)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	var docs []struct {
+		Key string `bson:"key"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, wrapErr(err)
+	}
+	found := make(map[string]bool, len(docs))
+	for _, doc := range docs {
+		found[doc.Key] = true
+	}
+	return found, nil
+}
+
 // Lookup retrieves a document from the bucket based on the provided filter.
-// The filter is cleaned according to config @REMINDER currently in utils.go
-// and prefixed to ensure compliance with the MongoDB schema. (storage/utils.go)
-func (b *mongoBucket) Lookup(filter any) (map[string]any, bool) {
-	mongoFilter := storage.CleanAndPrefix(filter)
+// The filter is checked against the bucket policy (storage.PolicyFor)
+// and prefixed to ensure compliance with the MongoDB schema.
+// A filter that matches nothing returns storage.ErrNotFound.
+// fields are pushed down as a projection, see storage.Projection
+func (b *mongoBucket) Lookup(ctx context.Context, filter any, fields ...string) (map[string]any, error) {
+	doc, err := b.LookupItem(ctx, filter, fields...)
+	if err != nil {
+		return nil, err
+	}
+	return doc["value"].(map[string]any), nil
+}
+
+// LookupItem retrieves the {key, value, rev} document Lookup reads
+func (b *mongoBucket) LookupItem(ctx context.Context, filter any, fields ...string) (map[string]any, error) {
+	mongoFilter, err := storage.PolicyFor(b.id).Clean(ctx, filter)
+	if err != nil {
+		logs.Err("Lookup rejected filter %v: %v", filter, err)
+		return nil, err
+	}
+	if err := storage.ValidProjection(fields); err != nil {
+		return nil, err
+	}
 	logs.Init("Lookup filter : %v", mongoFilter)
 
 	if len(mongoFilter) == 0 {
-		// nothing allowed to search on
 		logs.Err("empty filter provided, nothing to search on")
-		return nil, false
+		return nil, fmt.Errorf("%w: empty filter", storage.ErrInvalid)
 	}
 
+	findOpts := options.FindOne()
+	if projection := storage.Projection(fields); projection != nil {
+		findOpts.SetProjection(projection)
+	}
 	var rawDoc map[string]any
-	err := b.FindOne(context.Background(), mongoFilter).Decode(&rawDoc)
+	err = b.FindOne(ctx, live(mongoFilter), findOpts).Decode(&rawDoc)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if errors.Is(err, mongo.ErrNoDocuments) {
 			logs.Debug("soft warning: no document found for filter %v", mongoFilter)
-			return nil, false
+		} else {
+			logs.Err("Lookup error: %v", err)
 		}
-		logs.Err("Lookup error: %v", err)
-		return nil, false
+		return nil, wrapErr(err)
 	}
 
-	// unwrap and return
+	// unwrap and return, a projection matching no field leaves no value
+	if _, ok := rawDoc["value"]; !ok && len(fields) > 0 {
+		rawDoc["value"] = map[string]any{}
+	}
 	userMap, ok := rawDoc["value"].(map[string]any)
 	if !ok {
 		logs.Err("unexpected document shape %T", rawDoc["value"])
-		return nil, false
+		return nil, fmt.Errorf("unexpected document shape %T", rawDoc["value"])
 	}
 	logs.Debug("found user map: %v", userMap["username"])
-	return userMap, true
+	return rawDoc, nil
 }
 
 // ListKeys retrieves all keys from the bucket
-func (b *mongoBucket) ListKeys() ([]any, error) {
+func (b *mongoBucket) ListKeys(ctx context.Context) ([]any, error) {
 	logs.Init("List [%s]", b.Name())
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
 
-	cursor, err := b.Find(ctx, map[string]any{})
+	cursor, err := b.Find(ctx, live(bson.M{}))
 	if err != nil {
 		logs.Err("error: %v", err)
-		return nil, err
+		return nil, wrapErr(err)
 	}
 	defer cursor.Close(ctx)
 
@@ -189,20 +501,18 @@ func (b *mongoBucket) ListKeys() ([]any, error) {
 		results = append(results, result["value"])
 	}
 
-	return results, nil
+	return results, wrapErr(cursor.Err())
 }
 
 // ListItems retrieves all items from the bucket
 // note: you will need to validate the result before using it
-func (b *mongoBucket) ListItems() ([]map[string]any, error) {
+func (b *mongoBucket) ListItems(ctx context.Context) ([]map[string]any, error) {
 	logs.Init("ListItems [%s]", b.Name())
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
 
-	cursor, err := b.Find(ctx, map[string]any{})
+	cursor, err := b.Find(ctx, live(bson.M{}))
 	if err != nil {
 		logs.Err("error: %v", err)
-		return nil, err
+		return nil, wrapErr(err)
 	}
 	defer cursor.Close(ctx)
 
@@ -216,16 +526,226 @@ func (b *mongoBucket) ListItems() ([]map[string]any, error) {
 		results = append(results, result)
 	}
 
-	return results, nil
+	return results, wrapErr(cursor.Err())
+}
+
+// ListPage retrieves one page of {key, value} documents
+// sorting, filtering and the keyset cursor are all pushed down to MongoDB
+func (b *mongoBucket) ListPage(ctx context.Context, opts storage.ListOptions) (storage.Page, error) {
+	logs.Init("ListPage [%s] %+v", b.Name(), opts)
+	q, err := opts.Query(ctx, storage.PolicyFor(b.id))
+	if err != nil {
+		return storage.Page{}, err
+	}
+
+	findOpts := options.Find().SetSort(q.Sort()).SetLimit(q.Limit + 1)
+	if projection := q.Projection(); projection != nil {
+		findOpts.SetProjection(projection)
+	}
+	cursor, err := b.Find(ctx, live(q.Match()), findOpts)
+	if err != nil {
+		logs.Err("error: %v", err)
+		return storage.Page{}, wrapErr(err)
+	}
+	defer cursor.Close(ctx)
+
+	results := make([]map[string]any, 0, q.Limit+1)
+	for cursor.Next(ctx) {
+		var result map[string]any
+		if err := cursor.Decode(&result); err != nil {
+			logs.Err("decode error: %v", err)
+			return storage.Page{}, err
+		}
+		results = append(results, result)
+	}
+	if err := cursor.Err(); err != nil {
+		return storage.Page{}, wrapErr(err)
+	}
+	return q.Page(results), nil
+}
+
+// Aggregate groups and counts the live documents with a pipeline
+func (b *mongoBucket) Aggregate(ctx context.Context, agg storage.Aggregation) ([]storage.Group, error) {
+	logs.Init("Aggregate [%s] %+v", b.Name(), agg)
+	q, err := agg.Query(ctx, storage.PolicyFor(b.id))
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := b.Collection.Aggregate(ctx, q.Pipeline(live(q.Filter)))
+	if err != nil {
+		logs.Err("error: %v", err)
+		return nil, wrapErr(err)
+	}
+	var rows []map[string]any
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, wrapErr(err)
+	}
+	return q.Groups(rows), nil
+}
+
+// Search finds live documents through the text index of the collection
+// note: the server only searches every field of the index, a search
+// restricted to some of them filters the matches here
+func (b *mongoBucket) Search(ctx context.Context, query string, in []string, limit int64, fields ...string) ([]map[string]any, error) {
+	logs.Init("Search [%s] %q in %v", b.Name(), query, in)
+	b.mu.RLock()
+	text := b.text
+	b.mu.RUnlock()
+	q, err := storage.NewSearch(ctx, storage.PolicyFor(b.id), text, query, in, limit, fields...)
+	if err != nil {
+		return nil, err
+	}
+
+	score := bson.M{"$meta": "textScore"}
+	projection := bson.M{"score": score}
+	if len(q.Fields) > 0 {
+		projection = storage.Projection(q.Fields)
+		projection["score"] = score
+	}
+	findOpts := options.Find().
+		SetProjection(projection).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "key", Value: 1}}).
+		SetLimit(q.Limit)
+	filter := bson.M{"$text": bson.M{"$search": strings.Join(q.Terms, " ")}}
+	if !q.All {
+		filter["$or"] = inPaths(q)
+	}
+	cursor, err := b.Find(ctx, live(filter), findOpts)
+	if err != nil {
+		logs.Err("error: %v", err)
+		return nil, wrapErr(err)
+	}
+	defer cursor.Close(ctx)
+
+	results := make([]map[string]any, 0)
+	for cursor.Next(ctx) {
+		var result map[string]any
+		if err := cursor.Decode(&result); err != nil {
+			logs.Err("decode error: %v", err)
+			return nil, err
+		}
+		delete(result, "score")
+		result["value"] = storage.Pick(result["value"], q.Fields) // a projection matching no field leaves no value
+		if results = append(results, result); int64(len(results)) == q.Limit {
+			break
+		}
+	}
+	return results, wrapErr(cursor.Err())
 }
 
 // Get the number of keys in the bucket
-func (b *mongoBucket) Count() (int64, error) {
+func (b *mongoBucket) Count(ctx context.Context) (int64, error) {
 	logs.Init("Count [%s]", b.Name())
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
 
-	count, err := b.CountDocuments(ctx, bson.M{})
+	count, err := b.CountDocuments(ctx, live(bson.M{}))
 	logs.Log("[%s] count: %d", b.Name(), count)
-	return count, err
+	return count, wrapErr(err)
+}
+
+// ListTrash retrieves one page of trashed documents, like ListPage
+func (b *mongoBucket) ListTrash(ctx context.Context, opts storage.ListOptions) (storage.Page, error) {
+	logs.Init("ListTrash [%s] %+v", b.Name(), opts)
+	q, err := opts.Query(ctx, storage.PolicyFor(b.id))
+	if err != nil {
+		return storage.Page{}, err
+	}
+
+	findOpts := options.Find().SetSort(q.Sort()).SetLimit(q.Limit + 1)
+	if projection := q.Projection(); projection != nil {
+		findOpts.SetProjection(projection)
+	}
+	cursor, err := b.Find(ctx, trashed(q.Match()), findOpts)
+	if err != nil {
+		logs.Err("error: %v", err)
+		return storage.Page{}, wrapErr(err)
+	}
+	var results []map[string]any
+	if err := cursor.All(ctx, &results); err != nil {
+		return storage.Page{}, wrapErr(err)
+	}
+	return q.Page(results), nil
+}
+
+// Restore takes the document at key out of the trash
+func (b *mongoBucket) Restore(ctx context.Context, key string) error {
+	logs.Init("Restore [%s] key=%q", b.Name(), key)
+	result, err := b.UpdateOne(ctx, trashed(bson.M{"key": key}), bson.M{
+		"$unset": bson.M{storage.Deleted: ""},
+		"$inc":   bson.M{"rev": int64(1)},
+	})
+	if err != nil {
+		logs.Err("Restore() : %v", err)
+		return wrapErr(err)
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("%w: no trashed document with key=%q in bucket=%q",
+			storage.ErrNotFound, key, b.Name())
+	}
+	return nil
+}
+
+// Purge removes the documents trashed before cutoff for good
+func (b *mongoBucket) Purge(ctx context.Context, before time.Time) (int64, error) {
+	logs.Init("Purge [%s] before %v", b.Name(), before)
+	result, err := b.DeleteMany(ctx, bson.M{storage.Deleted + ".at": bson.M{"$lt": before}})
+	if err != nil {
+		logs.Err("Purge() : %v", err)
+		return 0, wrapErr(err)
+	}
+	return result.DeletedCount, nil
+}
+
+// inPaths restricts a search to documents holding one of its terms as a
+// word of one of its paths
+// note: the text index matches in all of its fields, with stemming, the
+// words are matched exactly like the in process index of the other backends
+func inPaths(q storage.SearchQuery) []any {
+	terms := make([]string, len(q.Terms))
+	for i, term := range q.Terms {
+		terms[i] = regexp.QuoteMeta(term)
+	}
+	word := `(?<![\p{L}\p{N}])(` + strings.Join(terms, "|") + `)(?![\p{L}\p{N}])`
+	out := make([]any, 0, len(q.Paths))
+	for _, path := range q.Paths {
+		out = append(out, bson.M{path: bson.M{"$regex": word, "$options": "i"}})
+	}
+	return out
+}
+
+// live restricts filter to documents that are neither trashed nor expired
+func live(filter bson.M) bson.M {
+	out := bson.M{
+		storage.Deleted: nil, // missing or null
+		storage.Expires: unexpired(),
+	}
+	for field, val := range filter {
+		out[field] = val
+	}
+	return out
+}
+
+// trashed restricts filter to trashed documents that have not expired
+func trashed(filter bson.M) bson.M {
+	out := bson.M{
+		storage.Deleted: bson.M{"$ne": nil},
+		storage.Expires: unexpired(),
+	}
+	for field, val := range filter {
+		out[field] = val
+	}
+	return out
+}
+
+// unexpired matches a missing expiry or one still in the future, the TTL
+// monitor only runs about once a minute so expired documents linger
+func unexpired() bson.M {
+	return bson.M{"$not": bson.M{"$lte": primitive.NewDateTimeFromTime(time.Now())}}
+}
+
+// trash is the update that tombstones a document
+func trash(ctx context.Context) bson.M {
+	return bson.M{
+		"$set": bson.M{storage.Deleted: storage.Tombstone(ctx)},
+		"$inc": bson.M{"rev": int64(1)},
+	}
 }
@@ -2,6 +2,9 @@ package mongo
 
 import (
 	"context"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/danmuck/dps_http/lib/storage"
@@ -11,6 +14,13 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// stores holds every MongoClient connected in this process by uri and
+// database, so services share a single connection pool
+var (
+	stores   = make(map[string]*MongoClient)
+	storesMu sync.Mutex
+)
+
 type MongoClient struct {
 	name     string
 	location string
@@ -18,9 +28,20 @@ type MongoClient struct {
 	client   *mongo.Client
 	db       *mongo.Database
 	buckets  map[string]*mongoBucket
+
+	mu sync.Mutex
 }
 
+// NewMongoStore connects to the database dbName at uri,
+// reusing the connection of an earlier call with the same arguments
 func NewMongoStore(uri, dbName string) (*MongoClient, error) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	if ms, exists := stores[uri+"/"+dbName]; exists {
+		logs.Log("reusing MongoDB connection to %s", dbName)
+		return ms, nil
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -35,13 +56,15 @@ func NewMongoStore(uri, dbName string) (*MongoClient, error) {
 	}
 	logs.Log("connecting to MongoDB at %s", uri)
 	db := client.Database(dbName)
-	return &MongoClient{
+	ms := &MongoClient{
 		name:    dbName,
 		t:       "mongo",
 		client:  client,
 		db:      db,
 		buckets: make(map[string]*mongoBucket),
-	}, nil
+	}
+	stores[uri+"/"+dbName] = ms
+	return ms, nil
 }
 
 // Name returns the name of the MongoDB Database
@@ -62,85 +85,122 @@ func (md *MongoClient) Location() string {
 
 // MongoDB client Ping wrapper
 func (ms *MongoClient) Ping(ctx context.Context) error {
-	return ms.client.Ping(ctx, nil)
+	return wrapErr(ms.client.Ping(ctx, nil))
 }
 
 // ConnectOrCreateBucket connects to an existing bucket or creates a new one if it doesn't exist.
 // It returns the collection for the specified bucket.
-func (ms *MongoClient) ConnectOrCreateBucket(bucket string) storage.Bucket {
+// indexes are created if they do not exist yet, a failure is logged and
+// the bucket is still returned
+func (ms *MongoClient) ConnectOrCreateBucket(ctx context.Context, bucket string, indexes ...storage.Index) storage.Bucket {
 	logs.Init("ConnectOrCreateBucket [%s]", bucket)
+	ms.mu.Lock()
 	collection, exists := ms.buckets[bucket]
 	if !exists || collection == nil {
 		logs.Info("Create [%s]", bucket)
 		collection = newMongoBucket(ms.db, bucket)
 		ms.buckets[bucket] = collection
 	}
+	ms.mu.Unlock()
+	if !exists {
+		if err := collection.ensureTTL(ctx); err != nil {
+			logs.Err("failed to create the ttl index for bucket %q: %v", bucket, err)
+		}
+	}
+	if len(indexes) > 0 {
+		if err := collection.ensureIndexes(ctx, indexes); err != nil {
+			logs.Err("failed to create indexes for bucket %q: %v", bucket, err)
+		}
+	}
 	logs.Debug("Connect [%s]", bucket)
 	return collection
 }
 
 // basic CRUD operations
-func (ms *MongoClient) Store(bucket string, key string, value any) error {
+func (ms *MongoClient) Store(ctx context.Context, bucket string, key string, value any) error {
 	logs.Init("Store [%q] : { %q : %q }", bucket, key, value)
-	collection := ms.ConnectOrCreateBucket(bucket)
-	err := collection.Store(key, value)
+	collection := ms.ConnectOrCreateBucket(ctx, bucket)
+	err := collection.Store(ctx, key, value)
 	logs.Debug("Store result: %v (success if <nil>)", err)
 	return err
 }
 
-// retreieves a value by key from a bucket
-// note: this wraps Lookup() with a specific filter for the key
+// retrieves a value by key from a bucket
 // it returns the value directly as `any` type
-func (ms *MongoClient) Retrieve(bucket string, key string) (any, error) {
+func (ms *MongoClient) Retrieve(ctx context.Context, bucket string, key string) (any, error) {
 	logs.Init("Retrieve [%q] : { %q }", bucket, key)
-	result, _ := ms.Lookup(bucket, bson.M{"key": key})
-	return result["value"], nil
+	collection := ms.ConnectOrCreateBucket(ctx, bucket)
+	return collection.Retrieve(ctx, key)
 }
 
-// TODO: implement
-func (ms *MongoClient) Delete(bucket string, key string) error {
+// deletes a key from a bucket
+func (ms *MongoClient) Delete(ctx context.Context, bucket string, key string) error {
 	logs.Init("Delete [%q] key %q", bucket, key)
-	collection := ms.ConnectOrCreateBucket(bucket)
-	err := collection.Delete(key)
+	collection := ms.ConnectOrCreateBucket(ctx, bucket)
+	err := collection.Delete(ctx, key)
 	return err
 }
 
 // Directly updates a value by key in a bucket
-func (ms *MongoClient) Update(bucket string, key string, value any) error {
+func (ms *MongoClient) Update(ctx context.Context, bucket string, key string, value any) error {
 	logs.Init("Update [%q] { %q : %v }", bucket, key, value)
-	collection := ms.ConnectOrCreateBucket(bucket)
-	return collection.Update(key, value)
+	collection := ms.ConnectOrCreateBucket(ctx, bucket)
+	return collection.Update(ctx, key, value)
 }
 
 // Patch fields on the value of a key in a bucket
-func (ms *MongoClient) Patch(bucket, key string, updates map[string]any) error {
+func (ms *MongoClient) Patch(ctx context.Context, bucket, key string, updates map[string]any) error {
 	logs.Init("Patch [%q] key %q updates: %v", bucket, key, updates)
-	collection := ms.ConnectOrCreateBucket(bucket)
-	return collection.Patch(key, updates)
+	collection := ms.ConnectOrCreateBucket(ctx, bucket)
+	return collection.Patch(ctx, key, updates)
 }
 
 // Lookup a key in a bucket by field key
-// note: this is gated by the allowed filter in storage/utils
+// note: this is gated by the bucket policy (storage.PolicyFor)
 // this is for user scope interactions
 // @TODO admin version
-func (ms *MongoClient) Lookup(bucket string, filter any) (map[string]any, bool) {
+func (ms *MongoClient) Lookup(ctx context.Context, bucket string, filter any, fields ...string) (map[string]any, error) {
 	logs.Init("Lookup [%q] filter: %v", bucket, filter)
-	collection := ms.ConnectOrCreateBucket(bucket)
-	return collection.Lookup(filter)
+	collection := ms.ConnectOrCreateBucket(ctx, bucket)
+	return collection.Lookup(ctx, filter, fields...)
 }
 
 // Retrieve a list of all keys in a bucket
-func (ms *MongoClient) List(bucket string) ([]any, error) {
+func (ms *MongoClient) List(ctx context.Context, bucket string) ([]any, error) {
 	logs.Init("List [%s]", bucket)
-	collection := ms.ConnectOrCreateBucket(bucket)
-	return collection.ListKeys()
+	collection := ms.ConnectOrCreateBucket(ctx, bucket)
+	return collection.ListKeys(ctx)
+}
+
+// Retrieve a single page of items in a bucket
+func (ms *MongoClient) ListPage(ctx context.Context, bucket string, opts storage.ListOptions) (storage.Page, error) {
+	logs.Init("ListPage [%s]", bucket)
+	collection := ms.ConnectOrCreateBucket(ctx, bucket)
+	return collection.ListPage(ctx, opts)
 }
 
 // Count the number of keys in a bucket
-func (ms *MongoClient) Count(bucket string) (int64, error) {
+func (ms *MongoClient) Count(ctx context.Context, bucket string) (int64, error) {
 	logs.Init("Count [%s]", bucket)
-	collection := ms.ConnectOrCreateBucket(bucket)
-	return collection.Count()
+	collection := ms.ConnectOrCreateBucket(ctx, bucket)
+	return collection.Count(ctx)
+}
+
+// Buckets lists the collections of the database, sorted
+// note: the GridFS collections of a blob store (see NewGridFSStore) in the
+// same database are listed too
+func (ms *MongoClient) Buckets(ctx context.Context) ([]string, error) {
+	logs.Init("Buckets")
+	names, err := ms.db.ListCollectionNames(ctx, bson.M{})
+	if err != nil {
+		logs.Err("error: %v", err)
+		return nil, wrapErr(err)
+	}
+	names = slices.DeleteFunc(names, func(name string) bool {
+		return strings.HasPrefix(name, "system.")
+	})
+	slices.Sort(names)
+	return names, nil
 }
 
 //		Example filters:
@@ -157,6 +217,6 @@ func (ms *MongoClient) Count(bucket string) (int64, error) {
 //				},
 //				"value.status": "active",
 //			}
-//			result, found := ms.Lookup("myBucket", filter)
+//			result, err := ms.Lookup(ctx, "myBucket", filter)
 //
 // //
@@ -0,0 +1,39 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// wrapErr maps driver errors onto the storage sentinel errors
+// the driver error stays in the chain for logging
+func wrapErr(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return fmt.Errorf("%w: %w", storage.ErrNotFound, err)
+	case mongo.IsDuplicateKeyError(err):
+		return fmt.Errorf("%w: %w", storage.ErrConflict, err)
+	case mongo.IsTimeout(err),
+		mongo.IsNetworkError(err),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, mongo.ErrClientDisconnected):
+		return fmt.Errorf("%w: %w", storage.ErrUnavailable, err)
+	}
+	return err
+}
+
+// notFound reports a key that matched no document
+func notFound(key, bucket string) error {
+	return fmt.Errorf("%w: no document with key=%q in bucket=%q", storage.ErrNotFound, key, bucket)
+}
+
+// stale reports a conditional write on a document that is no longer at rev
+func stale(key, bucket string, rev int64) error {
+	return fmt.Errorf("%w: key=%q in bucket=%q is no longer at revision %d", storage.ErrStale, key, bucket, rev)
+}
@@ -0,0 +1,53 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	"github.com/danmuck/dps_http/lib/storage/storagetest"
+)
+
+// needs a server, e.g.
+//
+//	MONGO_TEST_URI=mongodb://localhost:27017 go test ./lib/storage/mongo
+func TestConformance(t *testing.T) {
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+	storagetest.Run(t, func(t *testing.T) storage.Client {
+		ms, err := NewMongoStore(uri, fmt.Sprintf("conformance_%d", time.Now().UnixNano()))
+		if err != nil {
+			t.Fatalf("NewMongoStore: %v", err)
+		}
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			ms.db.Drop(ctx)
+		})
+		return ms
+	})
+}
+
+func TestBlobConformance(t *testing.T) {
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+	storagetest.RunBlobs(t, func(t *testing.T) storage.BlobStore {
+		gs, err := NewGridFSStore(uri, fmt.Sprintf("conformance_%d", time.Now().UnixNano()), "blobs")
+		if err != nil {
+			t.Fatalf("NewGridFSStore: %v", err)
+		}
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			gs.db.Drop(ctx)
+		})
+		return gs
+	})
+}
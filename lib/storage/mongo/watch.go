@@ -0,0 +1,134 @@
+package mongo
+
+import (
+	"context"
+	"slices"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	logs "github.com/danmuck/dps_lib/logs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// changeEvent is the part of a change stream event Watch reads
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		ID any `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument      map[string]any `bson:"fullDocument"`
+	UpdateDescription struct {
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+// Watch streams the writes on the collection through a change stream
+// note: change streams need a replica set, on a standalone server this
+// returns the driver error
+//
+// delete events only carry the _id of the document, so the _id -> key of
+// every live document is loaded once and kept up to date by the stream
+//
+// a soft delete is an update setting the tombstone and is reported as an
+// OpDelete, clearing it again (Restore, Store) as an OpInsert, a Purge
+// removes documents that are not tracked anymore and is dropped
+func (b *mongoBucket) Watch(ctx context.Context) (<-chan storage.Event, error) {
+	logs.Init("Watch [%s]", b.Name())
+	stream, err := b.Collection.Watch(ctx, mongo.Pipeline{},
+		options.ChangeStream().SetFullDocument(options.UpdateLookup))
+	if err != nil {
+		logs.Err("Watch() : %v", err)
+		return nil, wrapErr(err)
+	}
+	// opened first so that nothing written while the keys load is missed
+	keys, err := b.keysByID(ctx)
+	if err != nil {
+		stream.Close(context.Background())
+		return nil, err
+	}
+
+	events := make(chan storage.Event)
+	go func() {
+		defer close(events)
+		defer stream.Close(context.Background())
+		for stream.Next(ctx) {
+			var change changeEvent
+			if err := stream.Decode(&change); err != nil {
+				logs.Err("Watch [%s] decode: %v", b.Name(), err)
+				continue
+			}
+			ev, ok := b.event(change, keys)
+			if !ok {
+				continue
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := stream.Err(); err != nil && ctx.Err() == nil {
+			logs.Err("Watch [%s] stream: %v", b.Name(), err)
+		}
+	}()
+	return events, nil
+}
+
+// event converts a change stream event, updating keys along the way
+func (b *mongoBucket) event(change changeEvent, keys map[any]string) (storage.Event, bool) {
+	switch change.OperationType {
+	case "insert", "update", "replace":
+		if change.FullDocument == nil {
+			// deleted again before the update lookup ran
+			return storage.Event{}, false
+		}
+		key, _ := change.FullDocument["key"].(string)
+		if storage.IsDeleted(change.FullDocument) {
+			delete(keys, change.DocumentKey.ID)
+			return storage.Event{Op: storage.OpDelete, Key: key, Rev: storage.Revision(change.FullDocument)}, true
+		}
+		op := storage.OpUpdate
+		if change.OperationType == "insert" ||
+			slices.Contains(change.UpdateDescription.RemovedFields, storage.Deleted) {
+			op = storage.OpInsert
+		}
+		keys[change.DocumentKey.ID] = key
+		return storage.Event{
+			Op:    op,
+			Key:   key,
+			Value: change.FullDocument["value"],
+			Rev:   storage.Revision(change.FullDocument),
+		}, true
+	case "delete":
+		key, ok := keys[change.DocumentKey.ID]
+		if !ok {
+			// purged from the trash, already reported by the soft delete
+			logs.Debug("Watch [%s] delete of untracked _id %v", b.Name(), change.DocumentKey.ID)
+			return storage.Event{}, false
+		}
+		delete(keys, change.DocumentKey.ID)
+		return storage.Event{Op: storage.OpDelete, Key: key}, true
+	}
+	return storage.Event{}, false
+}
+
+// keysByID loads the _id -> key of every live document in the collection
+func (b *mongoBucket) keysByID(ctx context.Context) (map[any]string, error) {
+	cursor, err := b.Find(ctx, live(bson.M{}), options.Find().SetProjection(bson.M{"key": 1}))
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	var docs []struct {
+		ID  any    `bson:"_id"`
+		Key string `bson:"key"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, wrapErr(err)
+	}
+	keys := make(map[any]string, len(docs))
+	for _, doc := range docs {
+		keys[doc.ID] = doc.Key
+	}
+	return keys, nil
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	logs "github.com/danmuck/dps_lib/logs"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// @NOTE policies replace the old package level `allowed` whitelist,
+// every bucket declares which value fields may be filtered (or sorted) on,
+// by whom and with which operators, e.g.
+//
+//	storage.RegisterPolicy("usersv1", storage.Policy{Fields: map[string]storage.Rule{
+//		"username": {Ops: []string{"$in"}},
+//		"email":    {Roles: []string{"admin", storage.RoleSystem}},
+//	}})
+//
+// a filter that touches anything else is rejected with ErrInvalid
+// instead of being silently dropped
+// //
+
+// RoleSystem marks a trusted internal caller (e.g. the register
+// uniqueness check), it passes every Rule.Roles check
+const RoleSystem = "system"
+
+// Rule controls access to a single value field
+type Rule struct {
+	Ops   []string // operators allowed besides plain equality ($eq), e.g. "$in", "$gt"
+	Roles []string // caller roles allowed to use the field, nil for anyone
+}
+
+// Policy declares the queryable fields of a bucket
+// the zero Policy only allows filtering on "key"
+type Policy struct {
+	Fields map[string]Rule
+}
+
+var (
+	policyMu sync.RWMutex
+	policies = map[string]Policy{}
+)
+
+// RegisterPolicy declares the policy for bucket, replacing any previous one
+// note: services register their buckets when they are constructed
+func RegisterPolicy(bucket string, p Policy) {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	logs.Init("registering policy for %s: %d fields", bucket, len(p.Fields))
+	policies[bucket] = p
+}
+
+// PolicyFor returns the policy registered for bucket,
+// a tenant qualified bucket has the policy of its plain name
+func PolicyFor(bucket string) Policy {
+	_, bucket = SplitTenant(bucket)
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	return policies[bucket]
+}
+
+type rolesKey struct{}
+
+// WithRoles attaches the caller roles checked by Rule.Roles to ctx
+func WithRoles(ctx context.Context, roles ...string) context.Context {
+	return context.WithValue(ctx, rolesKey{}, roles)
+}
+
+// RolesFrom returns the caller roles attached with WithRoles
+func RolesFrom(ctx context.Context) []string {
+	roles, _ := ctx.Value(rolesKey{}).([]string)
+	return roles
+}
+
+// Clean checks filter against the policy and returns it with its value
+// fields prefixed so it conforms to the {key, value} schema
+// a nil filter is an empty one, anything rejected returns ErrInvalid
+func (p Policy) Clean(ctx context.Context, filter any) (bson.M, error) {
+	if filter == nil {
+		return bson.M{}, nil
+	}
+	fm, ok := asMap(filter)
+	if !ok {
+		return nil, fmt.Errorf("%w: filter must be a document, got %T", ErrInvalid, filter)
+	}
+	roles := RolesFrom(ctx)
+
+	out := bson.M{}
+	for field, val := range fm {
+		switch field {
+		case "$and", "$or":
+			subs := subFilters(val)
+			cleaned := make([]any, 0, len(subs))
+			for _, sub := range subs {
+				c, err := p.Clean(ctx, sub)
+				if err != nil {
+					return nil, err
+				}
+				cleaned = append(cleaned, c)
+			}
+			out[field] = cleaned
+			continue
+		case "key":
+			// special case for "key" to avoid prefixing
+			if err := checkOps(field, val, Rule{Ops: []string{"$in"}}); err != nil {
+				return nil, err
+			}
+			out[field] = val
+			continue
+		}
+
+		rule, err := p.rule(field, roles)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkOps(field, val, rule); err != nil {
+			return nil, err
+		}
+		logs.Debug("allowing %q → %q", field, Prefix(field))
+		out[Prefix(field)] = val
+	}
+	return out, nil
+}
+
+// Sortable reports an error when field may not be sorted on by the caller
+// "key" is always sortable
+func (p Policy) Sortable(ctx context.Context, field string) error {
+	if field == "" || field == "key" {
+		return nil
+	}
+	_, err := p.rule(field, RolesFrom(ctx))
+	return err
+}
+
+// rule returns the Rule for field if the caller roles satisfy it
+func (p Policy) rule(field string, roles []string) (Rule, error) {
+	rule, ok := p.Fields[field]
+	if !ok || strings.HasPrefix(field, "$") {
+		return rule, fmt.Errorf("%w: field %q is not queryable", ErrInvalid, field)
+	}
+	if rule.Roles == nil || slices.Contains(roles, RoleSystem) {
+		return rule, nil
+	}
+	for _, role := range roles {
+		if slices.Contains(rule.Roles, role) {
+			return rule, nil
+		}
+	}
+	return rule, fmt.Errorf("%w: field %q requires one of %v", ErrInvalid, field, rule.Roles)
+}
+
+// checkOps rejects operators in val that the rule does not allow
+func checkOps(field string, val any, rule Rule) error {
+	ops, ok := operators(val)
+	if !ok {
+		return nil
+	}
+	for op := range ops {
+		if op != "$eq" && !slices.Contains(rule.Ops, op) {
+			return fmt.Errorf("%w: operator %s is not allowed on %q", ErrInvalid, op, field)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// @NOTE a projection names the value fields a read returns, the others
+// are left in storage
+//
+//	b.Lookup(ctx, bson.M{"username": "dan"}, "username", "bio")
+//	b.ListPage(ctx, storage.ListOptions{Fields: []string{"username", "bio"}})
+//
+// no fields returns the whole value, a missing field is simply absent
+// from the result, "key" and "rev" of the documents are always returned
+//
+//	mongo          -> pushed down as a find projection
+//	memory, sqlite -> applied to the decoded documents
+//
+// note: a projection is not a permission, it is checked for shape only
+// and not against the bucket Policy
+// //
+
+// ValidProjection returns ErrInvalid for an empty field, an operator or
+// two fields where one contains the other ("contact" and "contact.phone")
+func ValidProjection(fields []string) error {
+	for i, field := range fields {
+		if field == "" || strings.HasPrefix(field, "$") || strings.Contains(field, "..") {
+			return fmt.Errorf("%w: cannot project field %q", ErrInvalid, field)
+		}
+		for _, other := range fields[:i] {
+			if field == other || strings.HasPrefix(field, other+".") || strings.HasPrefix(other, field+".") {
+				return fmt.Errorf("%w: projection fields %q and %q overlap", ErrInvalid, other, field)
+			}
+		}
+	}
+	return nil
+}
+
+// Pick returns a copy of value holding only fields, value as is when
+// fields is empty or value is not a document
+// note: a missing value picks an empty document, as a backend projecting
+// every field away would return
+func Pick(value any, fields []string) any {
+	doc, ok := asMap(value)
+	if len(fields) == 0 || (!ok && value != nil) {
+		return value
+	}
+	out := make(map[string]any, len(fields))
+	for _, field := range fields {
+		if val, ok := Resolve(doc, field); ok {
+			Assign(out, field, val)
+		}
+	}
+	return out
+}
+
+// PickItems applies Pick to the value of every {key, value} document in place
+func PickItems(items []map[string]any, fields []string) {
+	if len(fields) == 0 {
+		return
+	}
+	for _, item := range items {
+		item["value"] = Pick(item["value"], fields)
+	}
+}
+
+// Projection returns the find projection of fields over {key, value}
+// documents, extra paths (e.g. a sort path) are kept as well
+// nil when fields is empty, which projects nothing away
+func Projection(fields []string, extra ...string) bson.M {
+	if len(fields) == 0 {
+		return nil
+	}
+	out := bson.M{"key": 1, "rev": 1, Deleted: 1, Expires: 1}
+	for _, field := range fields {
+		out[Prefix(field)] = 1
+	}
+	for _, path := range extra {
+		if path == "key" || slices.ContainsFunc(fields, func(field string) bool {
+			prefixed := Prefix(field)
+			return path == prefixed || strings.HasPrefix(path, prefixed+".") || strings.HasPrefix(prefixed, path+".")
+		}) {
+			continue
+		}
+		out[path] = 1
+	}
+	return out
+}
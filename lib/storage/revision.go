@@ -0,0 +1,17 @@
+package storage
+
+// @NOTE documents are stored as {key, value, rev}, rev starts at 1 and
+// every Store / Update / Patch bumps it by one, documents written before
+// revisions existed have no rev and count as 0
+// //
+
+// Revision returns the revision of a decoded {key, value, rev} document
+func Revision(doc map[string]any) int64 {
+	switch rev := doc["rev"].(type) {
+	case int64:
+		return rev
+	case int32:
+		return int64(rev)
+	}
+	return 0
+}
@@ -0,0 +1,545 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	logs "github.com/danmuck/dps_lib/logs"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sealedBucket encrypts the registered fields of a bucket, see crypto.go
+// note: values that are not documents are stored as is
+type sealedBucket struct {
+	Bucket
+	fields []string
+	kr     *Keyring
+}
+
+// Seal wraps b so that fields are encrypted at rest with kr
+func Seal(b Bucket, kr *Keyring, fields ...string) Bucket {
+	return &sealedBucket{Bucket: b, fields: fields, kr: kr}
+}
+
+func (sb *sealedBucket) Store(ctx context.Context, key string, value any) error {
+	sealed, err := sb.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return sb.Bucket.Store(ctx, key, sealed)
+}
+
+func (sb *sealedBucket) StoreWithTTL(ctx context.Context, key string, value any, ttl time.Duration) error {
+	sealed, err := sb.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return sb.Bucket.StoreWithTTL(ctx, key, sealed, ttl)
+}
+
+func (sb *sealedBucket) Retrieve(ctx context.Context, key string) (any, error) {
+	value, _, err := sb.RetrieveRevision(ctx, key)
+	return value, err
+}
+
+func (sb *sealedBucket) RetrieveRevision(ctx context.Context, key string) (any, int64, error) {
+	value, rev, err := sb.Bucket.RetrieveRevision(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	value, err = sb.open(key, value)
+	return value, rev, err
+}
+
+func (sb *sealedBucket) Update(ctx context.Context, key string, value any) error {
+	sealed, err := sb.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return sb.Bucket.Update(ctx, key, sealed)
+}
+
+func (sb *sealedBucket) Patch(ctx context.Context, key string, updates map[string]any) error {
+	sealed, err := sb.sealUpdates(key, updates)
+	if err != nil {
+		return err
+	}
+	return sb.Bucket.Patch(ctx, key, sealed)
+}
+
+func (sb *sealedBucket) CompareAndSwap(ctx context.Context, key string, rev int64, value any) (int64, error) {
+	sealed, err := sb.seal(key, value)
+	if err != nil {
+		return 0, err
+	}
+	return sb.Bucket.CompareAndSwap(ctx, key, rev, sealed)
+}
+
+func (sb *sealedBucket) PatchIfRevision(ctx context.Context, key string, rev int64, updates map[string]any) (int64, error) {
+	sealed, err := sb.sealUpdates(key, updates)
+	if err != nil {
+		return 0, err
+	}
+	return sb.Bucket.PatchIfRevision(ctx, key, rev, sealed)
+}
+
+func (sb *sealedBucket) BatchStore(ctx context.Context, items []Item) ([]Result, error) {
+	sealed := make([]Item, len(items))
+	for i, item := range items {
+		value, err := sb.seal(item.Key, item.Value)
+		if err != nil {
+			return nil, err
+		}
+		sealed[i] = Item{Key: item.Key, Value: value}
+	}
+	return sb.Bucket.BatchStore(ctx, sealed)
+}
+
+func (sb *sealedBucket) BatchPatch(ctx context.Context, changes []Change) ([]Result, error) {
+	sealed := make([]Change, len(changes))
+	for i, change := range changes {
+		updates, err := sb.sealUpdates(change.Key, change.Updates)
+		if err != nil {
+			return nil, err
+		}
+		sealed[i] = Change{Key: change.Key, Updates: updates}
+	}
+	return sb.Bucket.BatchPatch(ctx, sealed)
+}
+
+func (sb *sealedBucket) Lookup(ctx context.Context, filter any, fields ...string) (map[string]any, error) {
+	doc, err := sb.LookupItem(ctx, filter, fields...)
+	if err != nil {
+		return nil, err
+	}
+	value, _ := asMap(doc["value"])
+	return value, nil
+}
+
+func (sb *sealedBucket) LookupItem(ctx context.Context, filter any, fields ...string) (map[string]any, error) {
+	blinded, err := sb.blindFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	fields, err = sb.project(fields)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := sb.Bucket.LookupItem(ctx, blinded, fields...)
+	if err != nil {
+		return nil, err
+	}
+	return doc, sb.openItems([]map[string]any{doc})
+}
+
+// ListKeys reads the items, the values are opened with their keys
+func (sb *sealedBucket) ListKeys(ctx context.Context) ([]any, error) {
+	items, err := sb.ListItems(ctx)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]any, 0, len(items))
+	for _, item := range items {
+		values = append(values, item["value"])
+	}
+	return values, nil
+}
+
+func (sb *sealedBucket) ListItems(ctx context.Context) ([]map[string]any, error) {
+	items, err := sb.Bucket.ListItems(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return items, sb.openItems(items)
+}
+
+func (sb *sealedBucket) ListPage(ctx context.Context, opts ListOptions) (Page, error) {
+	if err := sb.blindOptions(&opts); err != nil {
+		return Page{}, err
+	}
+	page, err := sb.Bucket.ListPage(ctx, opts)
+	if err != nil {
+		return Page{}, err
+	}
+	return page, sb.openItems(page.Items)
+}
+
+func (sb *sealedBucket) ListTrash(ctx context.Context, opts ListOptions) (Page, error) {
+	if err := sb.blindOptions(&opts); err != nil {
+		return Page{}, err
+	}
+	page, err := sb.Bucket.ListTrash(ctx, opts)
+	if err != nil {
+		return Page{}, err
+	}
+	return page, sb.openItems(page.Items)
+}
+
+// Aggregate can not group or sum on encrypted fields, equality filters
+// on them are blinded like for ListPage
+func (sb *sealedBucket) Aggregate(ctx context.Context, agg Aggregation) ([]Group, error) {
+	for _, field := range append([]string{agg.GroupBy}, agg.Sum...) {
+		if sb.encrypted(field) || field == Sealed || strings.HasPrefix(field, Sealed+".") {
+			return nil, fmt.Errorf("%w: cannot aggregate on encrypted field %q", ErrInvalid, field)
+		}
+	}
+	filter, err := sb.blindFilter(agg.Filter)
+	if err != nil {
+		return nil, err
+	}
+	agg.Filter = filter
+	return sb.Bucket.Aggregate(ctx, agg)
+}
+
+// Search can not look into encrypted fields, they only hold blind indexes
+func (sb *sealedBucket) Search(ctx context.Context, query string, in []string, limit int64, fields ...string) ([]map[string]any, error) {
+	for _, field := range in {
+		if sb.encrypted(field) || field == Sealed || strings.HasPrefix(field, Sealed+".") {
+			return nil, fmt.Errorf("%w: cannot search encrypted field %q", ErrInvalid, field)
+		}
+	}
+	fields, err := sb.project(fields)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := sb.Bucket.Search(ctx, query, in, limit, fields...)
+	if err != nil {
+		return nil, err
+	}
+	return docs, sb.openItems(docs)
+}
+
+// Watch opens the values of the events, an event that fails to open is
+// passed on without its value
+func (sb *sealedBucket) Watch(ctx context.Context) (<-chan Event, error) {
+	events, err := sb.Bucket.Watch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		for ev := range events {
+			if ev.Value != nil {
+				value, err := sb.open(ev.Key, ev.Value)
+				if err != nil {
+					logs.Err("Watch [%s] open %q: %v", sb.Name(), ev.Key, err)
+				}
+				ev.Value = value
+			}
+			select {
+			case out <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// Reseal seals every document again with the current key, documents
+// written before the bucket was encrypted are sealed for the first time
+// it returns how many documents were rewritten
+// note: trashed documents are not resealed, keep the old keys around
+// until they are restored or purged
+func (sb *sealedBucket) Reseal(ctx context.Context) (int, error) {
+	items, err := sb.Bucket.ListItems(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, item := range items {
+		key, _ := item["key"].(string)
+		value, ok := asMap(item["value"])
+		if !ok || !sb.stale(value) {
+			continue
+		}
+		opened, err := sb.open(key, value)
+		if err != nil {
+			return n, fmt.Errorf("reseal %q: %w", key, err)
+		}
+		sealed, err := sb.seal(key, opened)
+		if err != nil {
+			return n, fmt.Errorf("reseal %q: %w", key, err)
+		}
+		_, err = sb.Bucket.CompareAndSwap(ctx, key, Revision(item), sealed)
+		if err != nil {
+			return n, fmt.Errorf("reseal %q: %w", key, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Reseal seals b again with the current key if it is encrypted,
+// see sealedBucket.Reseal
+func Reseal(ctx context.Context, b Bucket) (int, error) {
+	switch b := b.(type) {
+	case *sealedBucket:
+		return b.Reseal(ctx)
+	case denied:
+		return 0, b.err
+	}
+	return 0, nil
+}
+
+// project adds the ciphertext of the projected encrypted fields, either
+// projected directly ("email") or through a parent ("contact")
+func (sb *sealedBucket) project(fields []string) ([]string, error) {
+	out := slices.Clone(fields)
+	for _, field := range fields {
+		if field == Sealed || strings.HasPrefix(field, Sealed+".") {
+			return nil, fmt.Errorf("%w: %q is reserved", ErrInvalid, field)
+		}
+		for _, enc := range sb.fields {
+			switch {
+			case enc == field || strings.HasPrefix(enc, field+"."):
+				out = append(out, Sealed+"."+enc)
+			case strings.HasPrefix(field, enc+"."):
+				return nil, fmt.Errorf("%w: %q is encrypted as a whole", ErrInvalid, enc)
+			}
+		}
+	}
+	return out, nil
+}
+
+// stale reports whether an encrypted field of value is in plaintext
+// or sealed with another key than the current one
+func (sb *sealedBucket) stale(value map[string]any) bool {
+	for _, field := range sb.fields {
+		if _, ok := Resolve(value, field); !ok {
+			continue
+		}
+		sealed, ok := Resolve(value, Sealed+"."+field)
+		if !ok {
+			return true
+		}
+		if s, _ := sealed.(string); SealedWith(s) != sb.kr.Current() {
+			return true
+		}
+	}
+	return false
+}
+
+// seal replaces the encrypted fields of the document value at key by
+// their blind index and stores their ciphertext under Sealed
+func (sb *sealedBucket) seal(key string, value any) (any, error) {
+	doc, ok := asMap(Normalize(value))
+	if !ok {
+		return value, nil
+	}
+	delete(doc, Sealed)
+	for _, field := range sb.fields {
+		plain, ok := Resolve(doc, field)
+		if !ok || plain == nil {
+			continue
+		}
+		sealed, err := sb.kr.Seal(plain, sb.aad(key, field))
+		if err != nil {
+			return nil, err
+		}
+		Assign(doc, field, sb.blind(field, plain))
+		Assign(doc, Sealed+"."+field, sealed)
+	}
+	return doc, nil
+}
+
+// sealUpdates seals the encrypted fields set by a Patch, either directly
+// ("email") or through a parent document ("contact" for "contact.phone")
+func (sb *sealedBucket) sealUpdates(key string, updates map[string]any) (map[string]any, error) {
+	out := make(map[string]any, len(updates))
+	for field, val := range updates {
+		if field == Sealed || strings.HasPrefix(field, Sealed+".") {
+			return nil, fmt.Errorf("%w: %q is reserved", ErrInvalid, field)
+		}
+		out[field] = val
+	}
+	for _, enc := range sb.fields {
+		for field, val := range updates {
+			switch {
+			case field == enc:
+				if val == nil {
+					out[Sealed+"."+enc] = nil
+					continue
+				}
+				sealed, err := sb.kr.Seal(val, sb.aad(key, enc))
+				if err != nil {
+					return nil, err
+				}
+				out[field] = sb.blind(enc, val)
+				out[Sealed+"."+enc] = sealed
+			case strings.HasPrefix(enc, field+"."):
+				parent, ok := asMap(Normalize(out[field]))
+				if !ok {
+					continue
+				}
+				rest := strings.TrimPrefix(enc, field+".")
+				plain, ok := Resolve(parent, rest)
+				if !ok || plain == nil {
+					// the parent is replaced without the field
+					out[Sealed+"."+enc] = nil
+					continue
+				}
+				sealed, err := sb.kr.Seal(plain, sb.aad(key, enc))
+				if err != nil {
+					return nil, err
+				}
+				Assign(parent, rest, sb.blind(enc, plain))
+				out[field] = parent
+				out[Sealed+"."+enc] = sealed
+			case strings.HasPrefix(field, enc+"."):
+				return nil, fmt.Errorf("%w: %q is encrypted as a whole", ErrInvalid, enc)
+			}
+		}
+	}
+	return out, nil
+}
+
+// open decrypts the encrypted fields of the document value at key, fields
+// without a ciphertext (written before the bucket was encrypted) are left
+// as is
+func (sb *sealedBucket) open(key string, value any) (any, error) {
+	doc, ok := asMap(value)
+	if !ok {
+		return value, nil
+	}
+	for _, field := range sb.fields {
+		raw, ok := Resolve(doc, Sealed+"."+field)
+		if !ok || raw == nil {
+			continue
+		}
+		sealed, _ := raw.(string)
+		plain, err := sb.kr.Open(sealed, sb.aad(key, field))
+		if err != nil {
+			return nil, fmt.Errorf("open %q: %w", field, err)
+		}
+		Assign(doc, field, plain)
+	}
+	delete(doc, Sealed)
+	return doc, nil
+}
+
+// openItems opens the value of every {key, value} document in place
+func (sb *sealedBucket) openItems(items []map[string]any) error {
+	for _, item := range items {
+		key, _ := item["key"].(string)
+		value, err := sb.open(key, item["value"])
+		if err != nil {
+			return fmt.Errorf("key %v: %w", item["key"], err)
+		}
+		item["value"] = value
+	}
+	return nil
+}
+
+// blindOptions rewrites the filter and projection of a listing,
+// encrypted fields can not be sorted on
+func (sb *sealedBucket) blindOptions(opts *ListOptions) error {
+	field := strings.TrimPrefix(opts.Sort, "-")
+	if sb.encrypted(field) || field == Sealed || strings.HasPrefix(field, Sealed+".") {
+		return fmt.Errorf("%w: cannot sort on encrypted field %q", ErrInvalid, field)
+	}
+	filter, err := sb.blindFilter(opts.Filter)
+	if err != nil {
+		return err
+	}
+	opts.Filter = filter
+	opts.Fields, err = sb.project(opts.Fields)
+	return err
+}
+
+// blindFilter replaces the values compared against encrypted fields
+// by their blind index, only equality operators can be answered that way
+func (sb *sealedBucket) blindFilter(filter any) (any, error) {
+	if filter == nil {
+		return nil, nil
+	}
+	fm, ok := asMap(filter)
+	if !ok {
+		return filter, nil
+	}
+	out := make(map[string]any, len(fm))
+	for field, val := range fm {
+		switch {
+		case field == "$and" || field == "$or":
+			subs := subFilters(val)
+			blinded := make([]any, 0, len(subs))
+			for _, sub := range subs {
+				b, err := sb.blindFilter(sub)
+				if err != nil {
+					return nil, err
+				}
+				blinded = append(blinded, b)
+			}
+			out[field] = blinded
+		case field == Sealed || strings.HasPrefix(field, Sealed+"."):
+			return nil, fmt.Errorf("%w: field %q is not queryable", ErrInvalid, field)
+		case sb.encrypted(field):
+			b, err := sb.blindValue(field, val)
+			if err != nil {
+				return nil, err
+			}
+			out[field] = b
+		default:
+			out[field] = val
+		}
+	}
+	return out, nil
+}
+
+// blindValue blinds a plain value or the operands of $eq $ne $in $nin
+func (sb *sealedBucket) blindValue(field string, val any) (any, error) {
+	ops, ok := operators(val)
+	if !ok {
+		return sb.blind(field, val), nil
+	}
+	out := make(map[string]any, len(ops))
+	for op, arg := range ops {
+		switch op {
+		case "$eq", "$ne":
+			out[op] = sb.blind(field, arg)
+		case "$in", "$nin":
+			var list []any
+			switch l := Normalize(arg).(type) {
+			case primitive.A:
+				list = l
+			case []any:
+				list = l
+			default:
+				return nil, fmt.Errorf("%w: %s on %q expects a list", ErrInvalid, op, field)
+			}
+			blinded := make([]any, 0, len(list))
+			for _, elem := range list {
+				blinded = append(blinded, sb.blind(field, elem))
+			}
+			out[op] = blinded
+		default:
+			return nil, fmt.Errorf("%w: operator %s is not supported on encrypted field %q", ErrInvalid, op, field)
+		}
+	}
+	return out, nil
+}
+
+// aad returns the additional data binding the ciphertext of field to
+// the document key of this bucket
+func (sb *sealedBucket) aad(key, field string) string {
+	return fieldAAD(sb.Name(), key, field)
+}
+
+// blind returns the blind index of val in field of this bucket
+func (sb *sealedBucket) blind(field string, val any) string {
+	return sb.kr.Blind(blindScope(sb.Name(), field), val)
+}
+
+// encrypted reports whether field is one of the encrypted fields
+func (sb *sealedBucket) encrypted(field string) bool {
+	for _, enc := range sb.fields {
+		if field == enc {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// @NOTE Search finds the live documents whose text fields contain any of
+// the words of a query, best matches first
+//
+//	client.ConnectOrCreateBucket(ctx, "usersv1",
+//		storage.Index{Fields: []string{"username", "bio"}, Text: true},
+//	)
+//	docs, err := b.Search(ctx, "gopher ranch", nil, 20) // nil -> every text field
+//	docs, err := b.Search(ctx, "gopher", []string{"bio"}, 20, "username", "bio")
+//
+// the fields must be declared by the text index of the bucket (one per
+// bucket) and allowed by its Policy, words are lowercased letters and digits,
+// the fields after the limit project the values like for Lookup
+//
+//	mongo          -> the text index, with its stemming and stop words, a
+//	                  search of some of its fields matches their words exactly
+//	memory, sqlite -> a TextIndex kept in process, exact words only
+//
+// note: the in process index only sees writes made through this process
+// //
+
+// SearchQuery is the backend facing form of a Search
+type SearchQuery struct {
+	Terms  []string // distinct words of the query
+	Paths  []string // prefixed paths of the searched fields
+	Limit  int64    // clamped like ListOptions.Limit
+	All    bool     // whether Paths covers every field of the text index
+	Fields []string // projected value fields, nil for the whole value
+}
+
+// NewSearch validates a search in the fields in against the text index
+// fields of a bucket (nil when it has none) and its policy, and the
+// projection fields
+func NewSearch(ctx context.Context, p Policy, text []string, query string, in []string, limit int64, fields ...string) (SearchQuery, error) {
+	q := SearchQuery{Terms: Tokenize(query), Limit: limit, Fields: fields}
+	if err := ValidProjection(fields); err != nil {
+		return q, err
+	}
+	if len(text) == 0 {
+		return q, fmt.Errorf("%w: bucket has no text index", ErrInvalid)
+	}
+	if len(q.Terms) == 0 {
+		return q, fmt.Errorf("%w: empty search", ErrInvalid)
+	}
+	if q.Limit < 0 {
+		return q, fmt.Errorf("%w: negative limit %d", ErrInvalid, q.Limit)
+	}
+	if q.Limit == 0 {
+		q.Limit = DefaultPageSize
+	}
+	q.Limit = min(q.Limit, MaxPageSize)
+	if len(in) == 0 {
+		in = text
+	}
+	for _, field := range in {
+		if !slices.Contains(text, field) {
+			return q, fmt.Errorf("%w: %q is not text indexed", ErrInvalid, field)
+		}
+		if err := p.Sortable(ctx, field); err != nil {
+			return q, err
+		}
+		if !slices.Contains(q.Paths, Prefix(field)) {
+			q.Paths = append(q.Paths, Prefix(field))
+		}
+	}
+	q.All = len(q.Paths) == len(text)
+	return q, nil
+}
+
+// Tokenize returns the distinct lowercased words of s in order
+func Tokenize(s string) []string {
+	var out []string
+	for _, word := range words(s) {
+		if !slices.Contains(out, word) {
+			out = append(out, word)
+		}
+	}
+	return out
+}
+
+// words returns every word of a text field, arrays of strings included
+func words(val any) []string {
+	var out []string
+	switch v := val.(type) {
+	case string:
+		out = strings.FieldsFunc(strings.ToLower(v), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+	case bson.A:
+		for _, elem := range v {
+			out = append(out, words(elem)...)
+		}
+	case []any:
+		for _, elem := range v {
+			out = append(out, words(elem)...)
+		}
+	case []string:
+		for _, elem := range v {
+			out = append(out, words(elem)...)
+		}
+	}
+	return out
+}
+
+// TextIndex is an inverted index over the text fields of a bucket, it
+// backs Search for the backends without text indexes (memory, sqlite)
+// the zero TextIndex is not usable, see NewTextIndex
+type TextIndex struct {
+	mu       sync.RWMutex
+	fields   []string
+	postings map[string]map[string]map[string]int // map[word]map[key]map[path]occurrences
+	words    map[string][]string                  // map[key]words, to remove a document
+}
+
+// NewTextIndex returns an empty index of the value fields
+func NewTextIndex(fields []string) *TextIndex {
+	return &TextIndex{
+		fields:   slices.Clone(fields),
+		postings: make(map[string]map[string]map[string]int),
+		words:    make(map[string][]string),
+	}
+}
+
+// Fields returns the indexed value fields
+func (ti *TextIndex) Fields() []string {
+	return ti.fields
+}
+
+// Put indexes the decoded {key, value} document stored at key, a nil
+// document removes it
+func (ti *TextIndex) Put(key string, doc map[string]any) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.remove(key)
+	if doc == nil {
+		return
+	}
+	var indexed []string
+	for _, field := range ti.fields {
+		path := Prefix(field)
+		val, _ := Resolve(doc, path)
+		for _, word := range words(val) {
+			docs, ok := ti.postings[word]
+			if !ok {
+				docs = make(map[string]map[string]int)
+				ti.postings[word] = docs
+			}
+			if docs[key] == nil {
+				docs[key] = make(map[string]int)
+				indexed = append(indexed, word)
+			}
+			docs[key][path]++
+		}
+	}
+	if len(indexed) > 0 {
+		ti.words[key] = indexed
+	}
+}
+
+// remove drops every posting of key
+// note: callers must hold the lock
+func (ti *TextIndex) remove(key string) {
+	for _, word := range ti.words[key] {
+		delete(ti.postings[word], key)
+		if len(ti.postings[word]) == 0 {
+			delete(ti.postings, word)
+		}
+	}
+	delete(ti.words, key)
+}
+
+// Search returns the keys matching q, best first then by key, the caller
+// skips the ones that are no longer live and stops at q.Limit
+func (ti *TextIndex) Search(q SearchQuery) []string {
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+	scores := make(map[string]int)
+	for _, term := range q.Terms {
+		for key, paths := range ti.postings[term] {
+			for _, path := range q.Paths {
+				scores[key] += paths[path]
+			}
+		}
+	}
+	keys := make([]string, 0, len(scores))
+	for key, score := range scores {
+		if score > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if scores[keys[i]] != scores[keys[j]] {
+			return scores[keys[i]] > scores[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
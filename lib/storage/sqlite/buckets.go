@@ -0,0 +1,750 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	logs "github.com/danmuck/dps_lib/logs"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// conditions selecting the live and the trashed rows of a bucket,
+// expired rows are neither
+const (
+	liveRows    = "bson_get(doc, 'deleted') IS NULL AND NOT bson_expired(doc)"
+	trashedRows = "bson_get(doc, 'deleted') IS NOT NULL AND NOT bson_expired(doc)"
+)
+
+// sqliteBucket is a table of {key, doc} rows
+// rows are returned in rowid order, which mirrors natural order in MongoDB
+type sqliteBucket struct {
+	id    string
+	table string // quoted table identifier
+	db    *sql.DB
+	feed  storage.Feed                      // watchers in this process, see Watch
+	swept atomic.Int64                      // unix nano of the last sweep of expired rows, see sweep
+	text  atomic.Pointer[storage.TextIndex] // text index kept in process, see Search
+}
+
+// newSQLiteBucket creates the backing table for id if it does not exist yet
+func newSQLiteBucket(ctx context.Context, db *sql.DB, id string) (*sqliteBucket, error) {
+	logs.Init("NewSQLiteBucket %q", id)
+	b := &sqliteBucket{
+		id:    id,
+		table: `"` + strings.ReplaceAll(id, `"`, `""`) + `"`,
+		db:    db,
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (key TEXT NOT NULL PRIMARY KEY, doc BLOB NOT NULL)",
+		b.table,
+	))
+	return b, err
+}
+
+// ensureIndexes creates an expression index over bson_get for every
+// declared index, IF NOT EXISTS makes it idempotent
+// text indexes are kept in process instead, see ensureText
+func (b *sqliteBucket) ensureIndexes(ctx context.Context, indexes []storage.Index) error {
+	for _, idx := range indexes {
+		if idx.Text {
+			if err := b.ensureText(ctx, idx); err != nil {
+				return err
+			}
+			continue
+		}
+		exprs := make([]string, 0, len(idx.Fields))
+		for _, path := range idx.Paths() {
+			exprs = append(exprs, fmt.Sprintf("bson_get(doc, '%s')", strings.ReplaceAll(path, "'", "''")))
+		}
+		unique := ""
+		if idx.Unique {
+			unique = "UNIQUE "
+		}
+		name := `"` + strings.ReplaceAll(b.id+"_"+idx.Name(), `"`, `""`) + `"`
+		_, err := b.db.ExecContext(ctx, fmt.Sprintf(
+			"CREATE %sINDEX IF NOT EXISTS %s ON %s (%s)",
+			unique, name, b.table, strings.Join(exprs, ", "),
+		))
+		if err != nil {
+			return wrapErr(err)
+		}
+	}
+	return nil
+}
+
+// ensureText builds the text index from the stored rows, a bucket has at
+// most one
+// note: sqlite has no text index of its own (without FTS tables), the
+// index only sees writes made through this process after it is built
+func (b *sqliteBucket) ensureText(ctx context.Context, idx storage.Index) error {
+	if ti := b.text.Load(); ti != nil {
+		if slices.Equal(ti.Fields(), idx.Fields) {
+			return nil
+		}
+		return fmt.Errorf("%w: bucket=%q already has a text index on %v",
+			storage.ErrInvalid, b.id, ti.Fields())
+	}
+	ti := storage.NewTextIndex(idx.Fields)
+	err := b.scan(ctx, b.db, "1", func(doc map[string]any) bool {
+		key, _ := doc["key"].(string)
+		ti.Put(key, doc)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	b.text.Store(ti)
+	return nil
+}
+
+// Name returns the bucket id
+func (b *sqliteBucket) Name() string {
+	return b.id
+}
+
+// String returns a string representation of the bucket
+func (b *sqliteBucket) String() string {
+	return fmt.Sprintf("SQLiteBucket(id=%q)", b.id)
+}
+
+// Store upserts the given key-value pair in the bucket
+// a value colliding with a unique index returns storage.ErrConflict
+func (b *sqliteBucket) Store(ctx context.Context, key string, value any) error {
+	_, err := b.swap(ctx, key, upsert(key, value, 0))
+	return err
+}
+
+// StoreWithTTL upserts the key-value pair like Store, it expires after ttl
+func (b *sqliteBucket) StoreWithTTL(ctx context.Context, key string, value any, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%w: ttl must be positive, got %v", storage.ErrInvalid, ttl)
+	}
+	_, err := b.swap(ctx, key, upsert(key, value, ttl))
+	return err
+}
+
+// Retrieve retrieves the value associated with the given key from the bucket
+func (b *sqliteBucket) Retrieve(ctx context.Context, key string) (any, error) {
+	value, _, err := b.RetrieveRevision(ctx, key)
+	return value, err
+}
+
+// RetrieveRevision retrieves the value for key along with its revision
+func (b *sqliteBucket) RetrieveRevision(ctx context.Context, key string) (any, int64, error) {
+	doc, err := b.live(ctx, b.db, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return doc["value"], storage.Revision(doc), nil
+}
+
+// Delete moves the document at key to the trash
+func (b *sqliteBucket) Delete(ctx context.Context, key string) error {
+	logs.Debug("Delete [%s] key=%q", b.Name(), key)
+	_, err := b.swap(ctx, key, b.trash(ctx, key))
+	return err
+}
+
+// Update simply replaces the value for a key
+// and fails if the key does not exist
+func (b *sqliteBucket) Update(ctx context.Context, key string, value any) error {
+	_, err := b.CompareAndSwap(ctx, key, anyRevision, value)
+	return err
+}
+
+// Patch the value for a key
+// fields are prefixed with "value." the same way mongoBucket does it
+func (b *sqliteBucket) Patch(ctx context.Context, key string, updates map[string]any) error {
+	_, err := b.PatchIfRevision(ctx, key, anyRevision, updates)
+	return err
+}
+
+// CompareAndSwap replaces the value for key if it is still at rev
+// and returns the new revision, a moved on document returns storage.ErrStale
+func (b *sqliteBucket) CompareAndSwap(ctx context.Context, key string, rev int64, value any) (int64, error) {
+	return b.swap(ctx, key, b.replace(key, rev, value))
+}
+
+// PatchIfRevision patches the value for key like Patch if it is still at rev
+// and returns the new revision, a moved on document returns storage.ErrStale
+func (b *sqliteBucket) PatchIfRevision(ctx context.Context, key string, rev int64, updates map[string]any) (int64, error) {
+	logs.Init("PatchIfRevision [%q] { %q@%d : %v }", b.Name(), key, rev, updates)
+	return b.swap(ctx, key, b.patch(key, rev, updates))
+}
+
+// BatchStore stores every item in a single transaction
+func (b *sqliteBucket) BatchStore(ctx context.Context, items []storage.Item) ([]storage.Result, error) {
+	logs.Init("BatchStore [%q] %d items", b.Name(), len(items))
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	return b.batch(ctx, keys, func(tx *sql.Tx, i int) (storage.Event, error) {
+		return b.swapTx(ctx, tx, items[i].Key, upsert(items[i].Key, items[i].Value, 0))
+	})
+}
+
+// BatchDelete trashes every key in a single transaction
+func (b *sqliteBucket) BatchDelete(ctx context.Context, keys []string) ([]storage.Result, error) {
+	logs.Init("BatchDelete [%q] %d keys", b.Name(), len(keys))
+	return b.batch(ctx, keys, func(tx *sql.Tx, i int) (storage.Event, error) {
+		return b.swapTx(ctx, tx, keys[i], b.trash(ctx, keys[i]))
+	})
+}
+
+// BatchPatch applies every change in a single transaction
+func (b *sqliteBucket) BatchPatch(ctx context.Context, changes []storage.Change) ([]storage.Result, error) {
+	logs.Init("BatchPatch [%q] %d changes", b.Name(), len(changes))
+	keys := make([]string, len(changes))
+	for i, change := range changes {
+		keys[i] = change.Key
+	}
+	return b.batch(ctx, keys, func(tx *sql.Tx, i int) (storage.Event, error) {
+		return b.swapTx(ctx, tx, keys[i], b.patch(keys[i], anyRevision, changes[i].Updates))
+	})
+}
+
+// Lookup retrieves the value of the first document matching the provided
+// filter. The filter is cleaned and prefixed exactly like mongoBucket.Lookup
+func (b *sqliteBucket) Lookup(ctx context.Context, filter any, fields ...string) (map[string]any, error) {
+	doc, err := b.LookupItem(ctx, filter, fields...)
+	if err != nil {
+		return nil, err
+	}
+	return doc["value"].(map[string]any), nil
+}
+
+// LookupItem retrieves the {key, value, rev} document Lookup reads
+// note: filters on "key" alone are answered by the primary key,
+// anything else scans the table
+func (b *sqliteBucket) LookupItem(ctx context.Context, filter any, fields ...string) (map[string]any, error) {
+	sqlFilter, err := storage.PolicyFor(b.id).Clean(ctx, filter)
+	if err != nil {
+		logs.Err("Lookup rejected filter %v: %v", filter, err)
+		return nil, err
+	}
+	if err := storage.ValidProjection(fields); err != nil {
+		return nil, err
+	}
+	logs.Init("Lookup filter : %v", sqlFilter)
+
+	if len(sqlFilter) == 0 {
+		logs.Err("empty filter provided, nothing to search on")
+		return nil, fmt.Errorf("%w: empty filter", storage.ErrInvalid)
+	}
+
+	var found map[string]any
+	if key, ok := sqlFilter["key"].(string); ok && len(sqlFilter) == 1 {
+		doc, err := b.live(ctx, b.db, key)
+		if err != nil {
+			logs.Debug("soft warning: no document found for filter %v", sqlFilter)
+			return nil, err
+		}
+		found = doc
+	} else {
+		err := b.scan(ctx, b.db, liveRows, func(doc map[string]any) bool {
+			if storage.Match(doc, sqlFilter) {
+				found = doc
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			logs.Err("Lookup error: %v", err)
+			return nil, err
+		}
+		if found == nil {
+			logs.Debug("soft warning: no document found for filter %v", sqlFilter)
+			return nil, fmt.Errorf("%w: filter %v", storage.ErrNotFound, sqlFilter)
+		}
+	}
+
+	value, ok := found["value"].(map[string]any)
+	if !ok {
+		logs.Err("unexpected document shape %T", found["value"])
+		return nil, fmt.Errorf("unexpected document shape %T", found["value"])
+	}
+	found["value"] = storage.Pick(value, fields)
+	return found, nil
+}
+
+// ListKeys retrieves all values from the bucket
+func (b *sqliteBucket) ListKeys(ctx context.Context) ([]any, error) {
+	logs.Init("List [%s]", b.Name())
+	var results []any
+	err := b.scan(ctx, b.db, liveRows, func(doc map[string]any) bool {
+		results = append(results, doc["value"])
+		return true
+	})
+	if err != nil {
+		logs.Err("error: %v", err)
+		return nil, err
+	}
+	return results, nil
+}
+
+// ListItems retrieves all {key, value} documents from the bucket
+func (b *sqliteBucket) ListItems(ctx context.Context) ([]map[string]any, error) {
+	logs.Init("ListItems [%s]", b.Name())
+	return b.items(ctx, liveRows)
+}
+
+// items decodes every row matching where
+func (b *sqliteBucket) items(ctx context.Context, where string) ([]map[string]any, error) {
+	var results []map[string]any
+	err := b.scan(ctx, b.db, where, func(doc map[string]any) bool {
+		results = append(results, doc)
+		return true
+	})
+	if err != nil {
+		logs.Err("error: %v", err)
+		return nil, err
+	}
+	return results, nil
+}
+
+// ListPage retrieves one page of {key, value} documents
+// the query is evaluated in process over every row
+func (b *sqliteBucket) ListPage(ctx context.Context, opts storage.ListOptions) (storage.Page, error) {
+	logs.Init("ListPage [%s] %+v", b.Name(), opts)
+	q, err := opts.Query(ctx, storage.PolicyFor(b.id))
+	if err != nil {
+		return storage.Page{}, err
+	}
+	items, err := b.ListItems(ctx)
+	if err != nil {
+		return storage.Page{}, err
+	}
+	return q.Paginate(items), nil
+}
+
+// Aggregate groups and counts the live documents in process
+func (b *sqliteBucket) Aggregate(ctx context.Context, agg storage.Aggregation) ([]storage.Group, error) {
+	logs.Init("Aggregate [%s] %+v", b.Name(), agg)
+	q, err := agg.Query(ctx, storage.PolicyFor(b.id))
+	if err != nil {
+		return nil, err
+	}
+	items, err := b.ListItems(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return q.Run(items), nil
+}
+
+// Get the number of keys in the bucket
+func (b *sqliteBucket) Count(ctx context.Context) (int64, error) {
+	logs.Init("Count [%s]", b.Name())
+	var count int64
+	err := b.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", b.table, liveRows)).Scan(&count)
+	logs.Log("[%s] count: %d", b.Name(), count)
+	return count, wrapErr(err)
+}
+
+// Search finds live rows through the in process text index
+func (b *sqliteBucket) Search(ctx context.Context, query string, in []string, limit int64, fields ...string) ([]map[string]any, error) {
+	logs.Init("Search [%s] %q in %v", b.Name(), query, in)
+	ti := b.text.Load()
+	var text []string
+	if ti != nil {
+		text = ti.Fields()
+	}
+	q, err := storage.NewSearch(ctx, storage.PolicyFor(b.id), text, query, in, limit, fields...)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]map[string]any, 0)
+	for _, key := range ti.Search(q) {
+		doc, err := b.live(ctx, b.db, key)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		doc["value"] = storage.Pick(doc["value"], q.Fields)
+		if results = append(results, doc); int64(len(results)) == q.Limit {
+			break
+		}
+	}
+	return results, nil
+}
+
+// ListTrash retrieves one page of trashed documents, like ListPage
+func (b *sqliteBucket) ListTrash(ctx context.Context, opts storage.ListOptions) (storage.Page, error) {
+	logs.Init("ListTrash [%s] %+v", b.Name(), opts)
+	q, err := opts.Query(ctx, storage.PolicyFor(b.id))
+	if err != nil {
+		return storage.Page{}, err
+	}
+	items, err := b.items(ctx, trashedRows)
+	if err != nil {
+		return storage.Page{}, err
+	}
+	return q.Paginate(items), nil
+}
+
+// Restore takes the document at key out of the trash
+func (b *sqliteBucket) Restore(ctx context.Context, key string) error {
+	logs.Init("Restore [%s] key=%q", b.Name(), key)
+	_, err := b.swap(ctx, key, b.restore(key))
+	return err
+}
+
+// Purge removes the documents trashed before cutoff for good
+func (b *sqliteBucket) Purge(ctx context.Context, before time.Time) (int64, error) {
+	logs.Init("Purge [%s] before %v", b.Name(), before)
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, wrapErr(err)
+	}
+	defer tx.Rollback()
+
+	var keys []string
+	err = b.scan(ctx, tx, trashedRows, func(doc map[string]any) bool {
+		if storage.DeletedBefore(doc, before) {
+			key, _ := doc["key"].(string)
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE key = ?", b.table), key); err != nil {
+			return 0, wrapErr(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, wrapErr(err)
+	}
+	purged := make([]storage.Event, len(keys))
+	for i, key := range keys {
+		purged[i] = storage.Event{Op: storage.OpDelete, Key: key}
+	}
+	b.reindex(ctx, purged...)
+	return int64(len(keys)), nil
+}
+
+// Watch streams every write made through this process after the call
+// note: sqlite has no change stream, writes from other processes sharing
+// the file are not seen
+func (b *sqliteBucket) Watch(ctx context.Context) (<-chan storage.Event, error) {
+	logs.Init("Watch [%s]", b.Name())
+	if err := ctx.Err(); err != nil {
+		return nil, wrapErr(err)
+	}
+	return b.feed.Subscribe(ctx), nil
+}
+
+// anyRevision skips the revision check in expect, Update and Patch are
+// unconditional
+const anyRevision int64 = -1
+
+// expect checks that doc (nil when key is absent) exists and is at rev
+// a trashed document does not exist
+func (b *sqliteBucket) expect(key string, doc map[string]any, rev int64) error {
+	if doc == nil || storage.IsDeleted(doc) {
+		logs.Err("no document matched for key %q in bucket %q", key, b.Name())
+		return notFound(key, b.Name())
+	}
+	if rev != anyRevision && storage.Revision(doc) != rev {
+		return stale(key, b.Name(), rev)
+	}
+	return nil
+}
+
+// upsert returns the swap function that stores value whether or not
+// key exists yet, expiring after ttl unless it is 0
+func upsert(key string, value any, ttl time.Duration) func(map[string]any) (map[string]any, error) {
+	return func(map[string]any) (map[string]any, error) {
+		doc := map[string]any{"key": key, "value": value}
+		if ttl > 0 {
+			doc[storage.Expires] = storage.Expiry(ttl)
+		}
+		return doc, nil
+	}
+}
+
+// replace returns the swap function that replaces the value of a
+// document at rev, keeping its expiry
+func (b *sqliteBucket) replace(key string, rev int64, value any) func(map[string]any) (map[string]any, error) {
+	return func(doc map[string]any) (map[string]any, error) {
+		if err := b.expect(key, doc, rev); err != nil {
+			return nil, err
+		}
+		next := map[string]any{"key": key, "value": value}
+		if expires, ok := doc[storage.Expires]; ok {
+			next[storage.Expires] = expires
+		}
+		return next, nil
+	}
+}
+
+// patch returns the swap function that applies updates to a document at rev
+func (b *sqliteBucket) patch(key string, rev int64, updates map[string]any) func(map[string]any) (map[string]any, error) {
+	return func(doc map[string]any) (map[string]any, error) {
+		if err := b.expect(key, doc, rev); err != nil {
+			return nil, err
+		}
+		for field, val := range updates {
+			storage.Assign(doc, storage.Prefix(field), val)
+		}
+		return doc, nil
+	}
+}
+
+// trash returns the swap function that tombstones a live document
+func (b *sqliteBucket) trash(ctx context.Context, key string) func(map[string]any) (map[string]any, error) {
+	return func(doc map[string]any) (map[string]any, error) {
+		if err := b.expect(key, doc, anyRevision); err != nil {
+			return nil, err
+		}
+		doc[storage.Deleted] = storage.Tombstone(ctx)
+		return doc, nil
+	}
+}
+
+// restore returns the swap function that clears the tombstone of a
+// trashed document
+func (b *sqliteBucket) restore(key string) func(map[string]any) (map[string]any, error) {
+	return func(doc map[string]any) (map[string]any, error) {
+		if doc == nil || !storage.IsDeleted(doc) {
+			return nil, fmt.Errorf("%w: no trashed document with key=%q in bucket=%q",
+				storage.ErrNotFound, key, b.Name())
+		}
+		delete(doc, storage.Deleted)
+		return doc, nil
+	}
+}
+
+// swap replaces the document at key with the one returned by fn inside a
+// transaction, see swapTx
+func (b *sqliteBucket) swap(ctx context.Context, key string, fn func(doc map[string]any) (map[string]any, error)) (int64, error) {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, wrapErr(err)
+	}
+	defer tx.Rollback()
+
+	expired, err := b.sweep(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	ev, err := b.swapTx(ctx, tx, key, fn)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, wrapErr(err)
+	}
+	for _, ev := range expired {
+		b.feed.Publish(ev)
+	}
+	b.feed.Publish(ev)
+	b.reindex(ctx, append(expired, ev)...)
+	return ev.Rev, nil
+}
+
+// swapTx replaces the document at key with the one returned by fn, which
+// receives the current document (nil when absent), the write bumps the
+// revision and returns the event to publish once tx commits
+func (b *sqliteBucket) swapTx(ctx context.Context, tx *sql.Tx, key string, fn func(doc map[string]any) (map[string]any, error)) (storage.Event, error) {
+	doc, err := b.get(ctx, tx, key)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return storage.Event{}, err
+	}
+	if doc != nil && storage.IsExpired(doc, time.Now()) {
+		// overwritten below as if it was gone already
+		doc = nil
+	}
+	existed := doc != nil && !storage.IsDeleted(doc) // fn may modify doc
+	next, err := fn(doc)
+	if err != nil {
+		return storage.Event{}, err
+	}
+	rev := storage.Revision(doc) + 1
+	next["rev"] = rev
+	raw, err := bson.Marshal(next)
+	if err != nil {
+		logs.Err("swap() : %v", err)
+		return storage.Event{}, err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (key, doc) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET doc = excluded.doc",
+		b.table,
+	), key, raw)
+	if err != nil {
+		logs.Err("swap() : %v", err)
+		return storage.Event{}, wrapErr(err)
+	}
+
+	ev := storage.Event{Op: storage.OpUpdate, Key: key, Rev: rev}
+	switch {
+	case storage.IsDeleted(next):
+		ev.Op = storage.OpDelete
+	case !existed:
+		ev.Op = storage.OpInsert
+	}
+	if ev.Op != storage.OpDelete && b.feed.Watched() {
+		var stored map[string]any
+		if err := bson.Unmarshal(raw, &stored); err == nil {
+			ev.Value = stored["value"]
+		}
+	}
+	return ev, nil
+}
+
+// batch runs fn for every entry of a batch inside one transaction, fn
+// errors are per entry results and do not roll the others back
+func (b *sqliteBucket) batch(ctx context.Context, keys []string, fn func(tx *sql.Tx, i int) (storage.Event, error)) ([]storage.Result, error) {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer tx.Rollback()
+
+	events, err := b.sweep(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]storage.Result, len(keys))
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, wrapErr(err)
+		}
+		ev, err := fn(tx, i)
+		if err == nil {
+			events = append(events, ev)
+		}
+		results[i] = storage.Result{Key: key, Err: err}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, wrapErr(err)
+	}
+	for _, ev := range events {
+		b.feed.Publish(ev)
+	}
+	b.reindex(ctx, events...)
+	return results, nil
+}
+
+// reindex refreshes the text index entries of the keys written by events
+// once their transaction committed, from what is stored by then
+func (b *sqliteBucket) reindex(ctx context.Context, events ...storage.Event) {
+	ti := b.text.Load()
+	if ti == nil {
+		return
+	}
+	// the write is done, the index follows even if the caller gave up
+	ctx = context.WithoutCancel(ctx)
+	for _, ev := range events {
+		doc, err := b.get(ctx, b.db, ev.Key)
+		if errors.Is(err, storage.ErrNotFound) {
+			ti.Put(ev.Key, nil)
+			continue
+		}
+		if err != nil {
+			logs.Err("reindex() : %v", err)
+			continue
+		}
+		ti.Put(ev.Key, doc)
+	}
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// get decodes the document stored for key
+func (b *sqliteBucket) get(ctx context.Context, q queryer, key string) (map[string]any, error) {
+	var raw []byte
+	err := q.QueryRowContext(ctx, fmt.Sprintf("SELECT doc FROM %s WHERE key = ?", b.table), key).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFound(key, b.Name())
+	}
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	var doc map[string]any
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// live decodes the document stored for key unless it is trashed or expired
+func (b *sqliteBucket) live(ctx context.Context, q queryer, key string) (map[string]any, error) {
+	doc, err := b.get(ctx, q, key)
+	if err != nil {
+		return nil, err
+	}
+	if storage.IsDeleted(doc) || storage.IsExpired(doc, time.Now()) {
+		return nil, notFound(key, b.Name())
+	}
+	return doc, nil
+}
+
+// sweep deletes the expired rows, at most once per storage.SweepInterval,
+// and returns the OpDelete events to publish once tx commits
+func (b *sqliteBucket) sweep(ctx context.Context, tx *sql.Tx) ([]storage.Event, error) {
+	now := time.Now().UnixNano()
+	last := b.swept.Load()
+	if now-last < int64(storage.SweepInterval) || !b.swept.CompareAndSwap(last, now) {
+		return nil, nil
+	}
+	var keys []string
+	var events []storage.Event
+	err := b.scan(ctx, tx, "bson_expired(doc)", func(doc map[string]any) bool {
+		key, _ := doc["key"].(string)
+		keys = append(keys, key)
+		if !storage.IsDeleted(doc) {
+			events = append(events, storage.Event{Op: storage.OpDelete, Key: key})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE key = ?", b.table), key); err != nil {
+			return nil, wrapErr(err)
+		}
+	}
+	return events, nil
+}
+
+// scan decodes every document matching where (live or trashed) in rowid
+// order and hands it to fn until fn returns false
+func (b *sqliteBucket) scan(ctx context.Context, q queryer, where string, fn func(doc map[string]any) bool) error {
+	rows, err := q.QueryContext(ctx, fmt.Sprintf("SELECT doc FROM %s WHERE %s ORDER BY rowid", b.table, where))
+	if err != nil {
+		return wrapErr(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return err
+		}
+		var doc map[string]any
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			return err
+		}
+		if !fn(doc) {
+			break
+		}
+	}
+	return wrapErr(rows.Err())
+}
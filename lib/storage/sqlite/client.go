@@ -0,0 +1,190 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	logs "github.com/danmuck/dps_lib/logs"
+	_ "modernc.org/sqlite" // pure go driver, registers "sqlite"
+)
+
+// stores holds every SQLiteClient opened in this process by path,
+// services sharing a database file share a single connection
+var (
+	stores   = make(map[string]*SQLiteClient)
+	storesMu sync.Mutex
+)
+
+// SQLiteClient is a storage.Client backed by an embedded SQLite file
+// each bucket is a table of {key, doc} rows where doc is the BSON encoded
+// {key, value} document, the same shape mongoBucket stores
+type SQLiteClient struct {
+	name     string
+	location string
+	t        string // "sqlite"
+	db       *sql.DB
+	buckets  map[string]*sqliteBucket
+
+	mu sync.Mutex
+}
+
+// NewSQLiteStore opens (or creates) the SQLite database file at path
+func NewSQLiteStore(path, dbName string) (*SQLiteClient, error) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	if ss, exists := stores[path]; exists {
+		return ss, nil
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite only allows a single writer, serialize everything through one connection
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		logs.Log("failed to open SQLite database at %s: %v", path, err)
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec("PRAGMA journal_mode=WAL; PRAGMA busy_timeout=5000;"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	logs.Log("connecting to SQLite at %s", path)
+	ss := &SQLiteClient{
+		name:     dbName,
+		location: path,
+		t:        "sqlite",
+		db:       db,
+		buckets:  make(map[string]*sqliteBucket),
+	}
+	stores[path] = ss
+	return ss, nil
+}
+
+// Name returns the name of the database
+func (ss *SQLiteClient) Name() string {
+	return ss.name
+}
+
+// Type returns the type of storage
+// -> "sqlite"
+func (ss *SQLiteClient) Type() string {
+	return ss.t
+}
+
+// Location returns the path of the database file
+func (ss *SQLiteClient) Location() string {
+	return ss.location
+}
+
+// database/sql Ping wrapper
+func (ss *SQLiteClient) Ping(ctx context.Context) error {
+	return wrapErr(ss.db.PingContext(ctx))
+}
+
+// ConnectOrCreateBucket connects to an existing bucket or creates its table if it doesn't exist.
+// indexes are created if they do not exist yet, a failure is logged and
+// the bucket is still returned
+func (ss *SQLiteClient) ConnectOrCreateBucket(ctx context.Context, bucket string, indexes ...storage.Index) storage.Bucket {
+	logs.Init("ConnectOrCreateBucket [%s]", bucket)
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	collection, exists := ss.buckets[bucket]
+	if !exists || collection == nil {
+		logs.Info("Create [%s]", bucket)
+		created, err := newSQLiteBucket(ctx, ss.db, bucket)
+		if err != nil {
+			// not cached, the next call retries creating the table
+			logs.Err("failed to create table for bucket %q: %v", bucket, err)
+			return created
+		}
+		ss.buckets[bucket] = created
+		collection = created
+	}
+	if len(indexes) > 0 {
+		if err := collection.ensureIndexes(ctx, indexes); err != nil {
+			logs.Err("failed to create indexes for bucket %q: %v", bucket, err)
+		}
+	}
+	return collection
+}
+
+// basic CRUD operations
+func (ss *SQLiteClient) Store(ctx context.Context, bucket string, key string, value any) error {
+	logs.Init("Store [%q] : { %q : %v }", bucket, key, value)
+	return ss.ConnectOrCreateBucket(ctx, bucket).Store(ctx, key, value)
+}
+
+// retrieves a value by key from a bucket
+func (ss *SQLiteClient) Retrieve(ctx context.Context, bucket string, key string) (any, error) {
+	logs.Init("Retrieve [%q] : { %q }", bucket, key)
+	return ss.ConnectOrCreateBucket(ctx, bucket).Retrieve(ctx, key)
+}
+
+// deletes a key from a bucket
+func (ss *SQLiteClient) Delete(ctx context.Context, bucket string, key string) error {
+	logs.Init("Delete [%q] key %q", bucket, key)
+	return ss.ConnectOrCreateBucket(ctx, bucket).Delete(ctx, key)
+}
+
+// Directly updates a value by key in a bucket
+func (ss *SQLiteClient) Update(ctx context.Context, bucket string, key string, value any) error {
+	logs.Init("Update [%q] { %q : %v }", bucket, key, value)
+	return ss.ConnectOrCreateBucket(ctx, bucket).Update(ctx, key, value)
+}
+
+// Patch fields on the value of a key in a bucket
+func (ss *SQLiteClient) Patch(ctx context.Context, bucket, key string, updates map[string]any) error {
+	logs.Init("Patch [%q] key %q updates: %v", bucket, key, updates)
+	return ss.ConnectOrCreateBucket(ctx, bucket).Patch(ctx, key, updates)
+}
+
+// Lookup a key in a bucket by field key
+// note: this is gated by the bucket policy (storage.PolicyFor)
+func (ss *SQLiteClient) Lookup(ctx context.Context, bucket string, filter any, fields ...string) (map[string]any, error) {
+	logs.Init("Lookup [%q] filter: %v", bucket, filter)
+	return ss.ConnectOrCreateBucket(ctx, bucket).Lookup(ctx, filter, fields...)
+}
+
+// Retrieve a list of all keys in a bucket
+func (ss *SQLiteClient) List(ctx context.Context, bucket string) ([]any, error) {
+	logs.Init("List [%s]", bucket)
+	return ss.ConnectOrCreateBucket(ctx, bucket).ListKeys(ctx)
+}
+
+// Retrieve a single page of items in a bucket
+func (ss *SQLiteClient) ListPage(ctx context.Context, bucket string, opts storage.ListOptions) (storage.Page, error) {
+	logs.Init("ListPage [%s]", bucket)
+	return ss.ConnectOrCreateBucket(ctx, bucket).ListPage(ctx, opts)
+}
+
+// Count the number of keys in a bucket
+func (ss *SQLiteClient) Count(ctx context.Context, bucket string) (int64, error) {
+	logs.Init("Count [%s]", bucket)
+	return ss.ConnectOrCreateBucket(ctx, bucket).Count(ctx)
+}
+
+// Buckets lists the bucket tables of the database file, sorted
+func (ss *SQLiteClient) Buckets(ctx context.Context) ([]string, error) {
+	logs.Init("Buckets")
+	rows, err := ss.db.QueryContext(ctx,
+		"SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, wrapErr(err)
+		}
+		names = append(names, name)
+	}
+	return names, wrapErr(rows.Err())
+}
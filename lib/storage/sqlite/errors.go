@@ -0,0 +1,48 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	driver "modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// wrapErr maps database/sql and sqlite errors onto the storage sentinel errors
+// the original error stays in the chain for logging
+func wrapErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %w", storage.ErrNotFound, err)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", storage.ErrUnavailable, err)
+	}
+	var serr *driver.Error
+	if errors.As(err, &serr) {
+		switch serr.Code() {
+		case sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+			return fmt.Errorf("%w: %w", storage.ErrConflict, err)
+		}
+		switch serr.Code() & 0xff {
+		case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+			return fmt.Errorf("%w: %w", storage.ErrUnavailable, err)
+		}
+	}
+	return err
+}
+
+// notFound reports a key that matched no document
+func notFound(key, bucket string) error {
+	return fmt.Errorf("%w: no document with key=%q in bucket=%q", storage.ErrNotFound, key, bucket)
+}
+
+// stale reports a conditional write on a document that is no longer at rev
+func stale(key, bucket string, rev int64) error {
+	return fmt.Errorf("%w: key=%q in bucket=%q is no longer at revision %d", storage.ErrStale, key, bucket, rev)
+}
@@ -0,0 +1,70 @@
+package sqlite
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	sqlite "modernc.org/sqlite"
+)
+
+// bson_get(doc, path) extracts the value at a dotted path from a BSON
+// encoded doc column, it backs the expression indexes created for
+// storage.Index declarations, e.g.
+//
+//	CREATE UNIQUE INDEX ... ON "usersv1" (bson_get(doc, 'value.username'))
+//
+// missing fields and nulls are NULL, which sqlite never treats as duplicates
+//
+// bson_expired(doc) is 1 once the storage.Expires date of doc has passed
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction("bson_get", 2, bsonGet)
+	sqlite.MustRegisterScalarFunction("bson_expired", 1, bsonExpired)
+}
+
+func bsonGet(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	raw, ok := args[0].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("bson_get: doc must be a blob, got %T", args[0])
+	}
+	path, ok := args[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("bson_get: path must be text, got %T", args[1])
+	}
+	val, err := bson.Raw(raw).LookupErr(strings.Split(path, ".")...)
+	if err != nil {
+		return nil, nil
+	}
+	switch val.Type {
+	case bson.TypeNull, bson.TypeUndefined:
+		return nil, nil
+	case bson.TypeString:
+		return val.StringValue(), nil
+	case bson.TypeInt32:
+		return int64(val.Int32()), nil
+	case bson.TypeInt64:
+		return val.Int64(), nil
+	case bson.TypeDouble:
+		return val.Double(), nil
+	}
+	// anything else compares by its encoding, tagged with the type
+	return append([]byte{byte(val.Type)}, val.Value...), nil
+}
+
+func bsonExpired(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	raw, ok := args[0].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("bson_expired: doc must be a blob, got %T", args[0])
+	}
+	val, err := bson.Raw(raw).LookupErr(storage.Expires)
+	if err != nil {
+		return int64(0), nil
+	}
+	if at, ok := val.DateTimeOK(); ok && at <= time.Now().UnixMilli() {
+		return int64(1), nil
+	}
+	return int64(0), nil
+}
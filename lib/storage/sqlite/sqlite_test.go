@@ -0,0 +1,20 @@
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	"github.com/danmuck/dps_http/lib/storage/sqlite"
+	"github.com/danmuck/dps_http/lib/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Client {
+		ss, err := sqlite.NewSQLiteStore(filepath.Join(t.TempDir(), "conformance.db"), "conformance")
+		if err != nil {
+			t.Fatalf("NewSQLiteStore: %v", err)
+		}
+		return ss
+	})
+}
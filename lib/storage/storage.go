@@ -2,19 +2,63 @@ package storage
 
 import (
 	"context"
+	"time"
 )
 
+// every operation takes a context.Context, callers are expected to bound it
+// (e.g. the gin request context with a service deadline) so that an abandoned
+// request cancels its database work
+//
+// errors wrap ErrNotFound, ErrConflict, ErrUnavailable, ErrInvalid, ErrStale or
+// ErrForbidden where they apply (see errors.go)
+//
+// every write bumps the revision of the document (see revision.go),
+// CompareAndSwap and PatchIfRevision only write at the expected revision
+//
+// the Batch operations report per item errors in their []Result, the
+// returned error is reserved for the batch as a whole (e.g. a dead context)
+//
+// Delete is a soft delete, trashed documents are hidden from everything but
+// ListTrash, Restore and Purge (see trash.go)
+//
+// StoreWithTTL documents expire, expired documents are hidden like
+// trashed ones until they are removed (see ttl.go)
+//
+// Lookup, LookupItem and ListPage read only the value fields they are given
+// (see projection.go)
+//
+// Watch streams the writes that happen after it is called (see watch.go),
+// the channel is closed when ctx is done or the watcher could not keep up
+// //
+
 type Bucket interface {
-	Name() string                                   // returns the bucket name
-	Store(key string, value any) error              // stores a value by key
-	Retrieve(key string) (any, error)               // retrieves a value by key
-	Delete(key string) error                        // deletes a value by key
-	Update(key string, value any) error             // updates a value by key
-	Patch(key string, updates map[string]any) error // updates specific fields in a document
-	Lookup(key any) (map[string]any, bool)          // looks up a specific key in the bucket
-	ListKeys() ([]any, error)                       // lists all keys in the bucket
-	ListItems() ([]map[string]any, error)           // lists all items in the bucket
-	Count() (int64, error)                          // counts documents in the bucket
+	Name() string                                                                                      // returns the bucket name
+	Store(ctx context.Context, key string, value any) error                                            // stores a value by key
+	StoreWithTTL(ctx context.Context, key string, value any, ttl time.Duration) error                  // stores a value that expires after ttl
+	Retrieve(ctx context.Context, key string) (any, error)                                             // retrieves a value by key
+	Delete(ctx context.Context, key string) error                                                      // deletes a value by key
+	Update(ctx context.Context, key string, value any) error                                           // updates a value by key
+	Patch(ctx context.Context, key string, updates map[string]any) error                               // updates specific fields in a document
+	RetrieveRevision(ctx context.Context, key string) (any, int64, error)                              // retrieves a value and its revision by key
+	CompareAndSwap(ctx context.Context, key string, rev int64, value any) (int64, error)               // replaces a value if it is still at rev
+	PatchIfRevision(ctx context.Context, key string, rev int64, updates map[string]any) (int64, error) // patches a document if it is still at rev
+	BatchStore(ctx context.Context, items []Item) ([]Result, error)                                    // stores many values, one result per item
+	BatchDelete(ctx context.Context, keys []string) ([]Result, error)                                  // deletes many keys, one result per key
+	BatchPatch(ctx context.Context, changes []Change) ([]Result, error)                                // patches many documents, one result per change
+	Lookup(ctx context.Context, key any, fields ...string) (map[string]any, error)                     // looks up a specific key, fields project its value
+	LookupItem(ctx context.Context, key any, fields ...string) (map[string]any, error)                 // looks up the {key, value, rev} document of a specific key
+	ListKeys(ctx context.Context) ([]any, error)                                                       // lists all keys in the bucket
+	ListItems(ctx context.Context) ([]map[string]any, error)                                           // lists all items in the bucket
+	ListPage(ctx context.Context, opts ListOptions) (Page, error)                                      // lists one sorted, filtered page of items
+	Count(ctx context.Context) (int64, error)                                                          // counts documents in the bucket
+	Aggregate(ctx context.Context, agg Aggregation) ([]Group, error)                                   // groups and counts live items, see aggregate.go
+	ListTrash(ctx context.Context, opts ListOptions) (Page, error)                                     // lists one page of soft deleted items
+	Restore(ctx context.Context, key string) error                                                     // brings back a soft deleted item
+	Purge(ctx context.Context, before time.Time) (int64, error)                                        // removes items deleted before a cutoff for good
+	Watch(ctx context.Context) (<-chan Event, error)                                                   // streams writes on the bucket until ctx is done
+
+	// finds live items by text in some fields, fields project their values, see search.go
+	Search(ctx context.Context, query string, in []string, limit int64, fields ...string) ([]map[string]any, error)
 }
 
 type Client interface {
@@ -23,13 +67,15 @@ type Client interface {
 	Type() string                   // returns the client type
 	Ping(ctx context.Context) error // checks if the client is reachable
 
-	ConnectOrCreateBucket(bucket string) Bucket             // connects to or creates a bucket
-	Store(bucket string, key string, value any) error       // stores a value in a bucket by key
-	Retrieve(bucket string, key string) (any, error)        // retrieves a value from a bucket by key
-	Delete(bucket string, key string) error                 // deletes a value from a bucket by key
-	Update(bucket string, key string, value any) error      // updates a value in a bucket by key
-	Patch(bucket, key string, updates map[string]any) error // updates specific fields in a document
-	List(bucket string) ([]any, error)                      // lists all keys in a bucket
-	Lookup(bucket string, key any) (map[string]any, bool)   // looks up a specific key in a bucket
-	Count(bucket string) (int64, error)                     // counts documents in a bucket
+	ConnectOrCreateBucket(ctx context.Context, bucket string, indexes ...Index) Bucket            // connects to or creates a bucket and its indexes
+	Store(ctx context.Context, bucket string, key string, value any) error                        // stores a value in a bucket by key
+	Retrieve(ctx context.Context, bucket string, key string) (any, error)                         // retrieves a value from a bucket by key
+	Delete(ctx context.Context, bucket string, key string) error                                  // deletes a value from a bucket by key
+	Update(ctx context.Context, bucket string, key string, value any) error                       // updates a value in a bucket by key
+	Patch(ctx context.Context, bucket, key string, updates map[string]any) error                  // updates specific fields in a document
+	List(ctx context.Context, bucket string) ([]any, error)                                       // lists all keys in a bucket
+	ListPage(ctx context.Context, bucket string, opts ListOptions) (Page, error)                  // lists one page of items in a bucket
+	Lookup(ctx context.Context, bucket string, key any, fields ...string) (map[string]any, error) // looks up a specific key in a bucket
+	Count(ctx context.Context, bucket string) (int64, error)                                      // counts documents in a bucket
+	Buckets(ctx context.Context) ([]string, error)                                                // lists the buckets of the database, see TenantsOf
 }
@@ -0,0 +1,163 @@
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/danmuck/dps_http/lib/storage"
+)
+
+// RunBlobs runs the blob suite against the stores returned by newStore,
+// which is called once per subtest and must return an empty store
+//
+//	func TestBlobs(t *testing.T) {
+//		storagetest.RunBlobs(t, func(t *testing.T) storage.BlobStore {
+//			fs, _ := files.NewFileStore(t.TempDir())
+//			return fs
+//		})
+//	}
+func RunBlobs(t *testing.T, newStore func(t *testing.T) storage.BlobStore) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, bs storage.BlobStore)
+	}{
+		{"PutGet", testPutGet},
+		{"Replace", testReplace},
+		{"BlobNotFound", testBlobNotFound},
+		{"BlobKeys", testBlobKeys},
+		{"CancelledPut", testCancelledPut},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStore(t))
+		})
+	}
+}
+
+// read returns the content of the blob at key
+func read(t *testing.T, ctx context.Context, bs storage.BlobStore, key string) ([]byte, storage.BlobInfo) {
+	t.Helper()
+	rc, info, err := bs.Get(ctx, key)
+	ok(t, "Get "+key, err)
+	defer rc.Close()
+	raw, err := io.ReadAll(rc)
+	ok(t, "Get "+key+" read", err)
+	return raw, info
+}
+
+func testPutGet(t *testing.T, bs storage.BlobStore) {
+	ctx := context5s(t)
+	// larger than a GridFS chunk (255kB) so that streaming is exercised
+	content := bytes.Repeat([]byte("0123456789abcdef"), 32<<10)
+
+	info, err := bs.Put(ctx, "avatars/a.png", bytes.NewReader(content), "image/png")
+	ok(t, "Put", err)
+	if info.Key != "avatars/a.png" || info.Size != int64(len(content)) || info.ContentType != "image/png" || info.Modified.IsZero() {
+		t.Fatalf("Put: got %+v, want the key, size, content type and modified time", info)
+	}
+	stat, err := bs.Stat(ctx, "avatars/a.png")
+	ok(t, "Stat", err)
+	if stat.Size != info.Size || stat.ContentType != info.ContentType {
+		t.Fatalf("Stat: got %+v, want %+v", stat, info)
+	}
+	got, gotInfo := read(t, ctx, bs, "avatars/a.png")
+	if !bytes.Equal(got, content) {
+		t.Fatalf("Get: got %d bytes, want the %d bytes put", len(got), len(content))
+	}
+	if gotInfo.Size != info.Size || gotInfo.ContentType != "image/png" {
+		t.Fatalf("Get: got %+v, want %+v", gotInfo, info)
+	}
+
+	// empty blobs are blobs too
+	_, err = bs.Put(ctx, "empty", strings.NewReader(""), "text/plain")
+	ok(t, "Put empty", err)
+	got, _ = read(t, ctx, bs, "empty")
+	equal(t, "Get empty", len(got), 0)
+
+	ok(t, "Delete", bs.Delete(ctx, "avatars/a.png"))
+	_, err = bs.Stat(ctx, "avatars/a.png")
+	is(t, "Stat after Delete", err, storage.ErrNotFound)
+	_, err = bs.Stat(ctx, "empty")
+	ok(t, "Stat other blob after Delete", err)
+}
+
+func testReplace(t *testing.T, bs storage.BlobStore) {
+	ctx := context5s(t)
+
+	_, err := bs.Put(ctx, "k", strings.NewReader("first version"), "text/plain")
+	ok(t, "Put", err)
+	_, err = bs.Put(ctx, "k", strings.NewReader("second"), "application/json")
+	ok(t, "Put again", err)
+	got, info := read(t, ctx, bs, "k")
+	equal(t, "Get replaced", string(got), "second")
+	if info.Size != 6 || info.ContentType != "application/json" {
+		t.Fatalf("Get replaced: got %+v, want 6 bytes of application/json", info)
+	}
+
+	// a Delete removes the blob as a whole, older versions included
+	ok(t, "Delete", bs.Delete(ctx, "k"))
+	_, _, err = bs.Get(ctx, "k")
+	is(t, "Get after Delete", err, storage.ErrNotFound)
+}
+
+func testBlobNotFound(t *testing.T, bs storage.BlobStore) {
+	ctx := context5s(t)
+
+	_, _, err := bs.Get(ctx, "missing")
+	is(t, "Get", err, storage.ErrNotFound)
+	_, err = bs.Stat(ctx, "missing")
+	is(t, "Stat", err, storage.ErrNotFound)
+	is(t, "Delete", bs.Delete(ctx, "missing"), storage.ErrNotFound)
+
+	// a prefix of a key is not a blob
+	_, err = bs.Put(ctx, "dir/blob", strings.NewReader("x"), "")
+	ok(t, "Put", err)
+	_, err = bs.Stat(ctx, "dir")
+	is(t, "Stat prefix", err, storage.ErrNotFound)
+}
+
+func testBlobKeys(t *testing.T, bs storage.BlobStore) {
+	ctx := context5s(t)
+
+	for _, key := range []string{"", "/abs", "a//b", "../up", "a/../b", ".hidden", "a/.b", "sp ace", "a\\b"} {
+		_, err := bs.Put(ctx, key, strings.NewReader("x"), "")
+		is(t, "Put "+key, err, storage.ErrInvalid)
+		_, _, err = bs.Get(ctx, key)
+		is(t, "Get "+key, err, storage.ErrInvalid)
+		is(t, "Delete "+key, bs.Delete(ctx, key), storage.ErrInvalid)
+	}
+	_, err := bs.Put(ctx, "tenant__avatars/0a1B-c_d.v2.png", strings.NewReader("x"), "")
+	ok(t, "Put qualified key", err)
+}
+
+func testCancelledPut(t *testing.T, bs storage.BlobStore) {
+	ctx := context5s(t)
+
+	_, err := bs.Put(ctx, "k", strings.NewReader("kept"), "text/plain")
+	ok(t, "Put", err)
+
+	// the reader fails half way, the blob in place is kept whole
+	failing := io.MultiReader(strings.NewReader("partial"), errReader{})
+	_, err = bs.Put(ctx, "k", failing, "text/plain")
+	if err == nil {
+		t.Fatal("Put from a failing reader: got no error")
+	}
+	got, _ := read(t, ctx, bs, "k")
+	equal(t, "Get after failed Put", string(got), "kept")
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = bs.Put(cancelled, "other", strings.NewReader("x"), "")
+	if err == nil {
+		t.Fatal("Put with a cancelled context: got no error")
+	}
+	_, err = bs.Stat(ctx, "other")
+	is(t, "Stat after cancelled Put", err, storage.ErrNotFound)
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, io.ErrUnexpectedEOF }
@@ -0,0 +1,927 @@
+// Package storagetest checks that a storage.Client honours the contract
+// documented in lib/storage, every backend runs the same suite
+//
+//	func TestMemory(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Client {
+//			return memory.NewMemoryStore(t.Name())
+//		})
+//	}
+//
+// note: the quirks the services rely on are checked here too, e.g. Update
+// fails on a missing key while Store upserts, Lookup returns the value
+// rather than the {key, value} document and ListKeys lists values
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danmuck/dps_http/lib/storage"
+)
+
+// Fields is the policy registered for every bucket of the suite
+var Fields = map[string]storage.Rule{
+	"name":     {Ops: []string{"$in", "$ne"}},
+	"n":        {Ops: []string{"$gt", "$gte", "$lt", "$lte"}},
+	"tags":     {Ops: []string{"$in"}},
+	"nested.x": {},
+}
+
+// Run runs the suite against the clients returned by newClient, which is
+// called once per subtest and must return a client on an empty database
+func Run(t *testing.T, newClient func(t *testing.T) storage.Client) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, c storage.Client)
+	}{
+		{"StoreRetrieve", testStoreRetrieve},
+		{"Revisions", testRevisions},
+		{"NotFound", testNotFound},
+		{"UpdateRequiresKey", testUpdateRequiresKey},
+		{"Patch", testPatch},
+		{"Prefixing", testPrefixing},
+		{"ListAndCount", testListAndCount},
+		{"ListPage", testListPage},
+		{"ListPageMissingSort", testListPageMissingSort},
+		{"Trash", testTrash},
+		{"UniqueIndex", testUniqueIndex},
+		{"TenantIndexes", testTenantIndexes},
+		{"TenantBuckets", testTenantBuckets},
+		{"Batch", testBatch},
+		{"TTL", testTTL},
+		{"Aggregate", testAggregate},
+		{"Search", testSearch},
+		{"Projection", testProjection},
+		{"ConcurrentWriters", testConcurrentWriters},
+		{"Watch", testWatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newClient(t))
+		})
+	}
+}
+
+// bucket returns a bucket named after the running test with the suite policy
+func bucket(t *testing.T, c storage.Client, indexes ...storage.Index) storage.Bucket {
+	t.Helper()
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '_'
+	}, t.Name())
+	storage.RegisterPolicy(name, storage.Policy{Fields: Fields})
+	return c.ConnectOrCreateBucket(context.Background(), name, indexes...)
+}
+
+func context5s(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(storage.WithRoles(context.Background(), storage.RoleSystem), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// equal compares a value read back with the value written
+func equal(t *testing.T, what string, got, want any) {
+	t.Helper()
+	if !reflect.DeepEqual(storage.Normalize(got), storage.Normalize(want)) {
+		t.Fatalf("%s: got %#v, want %#v", what, got, want)
+	}
+}
+
+func is(t *testing.T, what string, err, want error) {
+	t.Helper()
+	if !errors.Is(err, want) {
+		t.Fatalf("%s: got error %v, want %v", what, err, want)
+	}
+}
+
+func ok(t *testing.T, what string, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+}
+
+func count(t *testing.T, ctx context.Context, b storage.Bucket, want int64) {
+	t.Helper()
+	n, err := b.Count(ctx)
+	ok(t, "Count", err)
+	if n != want {
+		t.Fatalf("Count: got %d, want %d", n, want)
+	}
+}
+
+// integer reads back an int, backends decode small ones as int32
+func integer(v any) int64 {
+	switch n := v.(type) {
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	}
+	return -1
+}
+
+func doc(name string, n int, tags ...string) map[string]any {
+	if tags == nil {
+		tags = []string{}
+	}
+	return map[string]any{"name": name, "n": n, "tags": tags}
+}
+
+func testStoreRetrieve(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	b := bucket(t, c)
+
+	ok(t, "Store", b.Store(ctx, "a", doc("alpha", 1, "x")))
+	got, err := b.Retrieve(ctx, "a")
+	ok(t, "Retrieve", err)
+	equal(t, "Retrieve", got, doc("alpha", 1, "x"))
+
+	// Store upserts, the previous value is replaced not merged
+	ok(t, "Store", b.Store(ctx, "a", map[string]any{"name": "beta"}))
+	got, err = b.Retrieve(ctx, "a")
+	ok(t, "Retrieve", err)
+	equal(t, "Retrieve after Store", got, map[string]any{"name": "beta"})
+
+	// scalars are values too
+	ok(t, "Store", b.Store(ctx, "s", int64(42)))
+	got, err = b.Retrieve(ctx, "s")
+	ok(t, "Retrieve", err)
+	equal(t, "Retrieve scalar", got, int64(42))
+
+	// the client level operations reach the same bucket
+	got, err = c.Retrieve(ctx, b.Name(), "a")
+	ok(t, "Client.Retrieve", err)
+	equal(t, "Client.Retrieve", got, map[string]any{"name": "beta"})
+	ok(t, "Client.Store", c.Store(ctx, b.Name(), "c", doc("gamma", 3)))
+	count(t, ctx, b, 3)
+}
+
+func testRevisions(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	b := bucket(t, c)
+
+	ok(t, "Store", b.Store(ctx, "a", doc("alpha", 1)))
+	_, rev, err := b.RetrieveRevision(ctx, "a")
+	ok(t, "RetrieveRevision", err)
+	if rev != 1 {
+		t.Fatalf("first revision: got %d, want 1", rev)
+	}
+	ok(t, "Patch", b.Patch(ctx, "a", map[string]any{"n": 2}))
+	ok(t, "Update", b.Update(ctx, "a", doc("alpha", 3)))
+	_, rev, err = b.RetrieveRevision(ctx, "a")
+	ok(t, "RetrieveRevision", err)
+	if rev != 3 {
+		t.Fatalf("revision after Patch and Update: got %d, want 3", rev)
+	}
+
+	next, err := b.CompareAndSwap(ctx, "a", rev, doc("alpha", 4))
+	ok(t, "CompareAndSwap", err)
+	if next != rev+1 {
+		t.Fatalf("CompareAndSwap: got revision %d, want %d", next, rev+1)
+	}
+	_, err = b.CompareAndSwap(ctx, "a", rev, doc("alpha", 5))
+	is(t, "CompareAndSwap at a stale revision", err, storage.ErrStale)
+	_, err = b.PatchIfRevision(ctx, "a", rev, map[string]any{"n": 5})
+	is(t, "PatchIfRevision at a stale revision", err, storage.ErrStale)
+	next, err = b.PatchIfRevision(ctx, "a", next, map[string]any{"n": 5})
+	ok(t, "PatchIfRevision", err)
+	got, rev, err := b.RetrieveRevision(ctx, "a")
+	ok(t, "RetrieveRevision", err)
+	if rev != next {
+		t.Fatalf("RetrieveRevision: got revision %d, want %d", rev, next)
+	}
+	equal(t, "RetrieveRevision", got, doc("alpha", 5))
+}
+
+func testNotFound(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	b := bucket(t, c)
+
+	_, err := b.Retrieve(ctx, "missing")
+	is(t, "Retrieve", err, storage.ErrNotFound)
+	_, _, err = b.RetrieveRevision(ctx, "missing")
+	is(t, "RetrieveRevision", err, storage.ErrNotFound)
+	is(t, "Update", b.Update(ctx, "missing", doc("x", 1)), storage.ErrNotFound)
+	is(t, "Patch", b.Patch(ctx, "missing", map[string]any{"n": 1}), storage.ErrNotFound)
+	is(t, "Delete", b.Delete(ctx, "missing"), storage.ErrNotFound)
+	is(t, "Restore", b.Restore(ctx, "missing"), storage.ErrNotFound)
+	_, err = b.CompareAndSwap(ctx, "missing", 1, doc("x", 1))
+	is(t, "CompareAndSwap", err, storage.ErrNotFound)
+	_, err = b.PatchIfRevision(ctx, "missing", 1, map[string]any{"n": 1})
+	is(t, "PatchIfRevision", err, storage.ErrNotFound)
+	_, err = b.Lookup(ctx, map[string]any{"name": "missing"})
+	is(t, "Lookup", err, storage.ErrNotFound)
+	_, err = c.Retrieve(ctx, b.Name(), "missing")
+	is(t, "Client.Retrieve", err, storage.ErrNotFound)
+	count(t, ctx, b, 0)
+}
+
+// Update only replaces, it never creates the key, Store does
+func testUpdateRequiresKey(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	b := bucket(t, c)
+
+	is(t, "Update on a missing key", b.Update(ctx, "a", doc("alpha", 1)), storage.ErrNotFound)
+	is(t, "Client.Update on a missing key", c.Update(ctx, b.Name(), "a", doc("alpha", 1)), storage.ErrNotFound)
+	count(t, ctx, b, 0)
+
+	ok(t, "Store", b.Store(ctx, "a", doc("alpha", 1)))
+	ok(t, "Update", b.Update(ctx, "a", doc("alpha", 2)))
+	got, err := b.Retrieve(ctx, "a")
+	ok(t, "Retrieve", err)
+	equal(t, "Retrieve after Update", got, doc("alpha", 2))
+}
+
+func testPatch(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	b := bucket(t, c)
+
+	value := doc("alpha", 1, "x")
+	value["nested"] = map[string]any{"x": "a", "y": "b"}
+	ok(t, "Store", b.Store(ctx, "a", value))
+
+	// dotted paths set a single sub field, the rest of the value is kept
+	ok(t, "Patch", b.Patch(ctx, "a", map[string]any{"n": 2, "nested.x": "c"}))
+	value["n"] = 2
+	value["nested"] = map[string]any{"x": "c", "y": "b"}
+	got, err := b.Retrieve(ctx, "a")
+	ok(t, "Retrieve", err)
+	equal(t, "Retrieve after Patch", got, value)
+
+	// new fields are added
+	ok(t, "Client.Patch", c.Patch(ctx, b.Name(), "a", map[string]any{"extra": true}))
+	value["extra"] = true
+	got, err = b.Retrieve(ctx, "a")
+	ok(t, "Retrieve", err)
+	equal(t, "Retrieve after Client.Patch", got, value)
+}
+
+// values live under "value." in the stored document, filters name the
+// value fields without it
+func testPrefixing(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	b := bucket(t, c)
+
+	value := doc("alpha", 1)
+	value["nested"] = map[string]any{"x": "deep"}
+	ok(t, "Store", b.Store(ctx, "a", value))
+	ok(t, "Store", b.Store(ctx, "b", doc("beta", 2)))
+
+	got, err := b.Lookup(ctx, map[string]any{"name": "alpha"})
+	ok(t, "Lookup", err)
+	equal(t, "Lookup returns the value", got, value)
+	got, err = b.Lookup(ctx, map[string]any{"nested.x": "deep"})
+	ok(t, "Lookup on a dotted field", err)
+	equal(t, "Lookup on a dotted field", got, value)
+	got, err = c.Lookup(ctx, b.Name(), map[string]any{"key": "b"})
+	ok(t, "Client.Lookup on key", err)
+	equal(t, "Client.Lookup on key", got, doc("beta", 2))
+
+	_, err = b.Lookup(ctx, map[string]any{"secret": "x"})
+	is(t, "Lookup outside the policy", err, storage.ErrInvalid)
+	_, err = b.Lookup(ctx, map[string]any{})
+	is(t, "Lookup with an empty filter", err, storage.ErrInvalid)
+
+	items, err := b.ListItems(ctx)
+	ok(t, "ListItems", err)
+	for _, item := range items {
+		if _, found := item["name"]; found {
+			t.Fatalf("ListItems: value field at the top of %v", item)
+		}
+		if item["key"] == "a" {
+			name, _ := storage.Resolve(item, "value.name")
+			equal(t, "value.name", name, "alpha")
+		}
+	}
+}
+
+func testListAndCount(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	b := bucket(t, c)
+
+	want := map[string]any{}
+	for i := range 7 {
+		key := fmt.Sprintf("k%d", i)
+		want[key] = doc(key, i)
+		ok(t, "Store", b.Store(ctx, key, want[key]))
+	}
+	count(t, ctx, b, 7)
+	n, err := c.Count(ctx, b.Name())
+	ok(t, "Client.Count", err)
+	if n != 7 {
+		t.Fatalf("Client.Count: got %d, want 7", n)
+	}
+
+	items, err := b.ListItems(ctx)
+	ok(t, "ListItems", err)
+	if len(items) != len(want) {
+		t.Fatalf("ListItems: got %d items, want %d", len(items), len(want))
+	}
+	for _, item := range items {
+		key, _ := item["key"].(string)
+		equal(t, "ListItems "+key, item["value"], want[key])
+	}
+
+	// ListKeys (and Client.List) list the values despite the name
+	values, err := b.ListKeys(ctx)
+	ok(t, "ListKeys", err)
+	listed, err := c.List(ctx, b.Name())
+	ok(t, "Client.List", err)
+	if len(values) != len(want) || len(listed) != len(want) {
+		t.Fatalf("ListKeys: got %d and %d values, want %d", len(values), len(listed), len(want))
+	}
+	for _, v := range values {
+		m, _ := v.(map[string]any)
+		key, _ := m["name"].(string)
+		equal(t, "ListKeys "+key, v, want[key])
+	}
+}
+
+func testListPage(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	b := bucket(t, c)
+
+	for i := range 10 {
+		tag := "even"
+		if i%2 == 1 {
+			tag = "odd"
+		}
+		ok(t, "Store", b.Store(ctx, fmt.Sprintf("k%02d", i), doc(fmt.Sprintf("n%d", i), 9-i, tag)))
+	}
+
+	// walking the pages sorted on n sees every document once, in order
+	var seen []int
+	opts := storage.ListOptions{Limit: 3, Sort: "n"}
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("ListPage: cursor never ran out")
+		}
+		page, err := b.ListPage(ctx, opts)
+		ok(t, "ListPage", err)
+		if int64(len(page.Items)) > opts.Limit {
+			t.Fatalf("ListPage: got %d items, limit %d", len(page.Items), opts.Limit)
+		}
+		for _, item := range page.Items {
+			n, _ := storage.Resolve(item, "value.n")
+			seen = append(seen, int(integer(n)))
+		}
+		if page.Next == "" {
+			break
+		}
+		opts.Cursor = page.Next
+	}
+	equal(t, "ListPage order", seen, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+
+	page, err := b.ListPage(ctx, storage.ListOptions{Limit: 2, Sort: "-n"})
+	ok(t, "ListPage descending", err)
+	if len(page.Items) != 2 || page.Items[0]["key"] != "k00" || page.Items[1]["key"] != "k01" {
+		t.Fatalf("ListPage descending: got %v", page.Items)
+	}
+
+	page, err = b.ListPage(ctx, storage.ListOptions{Filter: map[string]any{"tags": "odd", "n": map[string]any{"$gte": 4}}})
+	ok(t, "ListPage filtered", err)
+	if len(page.Items) != 3 {
+		t.Fatalf("ListPage filtered: got %d items, want 3", len(page.Items))
+	}
+	page, err = c.ListPage(ctx, b.Name(), storage.ListOptions{Filter: map[string]any{"name": map[string]any{"$in": []string{"n1", "n2", "nope"}}}})
+	ok(t, "Client.ListPage with $in", err)
+	if len(page.Items) != 2 {
+		t.Fatalf("Client.ListPage with $in: got %d items, want 2", len(page.Items))
+	}
+
+	_, err = b.ListPage(ctx, storage.ListOptions{Sort: "secret"})
+	is(t, "ListPage sorted outside the policy", err, storage.ErrInvalid)
+	_, err = b.ListPage(ctx, storage.ListOptions{Cursor: "not a cursor"})
+	is(t, "ListPage with a bad cursor", err, storage.ErrInvalid)
+}
+
+func testListPageMissingSort(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	b := bucket(t, c)
+
+	// a, b and c have no n, they sort before every n
+	for _, key := range []string{"a", "b", "c"} {
+		ok(t, "Store", b.Store(ctx, key, map[string]any{"name": key}))
+	}
+	for i, key := range []string{"d", "e", "f"} {
+		ok(t, "Store", b.Store(ctx, key, doc(key, 3-i)))
+	}
+
+	walk := func(sort string) []string {
+		var seen []string
+		opts := storage.ListOptions{Limit: 2, Sort: sort}
+		for pages := 0; ; pages++ {
+			if pages > 6 {
+				t.Fatalf("ListPage %s: cursor never ran out", sort)
+			}
+			page, err := b.ListPage(ctx, opts)
+			ok(t, "ListPage "+sort, err)
+			for _, item := range page.Items {
+				key, _ := item["key"].(string)
+				seen = append(seen, key)
+			}
+			if page.Next == "" {
+				return seen
+			}
+			opts.Cursor = page.Next
+		}
+	}
+	equal(t, "ListPage n", walk("n"), []string{"a", "b", "c", "f", "e", "d"})
+	equal(t, "ListPage -n", walk("-n"), []string{"d", "e", "f", "c", "b", "a"})
+}
+
+func testTrash(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	b := bucket(t, c)
+
+	ok(t, "Store", b.Store(ctx, "a", doc("alpha", 1)))
+	ok(t, "Store", b.Store(ctx, "b", doc("beta", 2)))
+	ok(t, "Delete", c.Delete(ctx, b.Name(), "a"))
+
+	// a trashed document is hidden from every read and write
+	_, err := b.Retrieve(ctx, "a")
+	is(t, "Retrieve trashed", err, storage.ErrNotFound)
+	_, err = b.Lookup(ctx, map[string]any{"name": "alpha"})
+	is(t, "Lookup trashed", err, storage.ErrNotFound)
+	is(t, "Patch trashed", b.Patch(ctx, "a", map[string]any{"n": 3}), storage.ErrNotFound)
+	is(t, "Delete trashed", b.Delete(ctx, "a"), storage.ErrNotFound)
+	count(t, ctx, b, 1)
+
+	trash, err := b.ListTrash(ctx, storage.ListOptions{})
+	ok(t, "ListTrash", err)
+	if len(trash.Items) != 1 || trash.Items[0]["key"] != "a" || !storage.IsDeleted(trash.Items[0]) {
+		t.Fatalf("ListTrash: got %v", trash.Items)
+	}
+
+	ok(t, "Restore", b.Restore(ctx, "a"))
+	got, err := b.Retrieve(ctx, "a")
+	ok(t, "Retrieve restored", err)
+	equal(t, "Retrieve restored", got, doc("alpha", 1))
+	is(t, "Restore live", b.Restore(ctx, "a"), storage.ErrNotFound)
+	count(t, ctx, b, 2)
+
+	// Purge only removes what was trashed before the cutoff
+	ok(t, "Delete", b.Delete(ctx, "a"))
+	n, err := b.Purge(ctx, time.Now().Add(-time.Hour))
+	ok(t, "Purge", err)
+	if n != 0 {
+		t.Fatalf("Purge before the delete: removed %d, want 0", n)
+	}
+	n, err = b.Purge(ctx, time.Now().Add(time.Minute))
+	ok(t, "Purge", err)
+	if n != 1 {
+		t.Fatalf("Purge: removed %d, want 1", n)
+	}
+	trash, err = b.ListTrash(ctx, storage.ListOptions{})
+	ok(t, "ListTrash", err)
+	if len(trash.Items) != 0 {
+		t.Fatalf("ListTrash after Purge: got %v", trash.Items)
+	}
+	is(t, "Restore purged", b.Restore(ctx, "a"), storage.ErrNotFound)
+	count(t, ctx, b, 1)
+}
+
+func testUniqueIndex(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	b := bucket(t, c, storage.Index{Fields: []string{"name"}, Unique: true})
+
+	ok(t, "Store", b.Store(ctx, "a", doc("alpha", 1)))
+	is(t, "Store a duplicate", b.Store(ctx, "b", doc("alpha", 2)), storage.ErrConflict)
+	is(t, "Patch into a duplicate", func() error {
+		ok(t, "Store", b.Store(ctx, "c", doc("gamma", 3)))
+		return b.Patch(ctx, "c", map[string]any{"name": "alpha"})
+	}(), storage.ErrConflict)
+	// rewriting the same key is not a conflict
+	ok(t, "Store the same key", b.Store(ctx, "a", doc("alpha", 4)))
+	// documents without the field are not indexed
+	ok(t, "Store without the field", b.Store(ctx, "d", map[string]any{"n": 5}))
+	ok(t, "Store without the field", b.Store(ctx, "e", map[string]any{"n": 6}))
+	count(t, ctx, b, 4)
+}
+
+// indexes declared without a tenant hold in the buckets of every tenant,
+// which never declare them themselves
+func testTenantIndexes(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	tc := storage.Tenants(c)
+	plain := bucket(t, tc, storage.Index{Fields: []string{"name"}, Unique: true})
+
+	for _, tenant := range []string{"team-a", "team-b"} {
+		b := tc.ConnectOrCreateBucket(storage.WithTenant(ctx, tenant), plain.Name())
+		if b.Name() != storage.Qualify(tenant, plain.Name()) {
+			t.Fatalf("ConnectOrCreateBucket for %s: got bucket %q", tenant, b.Name())
+		}
+		ok(t, "Store in "+tenant, b.Store(ctx, "a", doc("alpha", 1)))
+		is(t, "Store duplicate in "+tenant, b.Store(ctx, "b", doc("alpha", 2)), storage.ErrConflict)
+		_, err := b.BatchStore(ctx, []storage.Item{{Key: "c", Value: doc("alpha", 3)}})
+		ok(t, "BatchStore duplicate in "+tenant, err)
+		_, err = b.Retrieve(ctx, "c")
+		is(t, "Retrieve rejected duplicate in "+tenant, err, storage.ErrNotFound)
+	}
+
+	// the tenants do not conflict with each other or the default tenant
+	ok(t, "Store in the default tenant", plain.Store(ctx, "a", doc("alpha", 1)))
+	is(t, "Store duplicate in the default tenant", plain.Store(ctx, "b", doc("alpha", 2)), storage.ErrConflict)
+}
+
+func testTenantBuckets(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	tc := storage.Tenants(c)
+	plain := bucket(t, tc)
+	other := plain.Name() + "other"
+
+	// a bucket is listed once it holds a document
+	ok(t, "Store", plain.Store(ctx, "a", doc("alpha", 1)))
+	for tenant, name := range map[string]string{"tb-a": plain.Name(), "tb-b": other} {
+		b := tc.ConnectOrCreateBucket(storage.WithTenant(ctx, tenant), name)
+		ok(t, "Store in "+tenant, b.Store(ctx, "a", doc("alpha", 1)))
+	}
+
+	names, err := c.Buckets(ctx)
+	ok(t, "Buckets", err)
+	for _, name := range []string{plain.Name(), storage.Qualify("tb-a", plain.Name()), storage.Qualify("tb-b", other)} {
+		if !slices.Contains(names, name) {
+			t.Fatalf("Buckets: got %v, want %q among them", names, name)
+		}
+	}
+	names, err = tc.Buckets(storage.WithTenant(ctx, "tb-a"))
+	ok(t, "Buckets of a tenant", err)
+	equal(t, "Buckets of a tenant", names, []string{plain.Name()})
+
+	tenants, err := storage.TenantsOf(ctx, tc, plain.Name())
+	ok(t, "TenantsOf", err)
+	equal(t, "TenantsOf", tenants, []string{"", "tb-a"})
+	tenants, err = storage.TenantsOf(ctx, tc, other)
+	ok(t, "TenantsOf", err)
+	equal(t, "TenantsOf", tenants, []string{"tb-b"})
+}
+
+func testBatch(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	b := bucket(t, c, storage.Index{Fields: []string{"name"}, Unique: true})
+
+	results, err := b.BatchStore(ctx, []storage.Item{
+		{Key: "a", Value: doc("alpha", 1)},
+		{Key: "b", Value: doc("beta", 2)},
+		{Key: "c", Value: doc("alpha", 3)},
+	})
+	ok(t, "BatchStore", err)
+	if len(results) != 3 || results[0].Key != "a" || results[2].Key != "c" {
+		t.Fatalf("BatchStore: results out of order %v", results)
+	}
+	failed := storage.Failed(results)
+	if len(failed) != 1 || failed[0].Key != "c" {
+		t.Fatalf("BatchStore: got failures %v, want c", failed)
+	}
+	is(t, "BatchStore duplicate", failed[0].Err, storage.ErrConflict)
+	count(t, ctx, b, 2)
+
+	results, err = b.BatchPatch(ctx, []storage.Change{
+		{Key: "a", Updates: map[string]any{"n": 10}},
+		{Key: "missing", Updates: map[string]any{"n": 11}},
+	})
+	ok(t, "BatchPatch", err)
+	if len(results) != 2 || results[0].Err != nil {
+		t.Fatalf("BatchPatch: got %v", results)
+	}
+	is(t, "BatchPatch missing", results[1].Err, storage.ErrNotFound)
+	got, err := b.Retrieve(ctx, "a")
+	ok(t, "Retrieve", err)
+	equal(t, "Retrieve after BatchPatch", got, doc("alpha", 10))
+
+	results, err = b.BatchDelete(ctx, []string{"a", "missing", "b"})
+	ok(t, "BatchDelete", err)
+	if len(results) != 3 || results[0].Err != nil || results[2].Err != nil {
+		t.Fatalf("BatchDelete: got %v", results)
+	}
+	is(t, "BatchDelete missing", results[1].Err, storage.ErrNotFound)
+	count(t, ctx, b, 0)
+}
+
+func testTTL(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	b := bucket(t, c)
+
+	is(t, "StoreWithTTL without a ttl", b.StoreWithTTL(ctx, "a", doc("alpha", 1), 0), storage.ErrInvalid)
+	ok(t, "StoreWithTTL", b.StoreWithTTL(ctx, "a", doc("alpha", 1), 200*time.Millisecond))
+	ok(t, "StoreWithTTL", b.StoreWithTTL(ctx, "b", doc("beta", 2), time.Hour))
+	got, err := b.Retrieve(ctx, "a")
+	ok(t, "Retrieve before expiry", err)
+	equal(t, "Retrieve before expiry", got, doc("alpha", 1))
+	count(t, ctx, b, 2)
+
+	time.Sleep(300 * time.Millisecond)
+	_, err = b.Retrieve(ctx, "a")
+	is(t, "Retrieve expired", err, storage.ErrNotFound)
+	_, err = b.Lookup(ctx, map[string]any{"name": "alpha"})
+	is(t, "Lookup expired", err, storage.ErrNotFound)
+	count(t, ctx, b, 1)
+
+	// Store clears the expiry
+	ok(t, "Store", b.Store(ctx, "b", doc("beta", 3)))
+	got, err = b.Retrieve(ctx, "b")
+	ok(t, "Retrieve", err)
+	equal(t, "Retrieve after Store", got, doc("beta", 3))
+}
+
+func testAggregate(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	b := bucket(t, c)
+
+	ok(t, "Store", b.Store(ctx, "a", doc("alpha", 1, "x", "y")))
+	ok(t, "Store", b.Store(ctx, "b", doc("beta", 2, "x")))
+	ok(t, "Store", b.Store(ctx, "c", doc("gamma", 4)))
+	ok(t, "Store", b.Store(ctx, "d", doc("delta", 8, "y")))
+	ok(t, "Delete", b.Delete(ctx, "d"))
+
+	counts, err := storage.GroupCount(ctx, b, "tags")
+	ok(t, "GroupCount", err)
+	equal(t, "GroupCount", counts, map[string]int64{"x": 2, "y": 1})
+
+	groups, err := b.Aggregate(ctx, storage.Aggregation{Sum: []string{"n"}})
+	ok(t, "Aggregate", err)
+	if len(groups) != 1 || groups[0].Count != 3 || groups[0].Sums["n"] != 7 {
+		t.Fatalf("Aggregate: got %+v, want a single group of 3 summing to 7", groups)
+	}
+	groups, err = b.Aggregate(ctx, storage.Aggregation{GroupBy: "tags", Filter: map[string]any{"n": map[string]any{"$gt": 1}}})
+	ok(t, "Aggregate filtered", err)
+	if len(groups) != 2 || groups[0].Count != 1 || groups[1].Count != 1 {
+		t.Fatalf("Aggregate filtered: got %+v, want x and the nil group once each", groups)
+	}
+	_, err = b.Aggregate(ctx, storage.Aggregation{GroupBy: "secret"})
+	is(t, "Aggregate outside the policy", err, storage.ErrInvalid)
+}
+
+func testSearch(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	b := bucket(t, c, storage.Index{Fields: []string{"name", "tags"}, Text: true})
+
+	ok(t, "Store", b.Store(ctx, "a", doc("Red fox", 1)))
+	ok(t, "Store", b.Store(ctx, "b", doc("fox", 2, "fox")))
+	ok(t, "Store", b.Store(ctx, "c", doc("blue whale", 4, "fox")))
+	ok(t, "Store", b.Store(ctx, "d", doc("fox", 8)))
+	ok(t, "Store", b.Store(ctx, "e", doc("brown bear", 16)))
+	ok(t, "Delete", b.Delete(ctx, "d"))
+
+	keys := func(docs []map[string]any) []string {
+		out := make([]string, len(docs))
+		for i, doc := range docs {
+			out[i], _ = doc["key"].(string)
+		}
+		return out
+	}
+	// matched in both fields ranks first, the order of ties is the backend's
+	docs, err := b.Search(ctx, "FOX", nil, 0)
+	ok(t, "Search", err)
+	got := keys(docs)
+	if len(got) != 3 || got[0] != "b" {
+		t.Fatalf("Search: got %v, want b then a and c", got)
+	}
+	slices.Sort(got)
+	equal(t, "Search", got, []string{"a", "b", "c"})
+	equal(t, "Search value", docs[0]["value"], doc("fox", 2, "fox"))
+
+	docs, err = b.Search(ctx, "fox", []string{"name"}, 0)
+	ok(t, "Search name", err)
+	got = keys(docs)
+	slices.Sort(got)
+	equal(t, "Search name", got, []string{"a", "b"})
+
+	// the projection leaves the searched fields out unless they are asked for
+	docs, err = b.Search(ctx, "fox", []string{"name"}, 0, "n")
+	ok(t, "Search projecting n", err)
+	equal(t, "Search projecting n", len(docs), 2)
+	for _, found := range docs {
+		want := map[string]any{"n": 1}
+		if found["key"] == "b" {
+			want["n"] = 2
+		}
+		equal(t, "Search projecting n", found["value"], want)
+	}
+	docs, err = b.Search(ctx, "fox", []string{"name"}, 1, "name")
+	ok(t, "Search name limit", err)
+	equal(t, "Search name limit", len(docs), 1)
+	if _, ok := docs[0]["value"].(map[string]any)["n"]; ok {
+		t.Fatalf("Search name limit: got %v, want only the name", docs[0]["value"])
+	}
+
+	docs, err = b.Search(ctx, "whale bear", nil, 0)
+	ok(t, "Search any word", err)
+	got = keys(docs)
+	slices.Sort(got)
+	equal(t, "Search any word", got, []string{"c", "e"})
+
+	docs, err = b.Search(ctx, "fox", nil, 1)
+	ok(t, "Search limit", err)
+	equal(t, "Search limit", keys(docs), []string{"b"})
+
+	docs, err = b.Search(ctx, "otter", nil, 0)
+	ok(t, "Search no match", err)
+	equal(t, "Search no match", len(docs), 0)
+
+	_, err = b.Search(ctx, " !? ", nil, 0)
+	is(t, "Search empty", err, storage.ErrInvalid)
+	_, err = b.Search(ctx, "fox", []string{"n"}, 0)
+	is(t, "Search unindexed field", err, storage.ErrInvalid)
+	_, err = b.Search(ctx, "fox", nil, -1)
+	is(t, "Search negative limit", err, storage.ErrInvalid)
+	_, err = b.Search(ctx, "fox", nil, 0, "")
+	is(t, "Search projecting \"\"", err, storage.ErrInvalid)
+
+	plain := c.ConnectOrCreateBucket(ctx, b.Name()+"plain")
+	_, err = plain.Search(ctx, "fox", nil, 0)
+	is(t, "Search without text index", err, storage.ErrInvalid)
+
+	// better matches in the other fields do not crowd out the searched one
+	for i := range 8 {
+		ok(t, "Store", b.Store(ctx, fmt.Sprintf("t%d", i), doc("whale", i, "fox", "fox", "fox")))
+	}
+	docs, err = b.Search(ctx, "fox", []string{"name"}, 2)
+	ok(t, "Search name behind other fields", err)
+	got = keys(docs)
+	slices.Sort(got)
+	equal(t, "Search name behind other fields", got, []string{"a", "b"})
+}
+
+func testProjection(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	b := bucket(t, c)
+
+	full := map[string]any{"name": "alpha", "n": 1, "nested": map[string]any{"x": 1, "y": 2}, "secret": "s"}
+	ok(t, "Store", b.Store(ctx, "a", full))
+	ok(t, "Store", b.Store(ctx, "b", map[string]any{"name": "beta", "n": 2, "secret": "t"}))
+	ok(t, "Store", b.Store(ctx, "c", map[string]any{"name": "gamma", "n": 3, "secret": "u"}))
+
+	got, err := b.Lookup(ctx, map[string]any{"name": "alpha"}, "name", "nested.x")
+	ok(t, "Lookup projected", err)
+	equal(t, "Lookup projected", got, map[string]any{"name": "alpha", "nested": map[string]any{"x": 1}})
+	got, err = b.Lookup(ctx, map[string]any{"name": "alpha"})
+	ok(t, "Lookup", err)
+	equal(t, "Lookup", got, full)
+	got, err = b.Lookup(ctx, map[string]any{"name": "alpha"}, "missing")
+	ok(t, "Lookup missing field", err)
+	equal(t, "Lookup missing field", got, map[string]any{})
+	got, err = c.Lookup(ctx, b.Name(), map[string]any{"name": "beta"}, "n")
+	ok(t, "Client.Lookup projected", err)
+	equal(t, "Client.Lookup projected", got, map[string]any{"n": 2})
+
+	// LookupItem reads the same value along with its key and revision
+	item, err := b.LookupItem(ctx, map[string]any{"name": "alpha"}, "n")
+	ok(t, "LookupItem projected", err)
+	if item["key"] != "a" || storage.Revision(item) != 1 {
+		t.Fatalf("LookupItem projected: got key %v rev %d, want a at 1", item["key"], storage.Revision(item))
+	}
+	equal(t, "LookupItem projected", item["value"], map[string]any{"n": 1})
+	_, err = b.LookupItem(ctx, map[string]any{"name": "missing"})
+	is(t, "LookupItem missing", err, storage.ErrNotFound)
+
+	// the sort field does not have to be projected for the cursor to work
+	opts := storage.ListOptions{Limit: 2, Sort: "-n", Fields: []string{"name"}}
+	page, err := b.ListPage(ctx, opts)
+	ok(t, "ListPage projected", err)
+	if len(page.Items) != 2 || page.Next == "" {
+		t.Fatalf("ListPage projected: got %d items next=%q, want 2 and a cursor", len(page.Items), page.Next)
+	}
+	equal(t, "ListPage projected", page.Items[0]["value"], map[string]any{"name": "gamma"})
+	if storage.Revision(page.Items[0]) != 1 {
+		t.Fatalf("ListPage projected: got rev %d, want 1", storage.Revision(page.Items[0]))
+	}
+	opts.Cursor = page.Next
+	page, err = b.ListPage(ctx, opts)
+	ok(t, "ListPage projected next", err)
+	if len(page.Items) != 1 {
+		t.Fatalf("ListPage projected next: got %d items, want 1", len(page.Items))
+	}
+	equal(t, "ListPage projected next", page.Items[0]["value"], map[string]any{"name": "alpha"})
+
+	for _, fields := range [][]string{{""}, {"$where"}, {"nested", "nested.x"}, {"name", "name"}} {
+		_, err = b.Lookup(ctx, map[string]any{"name": "alpha"}, fields...)
+		is(t, fmt.Sprintf("Lookup projecting %q", fields), err, storage.ErrInvalid)
+		_, err = b.ListPage(ctx, storage.ListOptions{Fields: fields})
+		is(t, fmt.Sprintf("ListPage projecting %q", fields), err, storage.ErrInvalid)
+	}
+}
+
+func testConcurrentWriters(t *testing.T, c storage.Client) {
+	ctx := context5s(t)
+	b := bucket(t, c)
+	const writers, writes = 8, 20
+
+	// read, modify, CompareAndSwap, retried on ErrStale, loses no increment
+	ok(t, "Store", b.Store(ctx, "counter", map[string]any{"n": 0}))
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*2)
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range writes {
+				for {
+					value, rev, err := b.RetrieveRevision(ctx, "counter")
+					if err != nil {
+						errs <- err
+						return
+					}
+					m, _ := value.(map[string]any)
+					next := integer(m["n"]) + 1
+					_, err = b.CompareAndSwap(ctx, "counter", rev, map[string]any{"n": next})
+					if errors.Is(err, storage.ErrStale) {
+						continue
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+					break
+				}
+			}
+		}()
+	}
+	// writers of distinct keys do not lose each other either
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range writes {
+				if err := b.Store(ctx, fmt.Sprintf("w%d-%d", w, i), doc("w", i)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent write: %v", err)
+	}
+
+	got, err := b.Retrieve(ctx, "counter")
+	ok(t, "Retrieve", err)
+	m, _ := got.(map[string]any)
+	if n := integer(m["n"]); n != writers*writes {
+		t.Fatalf("counter: got %d, want %d", n, writers*writes)
+	}
+	count(t, ctx, b, writers*writes+1)
+}
+
+// Watch is optional (e.g. mongo without a replica set), a backend that
+// cannot watch must say so instead of returning a silent channel
+func testWatch(t *testing.T, c storage.Client) {
+	ctx, cancel := context.WithCancel(context5s(t))
+	b := bucket(t, c)
+
+	events, err := b.Watch(ctx)
+	if err != nil {
+		cancel()
+		t.Skipf("Watch: %v", err)
+	}
+	ok(t, "Store", b.Store(ctx, "a", doc("alpha", 1)))
+	ok(t, "Patch", b.Patch(ctx, "a", map[string]any{"n": 2}))
+	ok(t, "Delete", b.Delete(ctx, "a"))
+
+	want := []storage.Op{storage.OpInsert, storage.OpUpdate, storage.OpDelete}
+	for i, op := range want {
+		select {
+		case ev, open := <-events:
+			if !open {
+				t.Fatalf("Watch: closed after %d events", i)
+			}
+			if ev.Op != op || ev.Key != "a" || ev.Rev != int64(i+1) {
+				t.Fatalf("Watch event %d: got %s %q@%d, want %s \"a\"@%d", i, ev.Op, ev.Key, ev.Rev, op, i+1)
+			}
+			if op == storage.OpUpdate {
+				equal(t, "Watch update value", ev.Value, doc("alpha", 2))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Watch: no %s event", op)
+		}
+	}
+
+	// the channel is closed once ctx is done
+	cancel()
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case _, open := <-events:
+			if !open {
+				return
+			}
+		case <-deadline:
+			t.Fatal("Watch: channel still open after cancel")
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// @NOTE tenants share one database, every bucket a tenant touches is
+// qualified with its id so that tenants never see each other's data
+//
+//	ctx := storage.WithTenant(ctx, "team-a")
+//	client.ConnectOrCreateBucket(ctx, "usersv1") // -> "team-a__usersv1"
+//
+// drivers.Open wraps every client with Tenants, a context without a tenant
+// reaches the unqualified buckets (the default tenant)
+// policies, encryption and the Manager registry keep using the plain
+// bucket name, only the backends (and so Cache and Instrument) see the
+// qualified one
+//
+// indexes are declared once per plain bucket name (services declare them
+// when they are constructed, without a tenant), the Tenants client keeps
+// them and creates them on the bucket of every tenant the first time the
+// tenant opens it in this process
+// note: bucket names must not contain TenantSeparator
+// //
+
+// TenantSeparator joins a tenant id and a bucket name
+const TenantSeparator = "__"
+
+// tenant ids are lowercase letters, digits and dashes
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// ValidTenant returns ErrInvalid unless tenant is "" or a valid tenant id
+func ValidTenant(tenant string) error {
+	if tenant != "" && !tenantPattern.MatchString(tenant) {
+		return fmt.Errorf("%w: tenant %q", ErrInvalid, tenant)
+	}
+	return nil
+}
+
+type tenantKey struct{}
+
+// WithTenant attaches the tenant whose buckets the caller reaches to ctx
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFrom returns the tenant attached with WithTenant, "" if none
+func TenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// Qualify returns the name of bucket as stored for tenant
+func Qualify(tenant, bucket string) string {
+	if tenant == "" {
+		return bucket
+	}
+	return tenant + TenantSeparator + bucket
+}
+
+// SplitTenant splits a qualified bucket name into its tenant and bucket
+func SplitTenant(name string) (tenant, bucket string) {
+	if t, b, ok := strings.Cut(name, TenantSeparator); ok && tenantPattern.MatchString(t) {
+		return t, b
+	}
+	return "", name
+}
+
+// Tenants returns c with every bucket qualified by the tenant of the context
+func Tenants(c Client) Client {
+	return &tenantClient{
+		Client:   c,
+		declared: make(map[string]*declaration),
+		applied:  make(map[string]int),
+	}
+}
+
+// tenantClient hands out the buckets of the calling tenant
+type tenantClient struct {
+	Client
+
+	mu       sync.Mutex
+	declared map[string]*declaration // map[bucket]indexes declared on it
+	applied  map[string]int          // map[qualified bucket]declaration version created
+}
+
+// declaration is the union of the indexes declared on a bucket, version
+// is bumped whenever it grows
+type declaration struct {
+	indexes []Index
+	version int
+}
+
+// ConnectOrCreateBucket returns the bucket of the calling tenant, creating
+// the indexes declared on bucket (by any tenant) that it does not have yet
+func (tc *tenantClient) ConnectOrCreateBucket(ctx context.Context, bucket string, indexes ...Index) Bucket {
+	tenant := TenantFrom(ctx)
+	if err := ValidTenant(tenant); err != nil {
+		return denied{name: bucket, err: err}
+	}
+	name := Qualify(tenant, bucket)
+	pending, version := tc.pending(bucket, name, indexes)
+	b := tc.Client.ConnectOrCreateBucket(ctx, name, pending...)
+	if len(pending) > 0 && ctx.Err() == nil {
+		// note: backends log index errors rather than return them, a
+		// done context is the one failure retried on the next open
+		tc.mu.Lock()
+		tc.applied[name] = max(tc.applied[name], version)
+		tc.mu.Unlock()
+	}
+	return b
+}
+
+// pending records indexes as declared on bucket and returns the declared
+// indexes the qualified bucket name still needs, with their version
+func (tc *tenantClient) pending(bucket, name string, indexes []Index) ([]Index, int) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	decl, ok := tc.declared[bucket]
+	if !ok {
+		decl = &declaration{}
+		tc.declared[bucket] = decl
+	}
+	for _, idx := range indexes {
+		if !slices.ContainsFunc(decl.indexes, func(d Index) bool { return d.Name() == idx.Name() }) {
+			decl.indexes = append(decl.indexes, idx)
+			decl.version++
+		}
+	}
+	if tc.applied[name] == decl.version {
+		// note: indexes declared again are passed on as is
+		return indexes, decl.version
+	}
+	return slices.Clone(decl.indexes), decl.version
+}
+
+func (tc *tenantClient) Store(ctx context.Context, bucket string, key string, value any) error {
+	return tc.ConnectOrCreateBucket(ctx, bucket).Store(ctx, key, value)
+}
+
+func (tc *tenantClient) Retrieve(ctx context.Context, bucket string, key string) (any, error) {
+	return tc.ConnectOrCreateBucket(ctx, bucket).Retrieve(ctx, key)
+}
+
+func (tc *tenantClient) Delete(ctx context.Context, bucket string, key string) error {
+	return tc.ConnectOrCreateBucket(ctx, bucket).Delete(ctx, key)
+}
+
+func (tc *tenantClient) Update(ctx context.Context, bucket string, key string, value any) error {
+	return tc.ConnectOrCreateBucket(ctx, bucket).Update(ctx, key, value)
+}
+
+func (tc *tenantClient) Patch(ctx context.Context, bucket, key string, updates map[string]any) error {
+	return tc.ConnectOrCreateBucket(ctx, bucket).Patch(ctx, key, updates)
+}
+
+func (tc *tenantClient) List(ctx context.Context, bucket string) ([]any, error) {
+	return tc.ConnectOrCreateBucket(ctx, bucket).ListKeys(ctx)
+}
+
+func (tc *tenantClient) ListPage(ctx context.Context, bucket string, opts ListOptions) (Page, error) {
+	return tc.ConnectOrCreateBucket(ctx, bucket).ListPage(ctx, opts)
+}
+
+func (tc *tenantClient) Lookup(ctx context.Context, bucket string, key any, fields ...string) (map[string]any, error) {
+	return tc.ConnectOrCreateBucket(ctx, bucket).Lookup(ctx, key, fields...)
+}
+
+func (tc *tenantClient) Count(ctx context.Context, bucket string) (int64, error) {
+	return tc.ConnectOrCreateBucket(ctx, bucket).Count(ctx)
+}
+
+// Buckets lists the buckets of the calling tenant by their plain names,
+// the default tenant sees every bucket as stored, qualified names included
+func (tc *tenantClient) Buckets(ctx context.Context) ([]string, error) {
+	tenant := TenantFrom(ctx)
+	if err := ValidTenant(tenant); err != nil {
+		return nil, err
+	}
+	names, err := tc.Client.Buckets(ctx)
+	if err != nil || tenant == "" {
+		return names, err
+	}
+	out := make([]string, 0, len(names))
+	for _, name := range names {
+		if t, bucket := SplitTenant(name); t == tenant {
+			out = append(out, bucket)
+		}
+	}
+	return out, nil
+}
+
+// TenantsOf returns the tenants that have bucket, sorted, "" stands for
+// the default tenant
+// note: c must be tenant aware (see Tenants), the tenants are read from
+// the qualified bucket names of the database
+func TenantsOf(ctx context.Context, c Client, bucket string) ([]string, error) {
+	names, err := c.Buckets(WithTenant(ctx, ""))
+	if err != nil {
+		return nil, err
+	}
+	var tenants []string
+	for _, name := range names {
+		if tenant, plain := SplitTenant(name); plain == bucket && !slices.Contains(tenants, tenant) {
+			tenants = append(tenants, tenant)
+		}
+	}
+	slices.Sort(tenants)
+	return tenants, nil
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// @NOTE Delete is a soft delete, the document stays in the bucket with a
+// tombstone {at, by} under "deleted" and is hidden from every read
+// (Retrieve, Lookup, List*, Count) and write (Update, Patch, ...)
+//
+//	{key, value, rev, deleted: {at: <time>, by: "admin"}}
+//
+// ListTrash pages through the tombstoned documents, Restore brings one
+// back and Purge removes the ones deleted before a cutoff for good
+// note: a trashed document keeps its unique index entries so that Restore
+// can not collide, Store on a trashed key replaces it with a live document
+// //
+
+// Deleted is the document field holding the tombstone
+const Deleted = "deleted"
+
+type actorKey struct{}
+
+// WithActor attaches the caller recorded as "by" in tombstones to ctx
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the caller attached with WithActor, RoleSystem if none
+func ActorFrom(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return RoleSystem
+}
+
+// Tombstone returns the "deleted" field written by Delete
+func Tombstone(ctx context.Context) map[string]any {
+	return map[string]any{
+		"at": primitive.NewDateTimeFromTime(time.Now()),
+		"by": ActorFrom(ctx),
+	}
+}
+
+// IsDeleted reports whether a decoded document carries a tombstone
+func IsDeleted(doc map[string]any) bool {
+	return doc[Deleted] != nil
+}
+
+// DeletedBefore reports whether a decoded document was trashed before cutoff
+func DeletedBefore(doc map[string]any, cutoff time.Time) bool {
+	at, ok := Resolve(doc, Deleted+".at")
+	if !ok {
+		return false
+	}
+	dt, ok := at.(primitive.DateTime)
+	return ok && dt.Time().Before(cutoff)
+}
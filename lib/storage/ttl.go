@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// @NOTE StoreWithTTL writes the document with an "expires_at" date, once it
+// passes the document is hidden from every read and write like a deleted
+// one and removed shortly after
+//
+//	mongo          -> a TTL index, the server removes it within about a minute
+//	memory, sqlite -> a sweep on the first write after SweepInterval
+//
+// until it is removed it may still hold its unique index entries, and its
+// removal is reported to watchers as an OpDelete
+// note: Store and BatchStore clear the expiry, Update and Patch keep it
+// //
+
+// Expires is the document field holding the expiry date
+const Expires = "expires_at"
+
+// SweepInterval is how often the backends without TTL indexes look for
+// expired documents
+const SweepInterval = time.Minute
+
+// Expiry returns the "expires_at" date of a document stored now with ttl
+func Expiry(ttl time.Duration) primitive.DateTime {
+	return primitive.NewDateTimeFromTime(time.Now().Add(ttl))
+}
+
+// IsExpired reports whether a decoded document expired before now
+func IsExpired(doc map[string]any, now time.Time) bool {
+	at, ok := doc[Expires].(primitive.DateTime)
+	return ok && !at.Time().After(now)
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TypedBucket wraps a Bucket and decodes stored values directly into T
+// using its bson tags, e.g.
+//
+//	users := storage.Typed[api.User](client.ConnectOrCreateBucket(ctx, "usersv1"))
+//	user, err := users.Find(ctx, bson.M{"username": "dirtpig"})
+//
+// the untyped Bucket methods remain available through embedding
+type TypedBucket[T any] struct {
+	Bucket
+}
+
+// Typed returns a TypedBucket[T] view of b
+func Typed[T any](b Bucket) *TypedBucket[T] {
+	return &TypedBucket[T]{Bucket: b}
+}
+
+// Get returns the value stored at key decoded into T
+func (tb *TypedBucket[T]) Get(ctx context.Context, key string) (T, error) {
+	var zero T
+	raw, err := tb.Retrieve(ctx, key)
+	if err != nil {
+		return zero, err
+	}
+	return Decode[T](raw)
+}
+
+// GetRevision returns the value stored at key decoded into T along with
+// its revision, for use with CompareAndSwap / PatchIfRevision
+func (tb *TypedBucket[T]) GetRevision(ctx context.Context, key string) (T, int64, error) {
+	var zero T
+	raw, rev, err := tb.RetrieveRevision(ctx, key)
+	if err != nil {
+		return zero, 0, err
+	}
+	value, err := Decode[T](raw)
+	return value, rev, err
+}
+
+// Put stores value at key
+func (tb *TypedBucket[T]) Put(ctx context.Context, key string, value T) error {
+	return tb.Store(ctx, key, value)
+}
+
+// Find returns the first value matching filter decoded into T, fields
+// project it (the other fields of T are left zero)
+// note: the filter goes through Lookup and is gated the same way
+func (tb *TypedBucket[T]) Find(ctx context.Context, filter any, fields ...string) (T, error) {
+	var zero T
+	raw, err := tb.Lookup(ctx, filter, fields...)
+	if err != nil {
+		return zero, err
+	}
+	return Decode[T](raw)
+}
+
+// FindRevision is Find along with the revision of the value found, for
+// use with CompareAndSwap / PatchIfRevision
+func (tb *TypedBucket[T]) FindRevision(ctx context.Context, filter any, fields ...string) (T, int64, error) {
+	var zero T
+	doc, err := tb.LookupItem(ctx, filter, fields...)
+	if err != nil {
+		return zero, 0, err
+	}
+	value, err := Decode[T](doc["value"])
+	return value, Revision(doc), err
+}
+
+// List returns every value in the bucket decoded into T
+func (tb *TypedBucket[T]) List(ctx context.Context) ([]T, error) {
+	raws, err := tb.ListKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]T, 0, len(raws))
+	for _, raw := range raws {
+		value, err := Decode[T](raw)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// Decode converts a value read from storage (map[string]any, primitive.A, ...)
+// into T by round tripping it through BSON
+func Decode[T any](raw any) (T, error) {
+	var out struct {
+		V T `bson:"v"`
+	}
+	data, err := bson.Marshal(bson.M{"v": raw})
+	if err != nil {
+		return out.V, err
+	}
+	if err := bson.Unmarshal(data, &out); err != nil {
+		return out.V, err
+	}
+	return out.V, nil
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"sync"
+
+	logs "github.com/danmuck/dps_lib/logs"
+)
+
+// Op is the kind of write an Event reports
+type Op string
+
+const (
+	OpInsert Op = "insert"
+	OpUpdate Op = "update"
+	OpDelete Op = "delete"
+)
+
+// Event is one write on a bucket as seen by Watch
+// a soft delete is an OpDelete and a Restore an OpInsert, Purge is silent
+type Event struct {
+	Op    Op
+	Key   string
+	Value any   // the new value decoded like Retrieve, nil for OpDelete
+	Rev   int64 // the new revision
+}
+
+// how many events a watcher may fall behind before it is dropped
+const watchBuffer = 1024
+
+// Feed fans the events of one bucket out to its watchers, it backs Watch
+// for the backends without a native change stream (memory, sqlite)
+// the zero Feed is ready to use
+//
+// note: a watcher that falls behind has its channel closed rather than
+// blocking writers, it should watch again and rescan what it missed
+type Feed struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// Watched reports whether anyone is subscribed,
+// writers use it to skip decoding values nobody will read
+func (f *Feed) Watched() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subs) > 0
+}
+
+// Subscribe returns a channel of the events published after the call,
+// it is closed once ctx is done
+func (f *Feed) Subscribe(ctx context.Context) <-chan Event {
+	ch := make(chan Event, watchBuffer)
+	f.mu.Lock()
+	if f.subs == nil {
+		f.subs = make(map[chan Event]struct{})
+	}
+	f.subs[ch] = struct{}{}
+	f.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		f.drop(ch)
+	}()
+	return ch
+}
+
+// Publish hands ev to every watcher without blocking
+func (f *Feed) Publish(ev Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subs {
+		select {
+		case ch <- ev:
+		default:
+			logs.Warn("dropping watcher %d events behind", watchBuffer)
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// drop unsubscribes ch if it has not been dropped already
+func (f *Feed) drop(ch chan Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subs[ch]; ok {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
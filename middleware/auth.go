@@ -16,6 +16,8 @@ type Claims struct {
 	Username string `json:"username"` // username for convenience
 	// roles is a list of roles the user has, e.g. ["admin", "user"]
 	Roles []string `json:"roles"`
+	// tenant the user belongs to, "" for the default tenant
+	Tenant string `json:"tenant,omitempty"`
 }
 
 var JWT_SECRET []byte = []byte("your_jwt_secret_here")
@@ -50,6 +52,9 @@ func JWTMiddleware() gin.HandlerFunc {
 		logs.Debug("token is valid, claims: [%v]", token.Claims)
 		claims := token.Claims.(*Claims)
 		logs.Debug("SUBJECT: %s USER: %s", claims.Subject, claims.Username)
+		if !bindTenant(c, claims) {
+			return
+		}
 
 		c.Set("username", claims.Username)
 		c.Set("user_id", claims.Subject)
@@ -79,6 +84,9 @@ func AuthorizeResourceAccess() gin.HandlerFunc {
 
 		// extract username from claims to match url param
 		claims := token.Claims.(*Claims)
+		if !bindTenant(c, claims) {
+			return
+		}
 		username := claims.Username
 		owner := c.Param("username")
 		owner_id := c.Param("id")
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/danmuck/dps_http/lib/storage"
+	logs "github.com/danmuck/dps_lib/logs"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TenantHeader selects the tenant of a request before the caller has a
+// token (login, register), afterwards the token claim decides
+const TenantHeader = "X-Tenant"
+
+// TenantMiddleware sets "tenant" from the TenantHeader, "" is the default
+// tenant; api.CallerContext hands it to storage (see storage.WithTenant)
+func TenantMiddleware() gin.HandlerFunc {
+	logs.Init("TenantMiddleware")
+	return func(c *gin.Context) {
+		tenant := c.GetHeader(TenantHeader)
+		if err := storage.ValidTenant(tenant); err != nil {
+			logs.Err("rejecting request: %v", err)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid tenant"})
+			return
+		}
+		c.Set("tenant", tenant)
+		c.Next()
+	}
+}
+
+// bindTenant sets "tenant" from the token claim, a TenantHeader naming
+// another tenant is rejected rather than silently ignored
+func bindTenant(c *gin.Context, claims *Claims) bool {
+	if header := c.GetHeader(TenantHeader); header != "" && header != claims.Tenant {
+		logs.Err("tenant mismatch: token %q header %q", claims.Tenant, header)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "token belongs to another tenant"})
+		return false
+	}
+	c.Set("tenant", claims.Tenant)
+	return true
+}